@@ -0,0 +1,334 @@
+/*
+ * Copyright 2022 RapidLoop, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rapidrows
+
+import (
+	"fmt"
+	"io"
+	"math/big"
+	"reflect"
+	"time"
+
+	"github.com/apache/arrow/go/v11/arrow"
+	"github.com/apache/arrow/go/v11/arrow/array"
+	"github.com/apache/arrow/go/v11/arrow/decimal128"
+	"github.com/apache/arrow/go/v11/arrow/ipc"
+	"github.com/apache/arrow/go/v11/arrow/memory"
+	"github.com/apache/arrow/go/v11/parquet"
+	"github.com/apache/arrow/go/v11/parquet/compress"
+	"github.com/apache/arrow/go/v11/parquet/file"
+	"github.com/apache/arrow/go/v11/parquet/pqarrow"
+	"github.com/jackc/pgtype"
+)
+
+const (
+	// arrowBatchRows is the maximum number of rows in each record batch of
+	// the Arrow IPC stream output. Streamed outputs may have smaller batches.
+	arrowBatchRows = 8192
+
+	// parquetRowGroupRows is the maximum number of rows in each row group of
+	// the Parquet output.
+	parquetRowGroupRows = 128 * 1024
+)
+
+// arrowEncoder writes out a resultset in the Apache Arrow IPC streaming
+// format, or as a Parquet file. Rows are collected into record batches (for
+// Arrow) or row groups (for Parquet) before being written out. Errors are
+// not included in the output, but if there was an error, the end-of-stream
+// marker (for Arrow) or the footer (for Parquet) is not written, so that the
+// output cannot be mistaken for a complete one.
+type arrowEncoder struct {
+	w       io.Writer
+	parquet bool // write Parquet instead of Arrow IPC
+	cols    []columnInfo
+	schema  *arrow.Schema
+	bld     *array.RecordBuilder
+	n       int // number of rows in bld
+	ipcw    *ipc.Writer
+	pqw     *pqarrow.FileWriter
+}
+
+func (e *arrowEncoder) begin(cols []columnInfo) error {
+	e.cols = cols
+	fields := make([]arrow.Field, len(cols))
+	for i, c := range cols {
+		fields[i] = arrow.Field{Name: c.Name, Type: arrowType(c.TypeOID, c.typeMod), Nullable: true}
+	}
+	e.schema = arrow.NewSchema(fields, nil)
+	e.bld = array.NewRecordBuilder(memory.DefaultAllocator, e.schema)
+	if !e.parquet {
+		e.ipcw = ipc.NewWriter(e.w, ipc.WithSchema(e.schema))
+	}
+	// the Parquet writer is created when the first row group is written, see
+	// the end method for why
+	return nil
+}
+
+func (e *arrowEncoder) row(vals []any) error {
+	for i, v := range vals {
+		if err := appendArrow(e.bld.Field(i), e.cols[i].TypeOID, v); err != nil {
+			return fmt.Errorf("column %q: %v", e.cols[i].Name, err)
+		}
+	}
+	e.n++
+	if (e.parquet && e.n >= parquetRowGroupRows) || (!e.parquet && e.n >= arrowBatchRows) {
+		return e.write()
+	}
+	return nil
+}
+
+// write writes out the rows collected so far as a record batch or row group.
+func (e *arrowEncoder) write() error {
+	if e.n == 0 {
+		return nil
+	}
+	rec := e.bld.NewRecord()
+	defer rec.Release()
+	e.n = 0
+	if !e.parquet {
+		return e.ipcw.Write(rec)
+	}
+	if e.pqw == nil {
+		var err error
+		e.pqw, err = pqarrow.NewFileWriter(e.schema, e.w, parquetProps(),
+			pqarrow.NewArrowWriterProperties(pqarrow.WithStoreSchema()))
+		if err != nil {
+			return err
+		}
+	}
+	return e.pqw.Write(rec)
+}
+
+func (e *arrowEncoder) flush() error {
+	// Writing out a row group for each flush would result in too many small
+	// row groups, so Parquet output is written only when a row group fills up.
+	if e.parquet {
+		return nil
+	}
+	return e.write()
+}
+
+func (e *arrowEncoder) end(err error) error {
+	defer e.bld.Release()
+	if err != nil {
+		return nil // leave the output incomplete
+	}
+	if err := e.write(); err != nil {
+		return err
+	}
+	if !e.parquet {
+		return e.ipcw.Close()
+	}
+	if e.pqw != nil {
+		return e.pqw.Close()
+	}
+	// pqarrow.FileWriter cannot be closed without writing any data, so write
+	// out an empty file with just the schema
+	sc, err := pqarrow.ToParquet(e.schema, parquetProps(), pqarrow.DefaultWriterProps())
+	if err != nil {
+		return err
+	}
+	return file.NewParquetWriter(e.w, sc.Root(), file.WithWriterProps(parquetProps())).Close()
+}
+
+func parquetProps() *parquet.WriterProperties {
+	return parquet.NewWriterProperties(
+		parquet.WithCompression(compress.Codecs.Snappy),
+		parquet.WithMaxRowGroupLength(parquetRowGroupRows),
+	)
+}
+
+// arrowType returns the Arrow data type used to represent values of the
+// PostgreSQL type with the given OID and type modifier. Types that do not
+// have a natural Arrow equivalent are represented as strings, in the same
+// text format as used for CSV output.
+func arrowType(oid uint32, typeMod int32) arrow.DataType {
+	switch oid {
+	case pgtype.BoolOID:
+		return arrow.FixedWidthTypes.Boolean
+	case pgtype.Int2OID:
+		return arrow.PrimitiveTypes.Int16
+	case pgtype.Int4OID:
+		return arrow.PrimitiveTypes.Int32
+	case pgtype.Int8OID:
+		return arrow.PrimitiveTypes.Int64
+	case pgtype.OIDOID:
+		return arrow.PrimitiveTypes.Uint32
+	case pgtype.Float4OID:
+		return arrow.PrimitiveTypes.Float32
+	case pgtype.Float8OID:
+		return arrow.PrimitiveTypes.Float64
+	case pgtype.NumericOID:
+		// numeric(p,s) has the type modifier ((p << 16) | s) + 4, numeric
+		// without a precision can't be represented as a decimal
+		if typeMod >= 4 {
+			prec, scale := ((typeMod-4)>>16)&0xffff, (typeMod-4)&0xffff
+			if prec <= 38 {
+				return &arrow.Decimal128Type{Precision: prec, Scale: scale}
+			}
+		}
+	case pgtype.DateOID:
+		return arrow.FixedWidthTypes.Date32
+	case pgtype.TimeOID:
+		return arrow.FixedWidthTypes.Time64us
+	case pgtype.TimestampOID:
+		return &arrow.TimestampType{Unit: arrow.Microsecond}
+	case pgtype.TimestamptzOID:
+		return &arrow.TimestampType{Unit: arrow.Microsecond, TimeZone: "UTC"}
+	case pgtype.ByteaOID:
+		return arrow.BinaryTypes.Binary
+	default:
+		if elem := arrayElemOID(oid); elem != 0 {
+			return arrow.ListOf(arrowType(elem, typeMod))
+		}
+	}
+	return arrow.BinaryTypes.String
+}
+
+// arrayElemOID returns the OID of the element type if oid is that of an array
+// of a builtin type, else 0.
+func arrayElemOID(oid uint32) uint32 {
+	dt, ok := pgTypes.DataTypeForOID(oid)
+	if !ok || len(dt.Name) < 2 || dt.Name[0] != '_' {
+		return 0
+	}
+	if elem, ok := pgTypes.DataTypeForName(dt.Name[1:]); ok {
+		return elem.OID
+	}
+	return 0
+}
+
+// appendArrow appends a value read from a column with the given type OID to
+// the builder for that column. The builder must be of the type returned by
+// arrowType for the OID.
+func appendArrow(b array.Builder, oid uint32, v any) error {
+	if v == nil {
+		b.AppendNull()
+		return nil
+	}
+	switch b := b.(type) {
+	case *array.StringBuilder:
+		b.Append(formatText(oid, v))
+		return nil
+	case *array.BooleanBuilder:
+		if v, ok := v.(bool); ok {
+			b.Append(v)
+			return nil
+		}
+	case *array.Int16Builder:
+		if v, ok := v.(int16); ok {
+			b.Append(v)
+			return nil
+		}
+	case *array.Int32Builder:
+		if v, ok := v.(int32); ok {
+			b.Append(v)
+			return nil
+		}
+	case *array.Int64Builder:
+		if v, ok := v.(int64); ok {
+			b.Append(v)
+			return nil
+		}
+	case *array.Uint32Builder:
+		if v, ok := v.(uint32); ok {
+			b.Append(v)
+			return nil
+		}
+	case *array.Float32Builder:
+		if v, ok := v.(float32); ok {
+			b.Append(v)
+			return nil
+		}
+	case *array.Float64Builder:
+		if v, ok := v.(float64); ok {
+			b.Append(v)
+			return nil
+		}
+	case *array.Decimal128Builder:
+		if v, ok := v.(pgtype.Numeric); ok {
+			if v.NaN || v.Int == nil {
+				b.AppendNull() // NaN can't be represented
+			} else {
+				scale := b.Type().(*arrow.Decimal128Type).Scale
+				b.Append(numericToDecimal128(v, scale))
+			}
+			return nil
+		}
+	case *array.Date32Builder:
+		switch v := v.(type) {
+		case time.Time:
+			b.Append(arrow.Date32FromTime(v))
+			return nil
+		case pgtype.InfinityModifier:
+			b.AppendNull() // infinity can't be represented
+			return nil
+		}
+	case *array.TimestampBuilder:
+		switch v := v.(type) {
+		case time.Time:
+			b.Append(arrow.Timestamp(v.UnixMicro()))
+			return nil
+		case pgtype.InfinityModifier:
+			b.AppendNull() // infinity can't be represented
+			return nil
+		}
+	case *array.Time64Builder:
+		if v, ok := v.(int64); ok {
+			b.Append(arrow.Time64(v)) // microseconds since midnight
+			return nil
+		}
+	case *array.BinaryBuilder:
+		if v, ok := v.([]byte); ok {
+			b.Append(v)
+			return nil
+		}
+	case *array.ListBuilder:
+		// arrays are read as pgtype.*Array values, with the elements in the
+		// Elements field; multi-dimensional arrays are flattened
+		rv := reflect.ValueOf(v)
+		if rv.Kind() == reflect.Struct {
+			if elems := rv.FieldByName("Elements"); elems.Kind() == reflect.Slice {
+				b.Append(true)
+				vb, elemOID := b.ValueBuilder(), arrayElemOID(oid)
+				for i := 0; i < elems.Len(); i++ {
+					ev, ok := elems.Index(i).Addr().Interface().(pgtype.Value)
+					if !ok {
+						return fmt.Errorf("cannot convert array element %s to arrow %s", elems.Index(i).Type(), vb.Type())
+					}
+					if err := appendArrow(vb, elemOID, ev.Get()); err != nil {
+						return err
+					}
+				}
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("cannot convert %T to arrow %s", v, b.Type())
+}
+
+// numericToDecimal128 returns the value of a (non-NaN) numeric as a 128-bit
+// decimal with the given scale.
+func numericToDecimal128(n pgtype.Numeric, scale int32) decimal128.Num {
+	v := new(big.Int).Set(n.Int)
+	if exp := n.Exp + scale; exp > 0 {
+		v.Mul(v, new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(exp)), nil))
+	} else if exp < 0 {
+		v.Quo(v, new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(-exp)), nil))
+	}
+	return decimal128.FromBigInt(v)
+}
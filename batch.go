@@ -0,0 +1,154 @@
+/*
+ * Copyright 2022 RapidLoop, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rapidrows
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// batchResult is the result of a batch type endpoint. It is encoded as a JSON
+// object with the results of the steps as properties, in the order in which
+// they were run.
+type batchResult struct {
+	names   []string
+	results []any // queryResult or execResult
+}
+
+func (br *batchResult) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, name := range br.names {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		k, err := json.Marshal(name)
+		if err != nil {
+			return nil, err
+		}
+		v, err := json.Marshal(br.results[i])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(k)
+		buf.WriteByte(':')
+		buf.Write(v)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// batchError is the response of a batch type endpoint if any of the steps
+// failed. Step is empty if the failure was not in a step, for example when
+// committing the transaction.
+type batchError struct {
+	Step  string `json:"step,omitempty"`
+	Error string `json:"error"`
+}
+
+// errBatchStep is used to abort the transaction of a batch when a step fails.
+var errBatchStep = errors.New("batch step failed")
+
+func (a *APIServer) serveBatch(resp http.ResponseWriter, req *http.Request,
+	ep *Endpoint, params []any, logger zerolog.Logger) {
+
+	// Do debug logs only if debugging is turned on for this endpoint. Caller
+	// can also wrap in "if ep.Debug" to avoid compute.
+	debug := func() *zerolog.Event {
+		e := logger.Debug()
+		if !ep.Debug {
+			e = e.Discard()
+		}
+		return e
+	}
+
+	// map param names to values
+	paramsMap := make(map[string]any, len(ep.Params))
+	for i := range ep.Params {
+		paramsMap[ep.Params[i].Name] = params[i]
+	}
+	if ep.hasBody() {
+		paramsMap["body"] = params[len(ep.Params)]
+	}
+
+	// make context
+	ctx, cancel := a.queryContext(ep)
+	defer cancel()
+
+	// run the steps, always within a transaction
+	txopt := ep.TxOptions
+	if txopt == nil {
+		txopt = &TxOptions{}
+	}
+	var br batchResult
+	var be batchError
+	tq := time.Now()
+	cb := func(q querier) error {
+		for i := range ep.Steps {
+			step := &ep.Steps[i]
+			args := make([]any, len(step.Params))
+			for j, p := range step.Params {
+				args[j] = paramsMap[p]
+			}
+			ts := time.Now()
+			var result any
+			var errmsg string
+			if step.Mode == "exec" {
+				er := doExec(ctx, q, step.Script, args...)
+				result, errmsg = er, er.Error
+			} else {
+				qr := doQuery(ctx, q, step.Script, args...)
+				result, errmsg = qr, qr.Error
+			}
+			if errmsg != "" {
+				be.Step, be.Error = step.Name, errmsg
+				return errBatchStep
+			}
+			debug().Str("step", step.Name).Float64("elapsed", float64(time.Since(ts))/1e6).
+				Msg("batch step completed successfully")
+			br.names = append(br.names, step.Name)
+			br.results = append(br.results, result)
+		}
+		return nil
+	}
+	if err := a.ds.withTx(ep.Datasource, txopt, cb); err != nil {
+		if be.Step == "" {
+			be.Error = err.Error()
+		}
+		logger.Error().Str("step", be.Step).Str("error", be.Error).Msg("batch failed")
+		resp.Header().Set("Content-Type", "application/json")
+		resp.WriteHeader(http.StatusInternalServerError)
+		if err2 := json.NewEncoder(resp).Encode(be); err2 != nil {
+			logger.Error().Err(err2).Msg("error writing response")
+		}
+		return
+	}
+	debug().Float64("elapsed", float64(time.Since(tq))/1e6).Msg("batch completed successfully")
+
+	// write output
+	resp.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(resp)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(&br); err != nil {
+		logger.Error().Err(err).Msg("error writing response")
+	}
+}
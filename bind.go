@@ -0,0 +1,108 @@
+/*
+ * Copyright 2022 RapidLoop, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rapidrows
+
+import (
+	"strconv"
+)
+
+// hasSQLScript returns true if the Script of endpoints of the given type is
+// a SQL statement that is passed the values of the params.
+func hasSQLScript(implType string) bool {
+	return isQueryType(implType) || isExportType(implType) || implType == "exec"
+}
+
+// paramPos returns the position (starting from 1) of the param with the
+// given name in the endpoint's list of params, or 0 if there is no such
+// param. The request body of endpoints with a body schema is named "body",
+// and is after the params.
+func (ep *Endpoint) paramPos(name string) int {
+	for i := range ep.Params {
+		if ep.Params[i].Name == name {
+			return i + 1
+		}
+	}
+	if name == "body" && ep.hasBody() {
+		return len(ep.Params) + 1
+	}
+	return 0
+}
+
+// positional returns the positional parameter that a named parameter is
+// rewritten to, given its position, or an empty string if the position is 0.
+// The request body is cast to jsonb, as its type cannot always be inferred.
+func (ep *Endpoint) positional(name string, pos int) string {
+	if pos == 0 {
+		return ""
+	} else if name == "body" && ep.hasBody() {
+		return "$" + strconv.Itoa(pos) + "::jsonb"
+	}
+	return "$" + strconv.Itoa(pos)
+}
+
+// bindConfig returns a copy of the configuration with the named parameters
+// in the SQL statements of the endpoints rewritten into positional ones. The
+// configuration must be valid. The given configuration is not modified.
+func bindConfig(cfg *APIServerConfig) *APIServerConfig {
+	c := *cfg
+	c.Endpoints = make([]Endpoint, len(cfg.Endpoints))
+	for i := range cfg.Endpoints {
+		c.Endpoints[i] = cfg.Endpoints[i]
+		c.Endpoints[i].bind()
+	}
+	return &c
+}
+
+// bind rewrites the named parameters in the SQL statements of the endpoint.
+// For the Script and Merge, a name refers to the endpoint's param of that
+// name, at the same position as for $1, $2 etc. For a batch step, it refers
+// to the item of the step's Params with that name, which is appended to the
+// step's Params if not present.
+func (ep *Endpoint) bind() {
+	bind := func(name string) string {
+		return ep.positional(name, ep.paramPos(name))
+	}
+	if hasSQLScript(ep.ImplType) {
+		ep.Script = bindNamedParams(ep.Script, bind)
+	}
+	if ep.ImplType == "ingest" && ep.Ingest != nil && ep.Ingest.Merge != "" {
+		ing := *ep.Ingest
+		ing.Merge = bindNamedParams(ing.Merge, bind)
+		ep.Ingest = &ing
+	}
+	if ep.ImplType == "batch" && len(ep.Steps) > 0 {
+		steps := make([]BatchStep, len(ep.Steps))
+		for i := range ep.Steps {
+			s := ep.Steps[i]
+			s.Params = append([]string(nil), s.Params...)
+			s.Script = bindNamedParams(s.Script, func(name string) string {
+				if ep.paramPos(name) == 0 {
+					return "" // not a param
+				}
+				for j := range s.Params {
+					if s.Params[j] == name {
+						return ep.positional(name, j+1)
+					}
+				}
+				s.Params = append(s.Params, name)
+				return ep.positional(name, len(s.Params))
+			})
+			steps[i] = s
+		}
+		ep.Steps = steps
+	}
+}
@@ -0,0 +1,153 @@
+/*
+ * Copyright 2022 RapidLoop, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rapidrows
+
+import (
+	"sync/atomic"
+)
+
+// canCache returns true if the runtime interface supports caching.
+func (a *APIServer) canCache() bool {
+	return a.rti != nil && a.rti.CacheGet != nil &&
+		(a.rti.CacheSet != nil || a.rti.CacheSetTagged != nil)
+}
+
+// cachesResults returns true if the results of the endpoint are to be cached.
+// They are not, even if Cache is set, if the endpoint has params whose values
+// are different for each request.
+func (ep *Endpoint) cachesResults() bool {
+	return ep.Cache != nil && *ep.Cache > 0 && !ep.hasPerRequestParams()
+}
+
+// hasPerRequestParams returns true if the endpoint has params with the
+// sources `now` or `requestID`.
+func (ep *Endpoint) hasPerRequestParams() bool {
+	for i := range ep.Params {
+		if s := ep.Params[i].Source; s == "now" || s == "requestID" {
+			return true
+		}
+	}
+	return false
+}
+
+// hasClaimParams returns true if the endpoint has params with the source
+// `claim`, whose values depend on the user making the request.
+func (ep *Endpoint) hasClaimParams() bool {
+	for i := range ep.Params {
+		if ep.Params[i].Source == "claim" {
+			return true
+		}
+	}
+	return false
+}
+
+// cacheSet stores or deletes (if value is nil) a cache entry for the endpoint
+// with the given URI.
+func (a *APIServer) cacheSet(uri string, key uint64, value []byte) {
+	if a.rti.CacheSetTagged != nil {
+		a.rti.CacheSetTagged(key, uri, value)
+	} else {
+		a.rti.CacheSet(key, value)
+	}
+}
+
+// cacheGen returns the current generation of the cache entries for the
+// endpoint with the given URI. The generation is part of the cache key, so
+// that entries of older generations are never served.
+func (a *APIServer) cacheGen(uri string) uint64 {
+	if v, ok := a.cachegen.Load(uri); ok {
+		return v.(*atomic.Uint64).Load()
+	}
+	return 0
+}
+
+// invalidateCache invalidates all the cache entries of the endpoint with the
+// given URI, by moving on to the next generation. If the runtime interface
+// supports it, the entries are also marked to be purged in the background,
+// since purging can be slow and this is called from the notification
+// dispatcher. Repeated invalidations of an endpoint that is yet to be purged
+// result in a single purge.
+func (a *APIServer) invalidateCache(uri string) {
+	v, _ := a.cachegen.LoadOrStore(uri, new(atomic.Uint64))
+	v.(*atomic.Uint64).Add(1)
+	if a.purgewake == nil {
+		return
+	}
+	a.purging.Store(uri, true)
+	select {
+	case a.purgewake <- struct{}{}:
+	default: // purger already has a wakeup pending
+	}
+}
+
+// startPurger starts a goroutine that purges the cache entries of endpoints
+// marked by invalidateCache, until stopPurger is called.
+func (a *APIServer) startPurger() {
+	if a.rti == nil || a.rti.CachePurge == nil {
+		return
+	}
+	a.purgewake = make(chan struct{}, 1)
+	a.purgestop = make(chan struct{})
+	a.purgedone = make(chan struct{})
+	go func() {
+		defer close(a.purgedone)
+		for {
+			select {
+			case <-a.purgewake:
+				a.purgePending()
+			case <-a.purgestop:
+				a.purgePending()
+				return
+			}
+		}
+	}()
+}
+
+// purgePending purges the cache entries of all the endpoints currently
+// marked for purging.
+func (a *APIServer) purgePending() {
+	a.purging.Range(func(k, _ any) bool {
+		a.purging.Delete(k)
+		a.rti.CachePurge(k.(string))
+		return true
+	})
+}
+
+// stopPurger stops the goroutine started by startPurger, after it has purged
+// all the pending endpoints. Nothing should call invalidateCache after this.
+func (a *APIServer) stopPurger() {
+	if a.purgestop == nil {
+		return
+	}
+	close(a.purgestop)
+	<-a.purgedone
+}
+
+// cacheInvalidator invalidates the cached results of an endpoint whenever it
+// receives a notification from a notifDispatcher.
+type cacheInvalidator struct {
+	a  *APIServer
+	ep *Endpoint
+}
+
+func (ci *cacheInvalidator) accept(payload string) {
+	uri := ci.a.cfg.CommonPrefix + ci.ep.URI
+	ci.a.invalidateCache(uri)
+	if ci.ep.Debug {
+		ci.a.logger.Debug().Str("endpoint", uri).Msg("cache invalidated by notification")
+	}
+}
@@ -0,0 +1,311 @@
+/*
+ * Copyright 2022 RapidLoop, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// The package cache provides implementations of the caching functions of the
+// [rapidrows.RuntimeInterface]. [Cache] is an in-memory cache of bounded size,
+// that evicts the least recently used entries when full and removes expired
+// entries in the background. [Disk] is a cache of bounded size that is stored
+// in files, so that the cached entries survive restarts.
+package cache
+
+import (
+	"container/list"
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"github.com/rapidloop/rapidrows"
+)
+
+// entryOverhead is the approximate memory used by a cache entry, other than
+// the value and the tag.
+const entryOverhead = 128
+
+// Options specify the size limit and other settings of a Cache.
+type Options struct {
+	// MaxBytes is the maximum total size of all the entries in the cache. When
+	// exceeded, the least recently used entries are evicted. Values larger
+	// than this are not stored at all. Must be > 0.
+	MaxBytes int64
+
+	// TTL returns the duration for which the entries stored with the given
+	// tag remain valid, after which they are removed. The time at which an
+	// entry was stored is read from the 8-byte timestamp that prefixes each
+	// value stored by the APIServer. If TTL is nil or returns 0, entries are
+	// removed only when evicted or deleted. See also TTLFunc.
+	TTL func(tag string) time.Duration
+
+	// SweepInterval is the interval at which expired entries are removed in
+	// the background. Expired entries are never returned in any case. If <= 0,
+	// no background sweeping is done.
+	SweepInterval time.Duration
+
+	// ReportMetric, if set, is called after each sweep to report the
+	// statistics of the cache, as the metrics `cachehits`, `cachemisses`,
+	// `cacheevictions`, `cacheexpirations`, `cacheentries` and `cachebytes`,
+	// in that order.
+	// It has the same signature as RuntimeInterface.ReportMetric.
+	ReportMetric func(name string, labels []string, value float64)
+}
+
+// Stats are the statistics of a Cache. Hits, Misses, Evictions and
+// Expirations are counts since the cache was created.
+type Stats struct {
+	Hits        int64
+	Misses      int64
+	Evictions   int64
+	Expirations int64
+	Entries     int64
+	Bytes       int64
+}
+
+type entry struct {
+	key   uint64
+	tag   string
+	value []byte
+}
+
+func (e *entry) size() int64 {
+	return int64(len(e.value)+len(e.tag)) + entryOverhead
+}
+
+// Cache is an in-memory cache with a limit on its total size. It is safe for
+// concurrent use. Use Install to use it for caching in an APIServer.
+type Cache struct {
+	opts  Options
+	mu    sync.Mutex
+	items map[uint64]*list.Element // of *entry
+	lru   *list.List               // most recently used at the front
+	tags  map[string]map[uint64]struct{}
+	stats Stats
+	stop  chan struct{}
+	wg    sync.WaitGroup
+}
+
+// New creates a new cache with the given options, and starts the background
+// sweeping of expired entries if configured. Call Close when done.
+func New(opts Options) *Cache {
+	c := &Cache{
+		opts:  opts,
+		items: make(map[uint64]*list.Element),
+		lru:   list.New(),
+		tags:  make(map[string]map[uint64]struct{}),
+		stop:  make(chan struct{}),
+	}
+	if opts.SweepInterval > 0 {
+		c.wg.Add(1)
+		go c.sweeper()
+	}
+	return c
+}
+
+// Install sets the caching functions of the runtime interface to use this
+// cache.
+func (c *Cache) Install(rti *rapidrows.RuntimeInterface) {
+	rti.CacheGet = c.Get
+	rti.CacheSet = c.Set
+	rti.CacheSetTagged = c.SetTagged
+	rti.CachePurge = c.Purge
+}
+
+// Close stops the background sweeping. The cache can continue to be used
+// after this.
+func (c *Cache) Close() {
+	select {
+	case <-c.stop:
+	default:
+		close(c.stop)
+	}
+	c.wg.Wait()
+}
+
+// Get returns the value stored with the key, if it is present and has not
+// expired.
+func (c *Cache) Get(key uint64) (value []byte, found bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.items[key]
+	if !ok {
+		c.stats.Misses++
+		return nil, false
+	}
+	e := elem.Value.(*entry)
+	if c.expired(e, time.Now()) {
+		c.remove(elem)
+		c.stats.Expirations++
+		c.stats.Misses++
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	c.stats.Hits++
+	return e.value, true
+}
+
+// Set stores a value without a tag. If the value is empty, the entry is
+// deleted instead.
+func (c *Cache) Set(key uint64, value []byte) {
+	c.SetTagged(key, "", value)
+}
+
+// SetTagged stores a value along with a tag, which can be used to Purge it
+// later. If the value is empty, the entry is deleted instead.
+func (c *Cache) SetTagged(key uint64, tag string, value []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// remove any existing entry
+	if elem, ok := c.items[key]; ok {
+		c.remove(elem)
+	}
+	if len(value) == 0 {
+		return
+	}
+
+	// add the new entry, unless it is too large by itself
+	e := &entry{key: key, tag: tag, value: value}
+	if e.size() > c.opts.MaxBytes {
+		return
+	}
+	c.items[key] = c.lru.PushFront(e)
+	if tag != "" {
+		keys, ok := c.tags[tag]
+		if !ok {
+			keys = make(map[uint64]struct{})
+			c.tags[tag] = keys
+		}
+		keys[key] = struct{}{}
+	}
+	c.stats.Entries++
+	c.stats.Bytes += e.size()
+
+	// evict least recently used entries until we're within the limit
+	for c.stats.Bytes > c.opts.MaxBytes {
+		c.remove(c.lru.Back())
+		c.stats.Evictions++
+	}
+}
+
+// Purge deletes all the entries stored with the given tag.
+func (c *Cache) Purge(tag string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key := range c.tags[tag] {
+		c.remove(c.items[key])
+	}
+}
+
+// Stats returns the current statistics of the cache.
+func (c *Cache) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
+
+// remove deletes the entry in elem. Must be called with c.mu held.
+func (c *Cache) remove(elem *list.Element) {
+	e := c.lru.Remove(elem).(*entry)
+	delete(c.items, e.key)
+	if e.tag != "" {
+		if keys := c.tags[e.tag]; keys != nil {
+			delete(keys, e.key)
+			if len(keys) == 0 {
+				delete(c.tags, e.tag)
+			}
+		}
+	}
+	c.stats.Entries--
+	c.stats.Bytes -= e.size()
+}
+
+// expired returns true if the entry is older than the TTL for its tag.
+func (c *Cache) expired(e *entry, now time.Time) bool {
+	if c.opts.TTL == nil || len(e.value) < 8 {
+		return false
+	}
+	ttl := c.opts.TTL(e.tag)
+	if ttl <= 0 {
+		return false
+	}
+	stored := int64(binary.BigEndian.Uint64(e.value[0:8]))
+	return now.UnixNano()-stored > int64(ttl)
+}
+
+// sweep removes all expired entries.
+func (c *Cache) sweep() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for elem := c.lru.Front(); elem != nil; {
+		next := elem.Next()
+		if c.expired(elem.Value.(*entry), now) {
+			c.remove(elem)
+			c.stats.Expirations++
+		}
+		elem = next
+	}
+}
+
+func (c *Cache) sweeper() {
+	defer c.wg.Done()
+
+	ticker := time.NewTicker(c.opts.SweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.sweep()
+			reportStats(c.opts.ReportMetric, c.Stats())
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+// reportStats reports the statistics of a cache as metrics, if f is not nil.
+func reportStats(f func(name string, labels []string, value float64), s Stats) {
+	if f == nil {
+		return
+	}
+	f("cachehits", nil, float64(s.Hits))
+	f("cachemisses", nil, float64(s.Misses))
+	f("cacheevictions", nil, float64(s.Evictions))
+	f("cacheexpirations", nil, float64(s.Expirations))
+	f("cacheentries", nil, float64(s.Entries))
+	f("cachebytes", nil, float64(s.Bytes))
+}
+
+// TTLFunc returns a function that can be used as Options.TTL for caching the
+// results of the endpoints in the given configuration. The TTL of the entries
+// of an endpoint is the sum of its Cache and StaleWhileRevalidate settings.
+func TTLFunc(cfg *rapidrows.APIServerConfig) func(tag string) time.Duration {
+	ttls := make(map[string]time.Duration)
+	for _, ep := range cfg.Endpoints {
+		if ep.Cache == nil || *ep.Cache <= 0 {
+			continue
+		}
+		secs := *ep.Cache
+		if ep.StaleWhileRevalidate != nil && *ep.StaleWhileRevalidate > 0 {
+			secs += *ep.StaleWhileRevalidate
+		}
+		ttls[cfg.CommonPrefix+ep.URI] = time.Duration(secs * float64(time.Second))
+	}
+	return func(tag string) time.Duration {
+		return ttls[tag]
+	}
+}
@@ -0,0 +1,178 @@
+/*
+ * Copyright 2022 RapidLoop, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cache_test
+
+import (
+	"encoding/binary"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rapidloop/rapidrows"
+	"github.com/rapidloop/rapidrows/cache"
+	"github.com/stretchr/testify/require"
+)
+
+// mkval returns a cache value of the given total size, with the timestamp
+// prefix set to t.
+func mkval(t time.Time, size int) []byte {
+	v := make([]byte, size)
+	binary.BigEndian.PutUint64(v, uint64(t.UnixNano()))
+	return v
+}
+
+func TestCacheBasic(t *testing.T) {
+	r := require.New(t)
+
+	c := cache.New(cache.Options{MaxBytes: 1 << 20})
+	defer c.Close()
+
+	_, ok := c.Get(1)
+	r.False(ok)
+
+	v := mkval(time.Now(), 100)
+	c.Set(1, v)
+	got, ok := c.Get(1)
+	r.True(ok)
+	r.Equal(v, got)
+
+	// delete
+	c.Set(1, nil)
+	_, ok = c.Get(1)
+	r.False(ok)
+
+	s := c.Stats()
+	r.Equal(int64(1), s.Hits)
+	r.Equal(int64(2), s.Misses)
+	r.Equal(int64(0), s.Entries)
+	r.Equal(int64(0), s.Bytes)
+}
+
+func TestCacheEviction(t *testing.T) {
+	r := require.New(t)
+
+	// room for 3 entries of ~1000 bytes
+	c := cache.New(cache.Options{MaxBytes: 3500})
+	defer c.Close()
+
+	now := time.Now()
+	c.Set(1, mkval(now, 1000))
+	c.Set(2, mkval(now, 1000))
+	c.Set(3, mkval(now, 1000))
+	_, ok := c.Get(1) // 2 is now the least recently used
+	r.True(ok)
+	c.Set(4, mkval(now, 1000))
+
+	_, ok = c.Get(2)
+	r.False(ok)
+	for _, k := range []uint64{1, 3, 4} {
+		_, ok = c.Get(k)
+		r.True(ok, "key %d", k)
+	}
+	s := c.Stats()
+	r.Equal(int64(1), s.Evictions)
+	r.Equal(int64(3), s.Entries)
+	r.LessOrEqual(s.Bytes, int64(3500))
+
+	// values larger than the cache are not stored
+	c.Set(5, mkval(now, 4000))
+	_, ok = c.Get(5)
+	r.False(ok)
+	r.Equal(int64(3), c.Stats().Entries)
+}
+
+func TestCacheTagsAndExpiry(t *testing.T) {
+	r := require.New(t)
+
+	ttl := func(tag string) time.Duration {
+		if tag == "/short" {
+			return 100 * time.Millisecond
+		}
+		return 0
+	}
+	var metrics sync.Map
+	c := cache.New(cache.Options{
+		MaxBytes:      1 << 20,
+		TTL:           ttl,
+		SweepInterval: 50 * time.Millisecond,
+		ReportMetric: func(name string, labels []string, value float64) {
+			metrics.Store(name, value)
+		},
+	})
+	defer c.Close()
+
+	now := time.Now()
+	c.SetTagged(1, "/short", mkval(now, 100))
+	c.SetTagged(2, "/long", mkval(now, 100))
+	c.SetTagged(3, "/long", mkval(now, 100))
+	c.Set(4, mkval(now, 100))
+
+	// purge
+	c.Purge("/long")
+	_, ok := c.Get(2)
+	r.False(ok)
+	_, ok = c.Get(3)
+	r.False(ok)
+
+	// expiry, by the sweeper
+	_, ok = c.Get(1)
+	r.True(ok)
+	time.Sleep(300 * time.Millisecond)
+	s := c.Stats()
+	r.Equal(int64(1), s.Expirations)
+	r.Equal(int64(1), s.Entries)
+	_, ok = c.Get(4)
+	r.True(ok)
+	v, ok := metrics.Load("cacheexpirations")
+	r.True(ok)
+	r.Equal(float64(1), v)
+
+	// expired entries are not returned even without the sweeper
+	c2 := cache.New(cache.Options{MaxBytes: 1 << 20, TTL: ttl})
+	c2.SetTagged(1, "/short", mkval(now.Add(-time.Second), 100))
+	_, ok = c2.Get(1)
+	r.False(ok)
+	r.Equal(int64(1), c2.Stats().Expirations)
+}
+
+func TestCacheTTLFunc(t *testing.T) {
+	r := require.New(t)
+
+	ten, five := 10.0, 5.0
+	cfg := &rapidrows.APIServerConfig{
+		CommonPrefix: "/api",
+		Endpoints: []rapidrows.Endpoint{
+			{URI: "/a", Cache: &ten},
+			{URI: "/b", Cache: &ten, StaleWhileRevalidate: &five},
+			{URI: "/c"},
+		},
+	}
+	ttl := cache.TTLFunc(cfg)
+	r.Equal(10*time.Second, ttl("/api/a"))
+	r.Equal(15*time.Second, ttl("/api/b"))
+	r.Equal(time.Duration(0), ttl("/api/c"))
+
+	c := cache.New(cache.Options{MaxBytes: 1 << 20})
+	var rti rapidrows.RuntimeInterface
+	c.Install(&rti)
+	rti.CacheSetTagged(1, "/api/a", mkval(time.Now(), 10))
+	_, ok := rti.CacheGet(1)
+	r.True(ok)
+	rti.CachePurge("/api/a")
+	_, ok = rti.CacheGet(1)
+	r.False(ok)
+}
@@ -0,0 +1,602 @@
+/*
+ * Copyright 2022 RapidLoop, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rapidloop/rapidrows"
+)
+
+// The disk cache is stored as a series of append-only segment files, each
+// starting with segMagic and followed by records. Each record is:
+//
+//	crc32 (4 bytes, IEEE, over the rest of the record)
+//	key (8 bytes)
+//	tag length (2 bytes)
+//	value length (4 bytes, 0 for a deletion)
+//	tag
+//	value
+//
+// All integers are big-endian. An in-memory index maps keys to the location
+// of the latest record for the key. A record with key 0 is a purge fence for
+// its tag: its value is the 8-byte timestamp of the purge, and all entries
+// with the tag that were stored before then are considered deleted. This
+// keeps purged entries from coming back after a restart, when the APIServer
+// starts again from the first generation of cache keys.
+//
+// Segments are synced to disk when a new one is started and on Close, but
+// not after every write. After a crash, the most recent entries may be lost
+// or be found corrupt, and are discarded when loading.
+const (
+	segMagic      = "RRC1"
+	segSuffix     = ".seg"
+	segCount      = 8 // MaxBytes is split into these many segments
+	recHeaderSize = 18
+	maxTagLen     = 0xffff
+)
+
+type diskLoc struct {
+	seg    uint32
+	off    int64 // of the record
+	size   int64 // of the record
+	tag    string
+	stored int64 // timestamp prefix of the value, 0 if none
+}
+
+type segment struct {
+	id   uint32
+	f    *os.File
+	size int64
+	keys map[uint64]struct{} // keys whose latest record is in this segment
+}
+
+// Disk is a cache stored in files within a directory, which persists across
+// restarts. The total size of the files is limited to Options.MaxBytes; when
+// exceeded, the oldest file is deleted along with the entries in it. Values
+// larger than 1/8th of MaxBytes are not stored. It is safe for concurrent
+// use. Use Install to use it for caching in an APIServer.
+type Disk struct {
+	opts     Options
+	dir      string
+	segBytes int64
+	mu       sync.RWMutex
+	index    map[uint64]*diskLoc
+	tags     map[string]map[uint64]struct{}
+	fences   map[string]int64 // tag -> time of last purge
+	segs     []*segment       // oldest first, last one is being appended to
+	total    int64
+	hits     atomic.Int64
+	misses   atomic.Int64
+	nevicted int64
+	nexpired int64
+	stop     chan struct{}
+	wg       sync.WaitGroup
+}
+
+// OpenDisk opens the disk cache in the given directory, creating the
+// directory if required. Existing entries are loaded, except those that have
+// expired. Files or records that are found to be corrupt are discarded.
+// Options.MaxBytes must be > 0. Call Close when done.
+func OpenDisk(dir string, opts Options) (*Disk, error) {
+	if opts.MaxBytes <= 0 {
+		return nil, errors.New("cache: MaxBytes must be > 0")
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	d := &Disk{
+		opts:     opts,
+		dir:      dir,
+		segBytes: opts.MaxBytes / segCount,
+		index:    make(map[uint64]*diskLoc),
+		tags:     make(map[string]map[uint64]struct{}),
+		fences:   make(map[string]int64),
+		stop:     make(chan struct{}),
+	}
+	if err := d.load(); err != nil {
+		d.closeSegs()
+		return nil, err
+	}
+	if opts.SweepInterval > 0 {
+		d.wg.Add(1)
+		go d.sweeper()
+	}
+	return d, nil
+}
+
+// Install sets the caching functions of the runtime interface to use this
+// cache.
+func (d *Disk) Install(rti *rapidrows.RuntimeInterface) {
+	rti.CacheGet = d.Get
+	rti.CacheSet = d.Set
+	rti.CacheSetTagged = d.SetTagged
+	rti.CachePurge = d.Purge
+}
+
+// Close stops the background sweeping, and closes the files. The cache must
+// not be used after this.
+func (d *Disk) Close() error {
+	select {
+	case <-d.stop:
+	default:
+		close(d.stop)
+	}
+	d.wg.Wait()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.closeSegs()
+}
+
+func (d *Disk) closeSegs() (err error) {
+	if n := len(d.segs); n > 0 {
+		err = d.segs[n-1].f.Sync()
+	}
+	for _, s := range d.segs {
+		if err2 := s.f.Close(); err2 != nil && err == nil {
+			err = err2
+		}
+	}
+	d.segs = nil
+	return
+}
+
+// Get returns the value stored with the key, if it is present, has not
+// expired and can be read back intact.
+func (d *Disk) Get(key uint64) (value []byte, found bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	loc, ok := d.index[key]
+	if !ok || d.expired(loc, time.Now()) {
+		d.misses.Add(1)
+		return nil, false
+	}
+	s := d.seg(loc.seg)
+	if s == nil { // should not happen
+		d.misses.Add(1)
+		return nil, false
+	}
+	rec := make([]byte, loc.size)
+	if _, err := s.f.ReadAt(rec, loc.off); err != nil {
+		d.misses.Add(1)
+		return nil, false
+	}
+	_, _, value, ok = parseRecord(rec)
+	if !ok {
+		d.misses.Add(1)
+		return nil, false
+	}
+	d.hits.Add(1)
+	return value, true
+}
+
+// Set stores a value without a tag. If the value is empty, the entry is
+// deleted instead.
+func (d *Disk) Set(key uint64, value []byte) {
+	d.SetTagged(key, "", value)
+}
+
+// SetTagged stores a value along with a tag, which can be used to Purge it
+// later. If the value is empty, the entry is deleted instead. Errors in
+// writing to the disk are ignored, and the entry is not stored. Values with
+// a timestamp prefix older than the last Purge of the tag are not stored.
+// The key 0 is reserved and is ignored.
+func (d *Disk) SetTagged(key uint64, tag string, value []byte) {
+	if key == 0 {
+		return
+	}
+	if len(tag) > maxTagLen {
+		tag = ""
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if len(value) == 0 {
+		if _, ok := d.index[key]; ok {
+			d.remove(key)
+			d.write(key, "", nil) // tombstone
+		}
+		return
+	}
+	if int64(recHeaderSize+len(tag)+len(value)) > d.segBytes {
+		// too large, but delete any older value
+		if _, ok := d.index[key]; ok {
+			d.remove(key)
+			d.write(key, "", nil)
+		}
+		return
+	}
+	if d.fenced(tag, value) {
+		// computed before the last purge, and so possibly outdated
+		if _, ok := d.index[key]; ok {
+			d.remove(key)
+			d.write(key, "", nil)
+		}
+		return
+	}
+	d.remove(key)
+	if loc := d.write(key, tag, value); loc != nil {
+		d.add(key, loc)
+	}
+}
+
+// Purge deletes all the entries stored with the given tag. The purge is
+// persisted, so that these entries are not loaded again on reopening.
+func (d *Disk) Purge(tag string) {
+	if tag == "" || len(tag) > maxTagLen {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now().UnixNano()
+	var ts [8]byte
+	binary.BigEndian.PutUint64(ts[:], uint64(now))
+	d.write(0, tag, ts[:])
+	d.fences[tag] = now
+	for key := range d.tags[tag] {
+		d.remove(key)
+	}
+}
+
+// Stats returns the current statistics of the cache. Bytes is the total size
+// of the files, including deleted entries whose space is yet to be reclaimed.
+func (d *Disk) Stats() Stats {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return Stats{
+		Hits:        d.hits.Load(),
+		Misses:      d.misses.Load(),
+		Evictions:   d.nevicted,
+		Expirations: d.nexpired,
+		Entries:     int64(len(d.index)),
+		Bytes:       d.total,
+	}
+}
+
+//------------------------------------------------------------------------------
+// internals, all of these must be called with d.mu held
+
+func (d *Disk) seg(id uint32) *segment {
+	for _, s := range d.segs {
+		if s.id == id {
+			return s
+		}
+	}
+	return nil
+}
+
+// fenced returns true if the value has a timestamp prefix older than the last
+// purge of the tag.
+func (d *Disk) fenced(tag string, value []byte) bool {
+	fence, ok := d.fences[tag]
+	return ok && len(value) >= 8 && int64(binary.BigEndian.Uint64(value[0:8])) < fence
+}
+
+func (d *Disk) expired(loc *diskLoc, now time.Time) bool {
+	if d.opts.TTL == nil || loc.stored == 0 {
+		return false
+	}
+	ttl := d.opts.TTL(loc.tag)
+	return ttl > 0 && now.UnixNano()-loc.stored > int64(ttl)
+}
+
+// add adds an entry to the index.
+func (d *Disk) add(key uint64, loc *diskLoc) {
+	d.index[key] = loc
+	if s := d.seg(loc.seg); s != nil {
+		s.keys[key] = struct{}{}
+	}
+	if loc.tag != "" {
+		keys, ok := d.tags[loc.tag]
+		if !ok {
+			keys = make(map[uint64]struct{})
+			d.tags[loc.tag] = keys
+		}
+		keys[key] = struct{}{}
+	}
+}
+
+// remove removes an entry, if present, from the index.
+func (d *Disk) remove(key uint64) {
+	loc, ok := d.index[key]
+	if !ok {
+		return
+	}
+	delete(d.index, key)
+	if s := d.seg(loc.seg); s != nil {
+		delete(s.keys, key)
+	}
+	if keys := d.tags[loc.tag]; keys != nil {
+		delete(keys, key)
+		if len(keys) == 0 {
+			delete(d.tags, loc.tag)
+		}
+	}
+}
+
+// write appends a record to the current segment, starting a new one if
+// required, and evicts the oldest segments if the size limit is exceeded.
+func (d *Disk) write(key uint64, tag string, value []byte) *diskLoc {
+	rec := makeRecord(key, tag, value)
+	size := int64(len(rec))
+
+	// start a new segment if the current one is full, after syncing it
+	if len(d.segs) == 0 || d.segs[len(d.segs)-1].size+size > d.segBytes {
+		var id uint32
+		if len(d.segs) > 0 {
+			last := d.segs[len(d.segs)-1]
+			_ = last.f.Sync() // a failure will show up as corrupt records on load
+			id = last.id + 1
+		}
+		s, err := d.createSeg(id)
+		if err != nil {
+			return nil
+		}
+		d.segs = append(d.segs, s)
+		d.total += s.size
+	}
+
+	// evict the oldest segments to make room
+	for d.total+size > d.opts.MaxBytes && len(d.segs) > 1 {
+		d.dropSeg(0, true)
+	}
+
+	// append the record
+	s := d.segs[len(d.segs)-1]
+	if _, err := s.f.WriteAt(rec, s.size); err != nil {
+		// try to leave the file without a partial record
+		_ = s.f.Truncate(s.size)
+		return nil
+	}
+	loc := &diskLoc{seg: s.id, off: s.size, size: size, tag: tag}
+	if len(value) >= 8 {
+		loc.stored = int64(binary.BigEndian.Uint64(value[0:8]))
+	}
+	s.size += size
+	d.total += size
+	return loc
+}
+
+func (d *Disk) createSeg(id uint32) (*segment, error) {
+	name := filepath.Join(d.dir, fmt.Sprintf("%08x%s", id, segSuffix))
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Write([]byte(segMagic)); err != nil {
+		f.Close()
+		os.Remove(name)
+		return nil, err
+	}
+	return &segment{id: id, f: f, size: int64(len(segMagic)),
+		keys: make(map[uint64]struct{})}, nil
+}
+
+// dropSeg deletes the i'th segment along with the entries in it.
+func (d *Disk) dropSeg(i int, evict bool) {
+	s := d.segs[i]
+	for key := range s.keys {
+		d.remove(key)
+		if evict {
+			d.nevicted++
+		}
+	}
+	s.f.Close()
+	os.Remove(s.f.Name())
+	d.total -= s.size
+	d.segs = append(d.segs[:i], d.segs[i+1:]...)
+}
+
+// dropEmptySegs deletes the oldest segments, other than the one being
+// appended to, as long as they do not have any entries. Segments that are not
+// the oldest are retained even if empty, since they may contain deletion
+// records for entries in older segments.
+func (d *Disk) dropEmptySegs() {
+	for len(d.segs) > 1 && len(d.segs[0].keys) == 0 {
+		d.dropSeg(0, false)
+	}
+}
+
+// load reads in all the segments in the directory.
+func (d *Disk) load() error {
+	names, err := filepath.Glob(filepath.Join(d.dir, "*"+segSuffix))
+	if err != nil {
+		return err
+	}
+	var ids []uint32
+	for _, name := range names {
+		var id uint32
+		base := strings.TrimSuffix(filepath.Base(name), segSuffix)
+		if _, err := fmt.Sscanf(base, "%08x", &id); err != nil || len(base) != 8 {
+			continue // not ours
+		}
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	now := time.Now()
+	for _, id := range ids {
+		name := filepath.Join(d.dir, fmt.Sprintf("%08x%s", id, segSuffix))
+		f, err := os.OpenFile(name, os.O_RDWR, 0)
+		if err != nil {
+			return err
+		}
+		s := &segment{id: id, f: f, keys: make(map[uint64]struct{})}
+		d.segs = append(d.segs, s)
+		if err := d.loadSeg(s, now); err != nil {
+			return err
+		}
+		d.total += s.size
+	}
+
+	// drop the oldest segments if we're over the limit (which may have been
+	// lowered since), and also the ones that no longer have any entries
+	for d.total > d.opts.MaxBytes && len(d.segs) > 1 {
+		d.dropSeg(0, true)
+	}
+	d.dropEmptySegs()
+	return nil
+}
+
+// loadSeg reads the records of a segment into the index. If the segment is
+// not valid, it is reset to be empty. If a record is found to be truncated or
+// corrupt, the segment is truncated to before that record.
+func (d *Disk) loadSeg(s *segment, now time.Time) error {
+	data, err := io.ReadAll(s.f)
+	if err != nil {
+		return err
+	}
+	if !bytes.HasPrefix(data, []byte(segMagic)) {
+		if err := s.f.Truncate(0); err != nil {
+			return err
+		}
+		if _, err := s.f.WriteAt([]byte(segMagic), 0); err != nil {
+			return err
+		}
+		s.size = int64(len(segMagic))
+		return nil
+	}
+
+	off := int64(len(segMagic))
+	for off < int64(len(data)) {
+		rec := data[off:]
+		if len(rec) < recHeaderSize {
+			break
+		}
+		size := int64(recHeaderSize) + int64(binary.BigEndian.Uint16(rec[12:14])) +
+			int64(binary.BigEndian.Uint32(rec[14:18]))
+		if size > int64(len(rec)) {
+			break
+		}
+		key, tag, value, ok := parseRecord(rec[:size])
+		if !ok {
+			break
+		}
+		if key == 0 {
+			// purge fence, entries seen so far are all older
+			if len(value) == 8 {
+				d.fences[tag] = int64(binary.BigEndian.Uint64(value))
+				for k := range d.tags[tag] {
+					d.remove(k)
+				}
+			}
+			off += size
+			continue
+		}
+		d.remove(key)
+		if len(value) > 0 && !d.fenced(tag, value) {
+			loc := &diskLoc{seg: s.id, off: off, size: size, tag: tag}
+			if len(value) >= 8 {
+				loc.stored = int64(binary.BigEndian.Uint64(value[0:8]))
+			}
+			if d.expired(loc, now) {
+				d.nexpired++
+			} else {
+				d.add(key, loc)
+			}
+		}
+		off += size
+	}
+
+	s.size = off
+	if off < int64(len(data)) {
+		return s.f.Truncate(off)
+	}
+	return nil
+}
+
+func makeRecord(key uint64, tag string, value []byte) []byte {
+	rec := make([]byte, recHeaderSize+len(tag)+len(value))
+	binary.BigEndian.PutUint64(rec[4:12], key)
+	binary.BigEndian.PutUint16(rec[12:14], uint16(len(tag)))
+	binary.BigEndian.PutUint32(rec[14:18], uint32(len(value)))
+	copy(rec[recHeaderSize:], tag)
+	copy(rec[recHeaderSize+len(tag):], value)
+	binary.BigEndian.PutUint32(rec[0:4], crc32.ChecksumIEEE(rec[4:]))
+	return rec
+}
+
+// parseRecord decodes a complete record, and returns ok only if the checksum
+// matches.
+func parseRecord(rec []byte) (key uint64, tag string, value []byte, ok bool) {
+	if len(rec) < recHeaderSize {
+		return
+	}
+	taglen := int(binary.BigEndian.Uint16(rec[12:14]))
+	vallen := int(binary.BigEndian.Uint32(rec[14:18]))
+	if len(rec) != recHeaderSize+taglen+vallen ||
+		binary.BigEndian.Uint32(rec[0:4]) != crc32.ChecksumIEEE(rec[4:]) {
+		return
+	}
+	key = binary.BigEndian.Uint64(rec[4:12])
+	tag = string(rec[recHeaderSize : recHeaderSize+taglen])
+	value = rec[recHeaderSize+taglen:]
+	ok = true
+	return
+}
+
+//------------------------------------------------------------------------------
+// background sweeping
+
+// sweep removes expired entries from the index, and deletes the oldest
+// segments if they no longer have any entries.
+func (d *Disk) sweep() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	for key, loc := range d.index {
+		if d.expired(loc, now) {
+			d.remove(key)
+			d.nexpired++
+		}
+	}
+	d.dropEmptySegs()
+}
+
+func (d *Disk) sweeper() {
+	defer d.wg.Done()
+
+	ticker := time.NewTicker(d.opts.SweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			d.sweep()
+			reportStats(d.opts.ReportMetric, d.Stats())
+		case <-d.stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,211 @@
+/*
+ * Copyright 2022 RapidLoop, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cache_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rapidloop/rapidrows/cache"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiskPersist(t *testing.T) {
+	r := require.New(t)
+	dir := t.TempDir()
+	opts := cache.Options{MaxBytes: 1 << 20}
+
+	d, err := cache.OpenDisk(dir, opts)
+	r.Nil(err)
+	now := time.Now()
+	v1, v2, v3 := mkval(now, 100), mkval(now, 200), mkval(now, 300)
+	d.Set(1, v1)
+	d.SetTagged(2, "/a", v2)
+	d.SetTagged(3, "/b", v3)
+	d.Set(4, mkval(now, 10))
+	d.Set(4, nil)
+	got, ok := d.Get(2)
+	r.True(ok)
+	r.Equal(v2, got)
+	d.Purge("/b")
+	_, ok = d.Get(3)
+	r.False(ok)
+	r.Nil(d.Close())
+
+	// reopen, should have the same contents
+	d, err = cache.OpenDisk(dir, opts)
+	r.Nil(err)
+	got, ok = d.Get(1)
+	r.True(ok)
+	r.Equal(v1, got)
+	got, ok = d.Get(2)
+	r.True(ok)
+	r.Equal(v2, got)
+	_, ok = d.Get(3)
+	r.False(ok)
+	_, ok = d.Get(4)
+	r.False(ok)
+	r.Equal(int64(2), d.Stats().Entries)
+
+	// tags are also persisted
+	d.Purge("/a")
+	_, ok = d.Get(2)
+	r.False(ok)
+	r.Nil(d.Close())
+}
+
+func TestDiskPurgeFence(t *testing.T) {
+	r := require.New(t)
+	dir := t.TempDir()
+	opts := cache.Options{MaxBytes: 1 << 20}
+
+	d, err := cache.OpenDisk(dir, opts)
+	r.Nil(err)
+	before := time.Now()
+	d.SetTagged(1, "/a", mkval(before, 100))
+	d.Purge("/a")
+
+	// values computed before the purge are not stored
+	d.SetTagged(2, "/a", mkval(before, 100))
+	_, ok := d.Get(2)
+	r.False(ok)
+	after := time.Now()
+	v3 := mkval(after, 100)
+	d.SetTagged(3, "/a", v3)
+	r.Nil(d.Close())
+
+	// the fence is persisted, even for keys that are reused
+	d, err = cache.OpenDisk(dir, opts)
+	r.Nil(err)
+	_, ok = d.Get(1)
+	r.False(ok)
+	got, ok := d.Get(3)
+	r.True(ok)
+	r.Equal(v3, got)
+	d.SetTagged(1, "/a", mkval(before, 100))
+	_, ok = d.Get(1)
+	r.False(ok)
+	r.Nil(d.Close())
+}
+
+func TestDiskCorrupt(t *testing.T) {
+	r := require.New(t)
+	dir := t.TempDir()
+	opts := cache.Options{MaxBytes: 1 << 20}
+
+	d, err := cache.OpenDisk(dir, opts)
+	r.Nil(err)
+	now := time.Now()
+	v1 := mkval(now, 100)
+	d.Set(1, v1)
+	d.Set(2, mkval(now, 100))
+	r.Nil(d.Close())
+
+	// corrupt the value of the second record, and add a partial record
+	names, err := filepath.Glob(filepath.Join(dir, "*.seg"))
+	r.Nil(err)
+	r.Len(names, 1)
+	data, err := os.ReadFile(names[0])
+	r.Nil(err)
+	data[len(data)-1] ^= 0xff
+	data = append(data, 1, 2, 3)
+	r.Nil(os.WriteFile(names[0], data, 0o600))
+
+	// add a file that is not a segment
+	r.Nil(os.WriteFile(filepath.Join(dir, "00000005.seg"), []byte("garbage"), 0o600))
+
+	d, err = cache.OpenDisk(dir, opts)
+	r.Nil(err)
+	got, ok := d.Get(1)
+	r.True(ok)
+	r.Equal(v1, got)
+	_, ok = d.Get(2)
+	r.False(ok)
+
+	// can continue to write after the last good record
+	v3 := mkval(now, 50)
+	d.Set(3, v3)
+	r.Nil(d.Close())
+	d, err = cache.OpenDisk(dir, opts)
+	r.Nil(err)
+	got, ok = d.Get(3)
+	r.True(ok)
+	r.Equal(v3, got)
+	r.Nil(d.Close())
+}
+
+func TestDiskLimits(t *testing.T) {
+	r := require.New(t)
+	dir := t.TempDir()
+
+	// segments of 2000 bytes, total 16000
+	opts := cache.Options{
+		MaxBytes: 16000,
+		TTL: func(tag string) time.Duration {
+			return pick(tag == "/short", 100*time.Millisecond, 0)
+		},
+		SweepInterval: 50 * time.Millisecond,
+	}
+	d, err := cache.OpenDisk(dir, opts)
+	r.Nil(err)
+
+	// too large
+	now := time.Now()
+	d.Set(1, mkval(now, 3000))
+	_, ok := d.Get(1)
+	r.False(ok)
+
+	// oldest entries are evicted
+	for k := uint64(1); k <= 20; k++ {
+		d.Set(k, mkval(now, 1000))
+	}
+	s := d.Stats()
+	r.LessOrEqual(s.Bytes, int64(16000))
+	r.Greater(s.Evictions, int64(0))
+	_, ok = d.Get(1)
+	r.False(ok)
+	_, ok = d.Get(20)
+	r.True(ok)
+
+	// expiry
+	d.SetTagged(21, "/short", mkval(now, 100))
+	_, ok = d.Get(21)
+	r.True(ok)
+	time.Sleep(300 * time.Millisecond)
+	_, ok = d.Get(21)
+	r.False(ok)
+	r.Equal(int64(1), d.Stats().Expirations)
+	r.Nil(d.Close())
+
+	// a lower limit on reopening drops older entries
+	opts.MaxBytes = 8000
+	d, err = cache.OpenDisk(dir, opts)
+	r.Nil(err)
+	r.LessOrEqual(d.Stats().Bytes, int64(8000))
+	_, ok = d.Get(20)
+	r.True(ok)
+	r.Nil(d.Close())
+}
+
+func pick[T any](cond bool, ifyes, ifno T) T {
+	if cond {
+		return ifyes
+	}
+	return ifno
+}
@@ -22,12 +22,12 @@ import (
 	"log"
 	"os"
 	"os/signal"
-	"sync"
 	"time"
 
 	"github.com/goccy/go-yaml"
 	"github.com/mattn/go-isatty"
 	"github.com/rapidloop/rapidrows"
+	"github.com/rapidloop/rapidrows/cache"
 	"github.com/rs/zerolog"
 	"github.com/spf13/pflag"
 )
@@ -39,6 +39,9 @@ var (
 	flog     = flagset.StringP("logtype", "l", "text", "print logs in 'text' (default) or 'json' format")
 	fnocolor = flagset.Bool("no-color", false, "do not colorize log output")
 	fyaml    = flagset.BoolP("yaml", "y", false, "config-file is in YAML format")
+	fcache   = flagset.Int("cache-size", 64, "max size of the cache in MiB, 0 to disable caching")
+	fsweep   = flagset.Duration("cache-sweep", time.Minute, "interval for removing expired entries from the cache")
+	fcachedr = flagset.String("cache-dir", "", "store the cache in this directory, so that it persists across restarts")
 )
 
 var version string // set during build
@@ -51,6 +54,12 @@ Options:
 `)
 	flagset.PrintDefaults()
 	fmt.Fprintf(os.Stderr, `
+Caching:
+  Results of endpoints that have "cache" set in the config file are stored in
+  an in-memory cache of at most --cache-size MiB, or in --cache-dir if given.
+  Expired entries are removed every --cache-sweep, at which time the cache
+  statistics are also logged.
+
 (c) RapidLoop, Inc. 2022 * https://rapidrows.io
 `)
 }
@@ -59,7 +68,8 @@ func main() {
 	flagset.Usage = usage
 	if err := flagset.Parse(os.Args[1:]); err == pflag.ErrHelp {
 		return
-	} else if err != nil || (!*fversion && flagset.NArg() != 1) || (*flog != "text" && *flog != "json") {
+	} else if err != nil || (!*fversion && flagset.NArg() != 1) || (*flog != "text" && *flog != "json") ||
+		*fcache < 0 {
 		usage()
 		os.Exit(1)
 	}
@@ -129,9 +139,30 @@ func realmain() int {
 		logger = zerolog.New(out).With().Timestamp().Logger()
 	}
 	rti := rapidrows.RuntimeInterface{
-		Logger:   &logger,
-		CacheSet: cacheSet,
-		CacheGet: cacheGet,
+		Logger: &logger,
+	}
+	var c *cache.Cache
+	var d *cache.Disk
+	if *fcache > 0 {
+		opts := cache.Options{
+			MaxBytes:      int64(*fcache) * 1024 * 1024,
+			TTL:           cache.TTLFunc(&config),
+			SweepInterval: *fsweep,
+			ReportMetric:  cacheMetricsLogger(&logger),
+		}
+		if *fcachedr != "" {
+			if d, err = cache.OpenDisk(*fcachedr, opts); err != nil {
+				log.Printf("rapidrows: failed to open cache: %v", err)
+				return 1
+			}
+			d.Install(&rti)
+			s := d.Stats()
+			logger.Info().Str("dir", *fcachedr).Int64("entries", s.Entries).
+				Int64("bytes", s.Bytes).Msg("cache loaded")
+		} else {
+			c = cache.New(opts)
+			c.Install(&rti)
+		}
 	}
 	server, err := rapidrows.NewAPIServer(&config, &rti)
 	if err != nil {
@@ -155,22 +186,50 @@ func realmain() int {
 		log.Printf("rapidrows: warning: failed to stop server: %v", err)
 	}
 
+	// stop the cache, log stats
+	if c != nil {
+		c.Close()
+		logCacheStats(&logger, c.Stats())
+	}
+	if d != nil {
+		if err := d.Close(); err != nil {
+			log.Printf("rapidrows: warning: failed to close cache: %v", err)
+		}
+		logCacheStats(&logger, d.Stats())
+	}
+
 	return 0
 }
 
-var cache sync.Map
-
-func cacheSet(key uint64, value []byte) {
-	if len(value) == 0 {
-		cache.Delete(key)
-	} else {
-		cache.Store(key, value)
+// cacheMetricsLogger returns a function that can be used as
+// cache.Options.ReportMetric, which logs the cache statistics reported after
+// each sweep as a single line.
+func cacheMetricsLogger(logger *zerolog.Logger) func(string, []string, float64) {
+	var s cache.Stats
+	return func(name string, _ []string, value float64) {
+		switch name {
+		case "cachehits":
+			s.Hits = int64(value)
+		case "cachemisses":
+			s.Misses = int64(value)
+		case "cacheevictions":
+			s.Evictions = int64(value)
+		case "cacheexpirations":
+			s.Expirations = int64(value)
+		case "cacheentries":
+			s.Entries = int64(value)
+		case "cachebytes": // reported last
+			s.Bytes = int64(value)
+			logger.Info().Int64("hits", s.Hits).Int64("misses", s.Misses).
+				Int64("evictions", s.Evictions).Int64("expirations", s.Expirations).
+				Int64("entries", s.Entries).Int64("bytes", s.Bytes).
+				Msg("cache stats")
+		}
 	}
 }
 
-func cacheGet(key uint64) (value []byte, found bool) {
-	if v, ok := cache.Load(key); ok && v != nil {
-		return v.([]byte), true
-	}
-	return nil, false
+func logCacheStats(logger *zerolog.Logger, s cache.Stats) {
+	logger.Info().Int64("hits", s.Hits).Int64("misses", s.Misses).
+		Int64("evictions", s.Evictions).Int64("expirations", s.Expirations).
+		Msg("cache stopped")
 }
@@ -0,0 +1,581 @@
+/*
+ * Copyright 2022 RapidLoop, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rapidrows
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/jackc/pgproto3/v2"
+	"github.com/jackc/pgtype"
+)
+
+//------------------------------------------------------------------------------
+// row encoders
+
+// rowEncoder writes out a resultset incrementally, one row at a time. The
+// begin method is called exactly once before any rows, and end exactly once
+// after all rows. The end method is passed the error (if any) that occurred
+// while reading the rows, which the encoder may include in the output.
+type rowEncoder interface {
+	begin(cols []columnInfo) error
+	row(vals []any) error
+	flush() error
+	end(err error) error
+}
+
+// newRowEncoder returns a rowEncoder that writes to w in the given output
+// format, as configured for the endpoint.
+func newRowEncoder(ep *Endpoint, format string, w io.Writer) rowEncoder {
+	switch format {
+	case "csv":
+		return newCSVEncoder(w, ep.CSV)
+	case "ndjson":
+		return &ndjsonEncoder{w: w, objects: ep.Rows == "objects"}
+	case "arrow":
+		return &arrowEncoder{w: w}
+	case "parquet":
+		return &arrowEncoder{w: w, parquet: true}
+	}
+	if isSingleRow(ep, format) {
+		return &singleEncoder{w: w, scalar: ep.Result == "scalar"}
+	}
+	return &jsonEncoder{
+		w:       w,
+		objects: ep.Rows == "objects",
+		columns: ep.Columns && ep.Rows != "objects",
+	}
+}
+
+// isSingleRow returns true if the output of the endpoint in the given format
+// is a single row or value rather than the whole resultset.
+func isSingleRow(ep *Endpoint, format string) bool {
+	return format == "json" && (ep.Result == "single" || ep.Result == "scalar")
+}
+
+// contentTypeOf returns the content type of the output of the given endpoint
+// in the given output format.
+func contentTypeOf(ep *Endpoint, format string) string {
+	switch format {
+	case "csv":
+		if ep.CSV != nil && ep.CSV.Delimiter == "tab" {
+			return "text/tab-separated-values; charset=utf-8"
+		}
+		return "text/csv; charset=utf-8"
+	case "ndjson":
+		return "application/x-ndjson"
+	case "arrow":
+		return "application/vnd.apache.arrow.stream"
+	case "parquet":
+		return "application/vnd.apache.parquet"
+	}
+	return "application/json"
+}
+
+// encodeResult writes out an entire queryResult using a rowEncoder. The
+// cursor for the next page, if any, is included only in the json format.
+func encodeResult(enc rowEncoder, qr *queryResult) error {
+	if je, ok := enc.(*jsonEncoder); ok {
+		je.next = qr.Next
+	}
+	if err := enc.begin(qr.Columns); err != nil {
+		return err
+	}
+	for _, row := range qr.Rows {
+		if err := enc.row(row); err != nil {
+			return err
+		}
+	}
+	return enc.end(nil)
+}
+
+//------------------------------------------------------------------------------
+// json
+
+// jsonEncoder writes out a resultset as an indented JSON object, with the rows
+// in the "rows" property. The output is identical to that of qr2json for the
+// same resultset, but is produced incrementally.
+type jsonEncoder struct {
+	w       io.Writer
+	objects bool   // encode each row as an object rather than an array
+	columns bool   // include column metadata
+	next    string // cursor for the next page, if paginated
+	keys    []string
+	n       int
+}
+
+func (e *jsonEncoder) begin(cols []columnInfo) error {
+	e.keys = objectKeys(cols)
+	var buf bytes.Buffer
+	buf.WriteString("{\n")
+	if e.columns && len(cols) > 0 {
+		b, err := json.MarshalIndent(cols, "  ", "  ")
+		if err != nil {
+			return err
+		}
+		buf.WriteString(`  "columns": `)
+		buf.Write(b)
+		buf.WriteString(",\n")
+	}
+	buf.WriteString(`  "rows": [`)
+	_, err := e.w.Write(buf.Bytes())
+	return err
+}
+
+func (e *jsonEncoder) row(vals []any) error {
+	var v any = vals
+	if e.objects {
+		v = rowObject{keys: e.keys, vals: vals}
+	}
+	b, err := json.MarshalIndent(v, "    ", "  ")
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if e.n > 0 {
+		buf.WriteByte(',')
+	}
+	buf.WriteString("\n    ")
+	buf.Write(b)
+	e.n++
+	_, err = e.w.Write(buf.Bytes())
+	return err
+}
+
+func (e *jsonEncoder) flush() error {
+	return nil // not buffered
+}
+
+func (e *jsonEncoder) end(err error) error {
+	var buf bytes.Buffer
+	if e.n > 0 {
+		buf.WriteString("\n  ")
+	}
+	buf.WriteByte(']')
+	if err != nil {
+		b, err2 := json.Marshal(err.Error())
+		if err2 != nil {
+			return err2
+		}
+		buf.WriteString(",\n  \"error\": ")
+		buf.Write(b)
+	}
+	if e.next != "" {
+		buf.WriteString(",\n  \"next\": \"" + e.next + `"`)
+	}
+	buf.WriteString("\n}\n")
+	_, err = e.w.Write(buf.Bytes())
+	return err
+}
+
+// rowObject is a single row of a query result, which marshals into a JSON
+// object with the given keys, in the same order as the columns.
+type rowObject struct {
+	keys []string
+	vals []any
+}
+
+func (o rowObject) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i := range o.vals {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		k, err := json.Marshal(o.keys[i])
+		if err != nil {
+			return nil, err
+		}
+		v, err := json.Marshal(o.vals[i])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(k)
+		buf.WriteByte(':')
+		buf.Write(v)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// objectKeys returns the keys of the objects that the rows of a resultset
+// with the given columns are encoded as. These are the column names, except
+// that a name that repeats, like "id" in "select a.id, b.id ...", gets a
+// suffix (id_2, id_3 ..) so that the keys are unique.
+func objectKeys(cols []columnInfo) []string {
+	keys := make([]string, len(cols))
+	seen := make(map[string]bool, len(cols))
+	for i := range cols {
+		seen[cols[i].Name] = true
+	}
+	for i := range cols {
+		keys[i] = cols[i].Name
+		for j := 0; j < i; j++ {
+			if cols[j].Name == cols[i].Name {
+				// a repeat, find an unused suffix
+				for n := 2; ; n++ {
+					if k := fmt.Sprintf("%s_%d", cols[i].Name, n); !seen[k] {
+						keys[i] = k
+						seen[k] = true
+						break
+					}
+				}
+				break
+			}
+		}
+	}
+	return keys
+}
+
+// singleEncoder writes out only the first row of a resultset, as an indented
+// JSON object with the column names as keys, or only the value of the first
+// column of the first row if scalar is true. Errors are not included in the
+// output.
+type singleEncoder struct {
+	w      io.Writer
+	scalar bool
+	keys   []string
+	n      int
+}
+
+func (e *singleEncoder) begin(cols []columnInfo) error {
+	e.keys = objectKeys(cols)
+	return nil
+}
+
+func (e *singleEncoder) row(vals []any) error {
+	if e.n++; e.n > 1 {
+		return nil
+	}
+	var v any = rowObject{keys: e.keys, vals: vals}
+	if e.scalar {
+		v = nil
+		if len(vals) > 0 {
+			v = vals[0]
+		}
+	}
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = e.w.Write(append(b, '\n'))
+	return err
+}
+
+func (e *singleEncoder) flush() error {
+	return nil // not buffered
+}
+
+func (e *singleEncoder) end(err error) error {
+	return nil
+}
+
+//------------------------------------------------------------------------------
+// ndjson
+
+// ndjsonEncoder writes out a resultset as newline-delimited JSON, with each
+// row as a JSON array or object on a line by itself. If there was an error,
+// it is written out as a last line of the form {"error": "..."}.
+type ndjsonEncoder struct {
+	w       io.Writer
+	objects bool // encode each row as an object rather than an array
+	keys    []string
+}
+
+func (e *ndjsonEncoder) begin(cols []columnInfo) error {
+	e.keys = objectKeys(cols)
+	return nil
+}
+
+func (e *ndjsonEncoder) row(vals []any) error {
+	var v any = vals
+	if e.objects {
+		v = rowObject{keys: e.keys, vals: vals}
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = e.w.Write(append(b, '\n'))
+	return err
+}
+
+func (e *ndjsonEncoder) flush() error {
+	return nil // not buffered
+}
+
+func (e *ndjsonEncoder) end(err error) error {
+	if err == nil {
+		return nil
+	}
+	b, err2 := json.Marshal(map[string]string{"error": err.Error()})
+	if err2 != nil {
+		return err2
+	}
+	_, err2 = e.w.Write(append(b, '\n'))
+	return err2
+}
+
+//------------------------------------------------------------------------------
+// csv
+
+// csvEncoder writes out a resultset as CSV, as per the given CSVOptions.
+// Errors are not included in the output.
+type csvEncoder struct {
+	w      *bufio.Writer
+	opts   CSVOptions
+	delim  byte
+	eol    string
+	cols   []columnInfo
+	strrow []string
+	quoted []bool
+}
+
+func newCSVEncoder(w io.Writer, opts *CSVOptions) *csvEncoder {
+	e := &csvEncoder{w: bufio.NewWriter(w), delim: ',', eol: "\n"}
+	if opts != nil {
+		e.opts = *opts
+	}
+	switch e.opts.Delimiter {
+	case "tab":
+		e.delim = '\t'
+	case "semicolon":
+		e.delim = ';'
+	}
+	if e.opts.CRLF {
+		e.eol = "\r\n"
+	}
+	return e
+}
+
+func (e *csvEncoder) begin(cols []columnInfo) error {
+	e.cols = cols
+	e.strrow = make([]string, len(cols))
+	e.quoted = make([]bool, len(cols))
+	if e.opts.BOM {
+		if _, err := e.w.WriteString("\uFEFF"); err != nil {
+			return err
+		}
+	}
+	if e.opts.Header {
+		for i := range cols {
+			e.strrow[i] = cols[i].Name
+			e.quoted[i] = e.opts.Quote == "all" || e.opts.Quote == "nonnumeric"
+		}
+		return e.write()
+	}
+	return nil
+}
+
+func (e *csvEncoder) row(vals []any) error {
+	for i, v := range vals {
+		if v == nil {
+			e.strrow[i] = e.opts.Null
+			e.quoted[i] = false
+			continue
+		}
+		e.strrow[i] = formatText(e.cols[i].TypeOID, v)
+		switch e.opts.Quote {
+		case "all":
+			e.quoted[i] = true
+		case "nonnumeric":
+			e.quoted[i] = !isNumeric(e.cols[i].TypeOID, v)
+		default:
+			// quote empty strings if they'd otherwise look like NULLs
+			e.quoted[i] = e.strrow[i] == "" && e.opts.Null == ""
+		}
+	}
+	return e.write()
+}
+
+// write writes out e.strrow as a single CSV record. Fields are quoted if
+// e.quoted says so, or if required.
+func (e *csvEncoder) write() error {
+	for i, field := range e.strrow {
+		if i > 0 {
+			if err := e.w.WriteByte(e.delim); err != nil {
+				return err
+			}
+		}
+		if !e.quoted[i] && !e.needsQuotes(field) {
+			if _, err := e.w.WriteString(field); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := e.w.WriteByte('"'); err != nil {
+			return err
+		}
+		if _, err := e.w.WriteString(strings.ReplaceAll(field, `"`, `""`)); err != nil {
+			return err
+		}
+		if err := e.w.WriteByte('"'); err != nil {
+			return err
+		}
+	}
+	_, err := e.w.WriteString(e.eol)
+	return err
+}
+
+// needsQuotes reports whether a field must be quoted. The rules are the same
+// as that of encoding/csv.
+func (e *csvEncoder) needsQuotes(field string) bool {
+	if field == "" {
+		return false
+	}
+	if field == `\.` {
+		return true
+	}
+	for i := 0; i < len(field); i++ {
+		if c := field[i]; c == e.delim || c == '"' || c == '\r' || c == '\n' {
+			return true
+		}
+	}
+	r, _ := utf8.DecodeRuneInString(field)
+	return unicode.IsSpace(r)
+}
+
+func (e *csvEncoder) flush() error {
+	return e.w.Flush()
+}
+
+func (e *csvEncoder) end(err error) error {
+	return e.flush()
+}
+
+// isNumeric reports whether a non-nil value read from a column with the
+// given type OID is a number.
+func isNumeric(oid uint32, v any) bool {
+	if oid == pgtype.TimeOID {
+		return false // time values are read as int64 microseconds
+	}
+	switch v.(type) {
+	case int8, int16, int32, int64, int, uint8, uint16, uint32, uint64, uint,
+		float32, float64, pgtype.Numeric:
+		return true
+	}
+	return false
+}
+
+//------------------------------------------------------------------------------
+// text formatting
+
+// formatText returns the text representation of a non-nil value read from a
+// column with the given type OID. See the documentation of CSVOptions for the
+// formats used.
+func formatText(oid uint32, v any) string {
+	if oid == pgtype.JSONOID || oid == pgtype.JSONBOID {
+		if b, err := json.Marshal(v); err == nil {
+			return string(b)
+		}
+	}
+	switch v := v.(type) {
+	case string:
+		return v
+	case time.Time:
+		switch oid {
+		case pgtype.DateOID:
+			return v.Format("2006-01-02")
+		case pgtype.TimestampOID:
+			return v.Format("2006-01-02T15:04:05.999999")
+		}
+		return v.Format("2006-01-02T15:04:05.999999Z07:00")
+	case []byte:
+		return `\x` + hex.EncodeToString(v)
+	case [16]byte:
+		return encodeText(pgtype.UUID{Bytes: v, Status: pgtype.Present})
+	case int64:
+		if oid == pgtype.TimeOID {
+			return encodeText(pgtype.Time{Microseconds: v, Status: pgtype.Present})
+		}
+	case float32:
+		return strconv.FormatFloat(float64(v), 'g', -1, 32)
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case pgtype.Numeric:
+		return numericText(v)
+	case pgtype.TextEncoder:
+		return encodeText(v)
+	case fmt.Stringer:
+		return v.String()
+	}
+	return fmt.Sprintf("%v", v)
+}
+
+// numericText formats a numeric value in plain decimal notation, rather than
+// with an exponent as pgtype.Numeric's EncodeText does.
+func numericText(n pgtype.Numeric) string {
+	if n.NaN {
+		return "NaN"
+	}
+	if n.Int == nil {
+		return "0"
+	}
+	digits := new(big.Int).Abs(n.Int).String()
+	if n.Exp > 0 {
+		digits += strings.Repeat("0", int(n.Exp))
+	} else if n.Exp < 0 {
+		scale := int(-n.Exp)
+		if len(digits) <= scale {
+			digits = strings.Repeat("0", scale-len(digits)+1) + digits
+		}
+		digits = digits[:len(digits)-scale] + "." + digits[len(digits)-scale:]
+	}
+	if n.Int.Sign() < 0 {
+		return "-" + digits
+	}
+	return digits
+}
+
+func encodeText(v pgtype.TextEncoder) string {
+	b, err := v.EncodeText(pgTypes, nil)
+	if err != nil {
+		return fmt.Sprintf("%v", v)
+	}
+	return string(b)
+}
+
+//------------------------------------------------------------------------------
+// column metadata
+
+// fields2cols returns the name and type information of the columns of a
+// resultset, given it's field descriptions.
+func fields2cols(fds []pgproto3.FieldDescription) []columnInfo {
+	cols := make([]columnInfo, len(fds))
+	for i, fd := range fds {
+		cols[i].Name = string(fd.Name)
+		cols[i].TypeOID = fd.DataTypeOID
+		cols[i].typeMod = fd.TypeModifier
+		if dt, ok := pgTypes.DataTypeForOID(fd.DataTypeOID); ok {
+			cols[i].TypeName = dt.Name
+		}
+	}
+	return cols
+}
+
+// pgTypes is used only to lookup the names of builtin types by OID.
+var pgTypes = pgtype.NewConnInfo()
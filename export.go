@@ -0,0 +1,249 @@
+/*
+ * Copyright 2022 RapidLoop, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rapidrows
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/rs/zerolog"
+)
+
+// exportWriter writes the output of COPY TO to the response, calling start
+// before the first write. The error, if any, in writing to the response is
+// recorded in err.
+type exportWriter struct {
+	resp    http.ResponseWriter
+	start   func() error
+	started bool
+	n       int64
+	err     error
+}
+
+func (w *exportWriter) Write(p []byte) (n int, err error) {
+	if !w.started {
+		w.started = true
+		if err = w.start(); err != nil {
+			w.err = err
+			return
+		}
+	}
+	n, err = w.resp.Write(p)
+	w.n += int64(n)
+	if err != nil {
+		w.err = err
+	}
+	return
+}
+
+func (a *APIServer) serveExport(resp http.ResponseWriter, req *http.Request,
+	ep *Endpoint, format string, params []any, logger zerolog.Logger) {
+
+	// Do debug logs only if debugging is turned on for this endpoint. Caller
+	// can also wrap in "if ep.Debug" to avoid compute.
+	debug := func() *zerolog.Event {
+		e := logger.Debug()
+		if !ep.Debug {
+			e = e.Discard()
+		}
+		return e
+	}
+
+	// Start the output only when COPY produces the first data, so that errors
+	// that happen before that can still be reported with a status code of 500.
+	w := &exportWriter{resp: resp}
+	w.start = func() error {
+		if format == "csv" {
+			resp.Header().Set("Content-Type", contentTypeOf(ep, "csv"))
+		} else {
+			resp.Header().Set("Content-Type", "application/octet-stream")
+		}
+		resp.Header().Set("Trailer", streamErrorTrailer)
+		if format == "csv" && ep.CSV != nil && ep.CSV.BOM {
+			if _, err := resp.Write([]byte("\uFEFF")); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// make context
+	ctx, cancel := a.queryContext(ep)
+	defer cancel()
+
+	// run COPY, optionally in a transaction
+	var nrows int64
+	tq := time.Now()
+	cb := func(q querier) error {
+		conn, ok := q.(interface{ Conn() *pgx.Conn })
+		if !ok { // should not happen
+			return errors.New("connection does not support copy")
+		}
+		pgConn := conn.Conn().PgConn()
+		sql, err := exportSQL(ep, format, params, pgConn.EscapeString)
+		if err != nil {
+			return err
+		}
+		if ep.Debug {
+			debug().Str("sql", sql).Msg("starting copy")
+		}
+		tag, err := pgConn.CopyTo(ctx, w, sql)
+		if err != nil {
+			return err
+		}
+		nrows = tag.RowsAffected()
+		return nil
+	}
+	err := a.ds.withTx(ep.Datasource, ep.TxOptions, cb)
+	if w.err != nil {
+		logger.Error().Err(w.err).Msg("error writing response")
+		return
+	}
+	if err != nil && !w.started {
+		logger.Error().Err(err).Msg("export failed")
+		writeQueryError(resp, err, logger)
+		return
+	}
+	if !w.started {
+		if err := w.start(); err != nil {
+			logger.Error().Err(err).Msg("error writing response")
+			return
+		}
+		resp.WriteHeader(http.StatusOK)
+	}
+	if err != nil {
+		logger.Error().Err(err).Int64("bytes", w.n).Msg("export failed after output started")
+		msg := strings.NewReplacer("\r", " ", "\n", " ").Replace(err.Error())
+		resp.Header().Set(streamErrorTrailer, msg)
+		return
+	}
+	debug().Float64("elapsed", float64(time.Since(tq)/1e6)).Int64("rows", nrows).
+		Int64("bytes", w.n).Msg("export completed successfully")
+}
+
+// exportSQL returns the COPY statement for an export type endpoint. Since
+// COPY does not support bind parameters, the values of the parameters are
+// substituted into the query as literals. quote is used to escape strings.
+func exportSQL(ep *Endpoint, format string, params []any,
+	quote func(string) (string, error)) (string, error) {
+
+	// substitute the parameters
+	query := sqlTrimEnd(strings.TrimSpace(ep.Script))
+	var b strings.Builder
+	last := 0
+	toks, nums := sqlPlaceholders(query)
+	for i, tok := range toks {
+		if nums[i] < 1 || nums[i] > len(params) {
+			return "", fmt.Errorf("no value for parameter $%d", nums[i])
+		}
+		lit, err := sqlLiteral(params[nums[i]-1], quote)
+		if err != nil {
+			return "", fmt.Errorf("parameter $%d: %v", nums[i], err)
+		}
+		b.WriteString(query[last:tok.start])
+		b.WriteString(lit)
+		last = tok.end
+	}
+	b.WriteString(query[last:])
+
+	// add the options
+	opts := []string{"FORMAT " + format}
+	if c := ep.CSV; format == "csv" && c != nil {
+		if c.Header {
+			opts = append(opts, "HEADER")
+		}
+		switch c.Delimiter {
+		case "tab":
+			opts = append(opts, "DELIMITER E'\\t'")
+		case "semicolon":
+			opts = append(opts, "DELIMITER ';'")
+		}
+		if c.Null != "" {
+			null, err := quote(c.Null)
+			if err != nil {
+				return "", err
+			}
+			opts = append(opts, "NULL '"+null+"'")
+		}
+		if c.Quote == "all" {
+			opts = append(opts, "FORCE_QUOTE *")
+		}
+	}
+	return fmt.Sprintf("COPY (%s) TO STDOUT WITH (%s)", b.String(), strings.Join(opts, ", ")), nil
+}
+
+// sqlLiteral returns a SQL literal for the value of a parameter.
+func sqlLiteral(v any, quote func(string) (string, error)) (string, error) {
+	str := func(s string) (string, error) {
+		q, err := quote(s)
+		if err != nil {
+			return "", err
+		}
+		return "'" + q + "'", nil
+	}
+	num := func(f float64) string {
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return "'" + strconv.FormatFloat(f, 'g', -1, 64) + "'::float8"
+		}
+		return "(" + strconv.FormatFloat(f, 'g', -1, 64) + ")"
+	}
+	array := func(n int, elem func(i int) (string, error), typ string) (string, error) {
+		elems := make([]string, n)
+		for i := range elems {
+			var err error
+			if elems[i], err = elem(i); err != nil {
+				return "", err
+			}
+		}
+		return "ARRAY[" + strings.Join(elems, ",") + "]::" + typ + "[]", nil
+	}
+	switch v := v.(type) {
+	case nil:
+		return "NULL", nil
+	case bool:
+		return strings.ToUpper(strconv.FormatBool(v)), nil
+	case int64:
+		return "(" + strconv.FormatInt(v, 10) + ")", nil
+	case float64:
+		return num(v), nil
+	case string:
+		return str(v)
+	case textValue:
+		return str(v.text)
+	case []bool:
+		return array(len(v), func(i int) (string, error) { return strconv.FormatBool(v[i]), nil }, "boolean")
+	case []int64:
+		return array(len(v), func(i int) (string, error) { return strconv.FormatInt(v[i], 10), nil }, "bigint")
+	case []float64:
+		return array(len(v), func(i int) (string, error) { return num(v[i]), nil }, "float8")
+	case []string:
+		return array(len(v), func(i int) (string, error) { return str(v[i]) }, "text")
+	case []byte:
+		lit, err := str(`\x` + hex.EncodeToString(v))
+		return lit + "::bytea", err
+	case time.Time:
+		return str(v.Format(time.RFC3339Nano))
+	}
+	return str(fmt.Sprint(v))
+}
@@ -0,0 +1,289 @@
+/*
+ * Copyright 2022 RapidLoop, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rapidrows
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// filterOps maps the operators that can be used in filters to the
+// corresponding SQL operators.
+var filterOps = map[string]string{
+	"eq":    "=",
+	"neq":   "<>",
+	"gt":    ">",
+	"gte":   ">=",
+	"lt":    "<",
+	"lte":   "<=",
+	"like":  "LIKE",
+	"ilike": "ILIKE",
+	"in":    "IN",
+	"is":    "IS",
+}
+
+// filterReserved are the names of the query parameters, other than the
+// column names, that are used for filtering.
+var filterReserved = []string{"order", "limit", "offset"}
+
+// filterQuery returns the SQL query and its arguments for a query type
+// endpoint. If the endpoint has filtering enabled, the script is wrapped in a
+// query that filters, sorts and limits its rows according to the query
+// parameters in the URL. If page is not nil, the rows are also limited to
+// those of the requested page, with one extra row to tell if there are more.
+// The values in the URL are passed as arguments, following the endpoint's
+// parameters.
+func filterQuery(ep *Endpoint, urlData url.Values, params []any, page *keysetPage) (string, []any, error) {
+	f := ep.Filter
+	if f == nil && page == nil {
+		return ep.Script, params, nil
+	} else if f == nil {
+		f = &FilterOptions{}
+	}
+
+	args := append([]any(nil), params...)
+	arg := func(v any) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	// WHERE, columns are processed in sorted order so that the same filters
+	// result in the same query
+	var conds []string
+	cols := make([]string, 0, len(f.Columns))
+	for c := range f.Columns {
+		cols = append(cols, c)
+	}
+	sort.Strings(cols)
+	for _, c := range cols {
+		for _, v := range urlData[c] {
+			cond, err := filterCond(c, f.Columns[c], v, arg)
+			if err != nil {
+				return "", nil, fmt.Errorf("filter on %q: %v", c, err)
+			}
+			conds = append(conds, cond)
+		}
+	}
+
+	// for pages, the keys determine the order and the page size the limit
+	if page != nil {
+		if ep.Filter != nil && (urlData.Has("order") || urlData.Has("offset")) {
+			return "", nil, errors.New("order and offset cannot be used with pagination")
+		}
+		if page.after != nil {
+			conds = append(conds, keysetCond(ep.Paginate.Keys, page.after, arg))
+		}
+		return wrapQuery(ep.Script, conds, keysetOrder(ep.Paginate.Keys),
+			arg(page.limit+1), ""), args, nil
+	}
+
+	// ORDER BY
+	var order []string
+	for _, v := range urlData["order"] {
+		for _, o := range strings.Split(v, ",") {
+			term, err := filterOrder(f.Order, o)
+			if err != nil {
+				return "", nil, fmt.Errorf("order %q: %v", o, err)
+			}
+			order = append(order, term)
+		}
+	}
+
+	// LIMIT and OFFSET
+	limit := int64(f.Limit)
+	if f.MaxLimit > 0 && (limit == 0 || limit > int64(f.MaxLimit)) {
+		limit = int64(f.MaxLimit)
+	}
+	if v := urlData.Get("limit"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			return "", nil, fmt.Errorf("limit %q: not a valid number of rows", v)
+		} else if f.MaxLimit > 0 && n > int64(f.MaxLimit) {
+			return "", nil, fmt.Errorf("limit %q: exceeds the maximum of %d", v, f.MaxLimit)
+		}
+		limit = n
+	}
+	var offset int64
+	if v := urlData.Get("offset"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			return "", nil, fmt.Errorf("offset %q: not a valid number of rows", v)
+		}
+		offset = n
+	}
+
+	// nothing to do?
+	hasLimit := limit > 0 || urlData.Get("limit") != ""
+	if len(conds) == 0 && len(order) == 0 && !hasLimit && offset == 0 {
+		return ep.Script, params, nil
+	}
+
+	// compose the query
+	var limitArg, offsetArg string
+	if hasLimit {
+		limitArg = arg(limit)
+	}
+	if offset > 0 {
+		offsetArg = arg(offset)
+	}
+	return wrapQuery(ep.Script, conds, order, limitArg, offsetArg), args, nil
+}
+
+// wrapQuery returns a query that selects the rows of the given query that
+// match all of the conditions, in the given order, with the LIMIT and OFFSET
+// set to the given placeholders if not empty.
+func wrapQuery(query string, conds, order []string, limit, offset string) string {
+	var b strings.Builder
+	b.WriteString("SELECT * FROM (")
+	b.WriteString(sqlTrimEnd(strings.TrimSpace(query)))
+	b.WriteString("\n) AS _q")
+	if len(conds) > 0 {
+		b.WriteString(" WHERE ")
+		b.WriteString(strings.Join(conds, " AND "))
+	}
+	if len(order) > 0 {
+		b.WriteString(" ORDER BY ")
+		b.WriteString(strings.Join(order, ", "))
+	}
+	if limit != "" {
+		b.WriteString(" LIMIT " + limit)
+	}
+	if offset != "" {
+		b.WriteString(" OFFSET " + offset)
+	}
+	return b.String()
+}
+
+// filterCond returns the SQL condition for a filter of the form
+// "[not.]op.value" on a column.
+func filterCond(col string, allowed []string, v string, arg func(any) string) (string, error) {
+	not := strings.HasPrefix(v, "not.")
+	v = strings.TrimPrefix(v, "not.")
+	op, val, ok := strings.Cut(v, ".")
+	sqlOp, known := filterOps[op]
+	if !ok || !known {
+		return "", errors.New("must be of the form operator.value")
+	}
+	if len(allowed) > 0 && !contains(allowed, op) {
+		return "", fmt.Errorf("operator %q is not allowed", op)
+	}
+
+	ident := pgx.Identifier{col}.Sanitize()
+	var cond string
+	switch op {
+	case "is":
+		switch strings.ToLower(val) {
+		case "null", "true", "false", "unknown":
+			cond = ident + " IS " + strings.ToUpper(val)
+		default:
+			return "", fmt.Errorf("invalid value %q for is, must be null, true, false or unknown", val)
+		}
+	case "in":
+		vals, err := parseFilterList(val)
+		if err != nil {
+			return "", err
+		}
+		if len(vals) == 0 {
+			cond = "false"
+		} else {
+			for i := range vals {
+				vals[i] = arg(vals[i])
+			}
+			cond = ident + " IN (" + strings.Join(vals, ", ") + ")"
+		}
+	case "like", "ilike":
+		cond = ident + " " + sqlOp + " " + arg(strings.ReplaceAll(val, "*", "%"))
+	default:
+		cond = ident + " " + sqlOp + " " + arg(val)
+	}
+	if not {
+		cond = "NOT (" + cond + ")"
+	}
+	return cond, nil
+}
+
+// parseFilterList parses the value of an "in" filter, which is a list of
+// comma-separated values in parentheses. Values can be double-quoted if they
+// contain commas or parentheses.
+func parseFilterList(s string) ([]string, error) {
+	if len(s) < 2 || s[0] != '(' || s[len(s)-1] != ')' {
+		return nil, errors.New("list of values must be enclosed in parentheses")
+	}
+	s = s[1 : len(s)-1]
+	if s == "" {
+		return nil, nil
+	}
+	var out []string
+	var cur strings.Builder
+	quoted, wasQuoted := false, false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quoted && c == '\\' && i+1 < len(s):
+			i++
+			cur.WriteByte(s[i])
+		case c == '"' && (quoted || cur.Len() == 0):
+			quoted, wasQuoted = !quoted, true
+		case c == ',' && !quoted:
+			out = append(out, cur.String())
+			cur.Reset()
+			wasQuoted = false
+		case wasQuoted && !quoted:
+			return nil, errors.New("unexpected character after quoted value")
+		default:
+			cur.WriteByte(c)
+		}
+	}
+	if quoted {
+		return nil, errors.New("unterminated quoted value")
+	}
+	return append(out, cur.String()), nil
+}
+
+// filterOrder returns the SQL ORDER BY term for an item of the form
+// "column[.asc|.desc][.nullsfirst|.nullslast]".
+func filterOrder(allowed []string, o string) (string, error) {
+	parts := strings.Split(o, ".")
+	col, mods := parts[0], parts[1:]
+	if !contains(allowed, col) {
+		return "", errors.New("column is not one of the sortable columns")
+	}
+	term := pgx.Identifier{col}.Sanitize()
+	var dir, nulls bool
+	for _, m := range mods {
+		switch {
+		case (m == "asc" || m == "desc") && !dir && !nulls:
+			term += " " + strings.ToUpper(m)
+			dir = true
+		case m == "nullsfirst" && !nulls:
+			term += " NULLS FIRST"
+			nulls = true
+		case m == "nullslast" && !nulls:
+			term += " NULLS LAST"
+			nulls = true
+		default:
+			return "", fmt.Errorf("invalid modifier %q", m)
+		}
+	}
+	return term, nil
+}
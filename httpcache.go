@@ -0,0 +1,123 @@
+/*
+ * Copyright 2022 RapidLoop, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rapidrows
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// makeETag returns a weak entity tag for the given response body. It is weak
+// because the response may be compressed on the way out, and the compressed
+// bytes are not what the tag is computed from.
+func makeETag(body []byte) string {
+	return fmt.Sprintf(`W/"%016x"`, xxhash.Sum64(body))
+}
+
+// setCacheControl sets the Cache-Control header for a successful response
+// from the endpoint, which will remain fresh for maxAge. If the endpoint
+// specifies the header value explicitly, that is used instead. Nothing is set
+// if neither is available. Responses that depend on the claims of the user
+// are marked private, so that shared caches do not store them.
+func setCacheControl(h http.Header, ep *Endpoint, maxAge time.Duration) {
+	if ep.CacheControl != "" {
+		h.Set("Cache-Control", ep.CacheControl)
+	} else if maxAge > 0 && ep.hasClaimParams() {
+		h.Set("Cache-Control", fmt.Sprintf("private, max-age=%d", int64(maxAge/time.Second)))
+	} else if maxAge > 0 {
+		h.Set("Cache-Control", fmt.Sprintf("max-age=%d", int64(maxAge/time.Second)))
+	}
+}
+
+// varyOf returns the request headers, other than those handled by middleware,
+// that can change the response of the endpoint.
+func varyOf(ep *Endpoint) (vary []string) {
+	if ep.ImplType == "query" {
+		vary = append(vary, "Accept")
+	}
+	cookie := false
+	for i := range ep.Params {
+		switch ep.Params[i].In {
+		case "header":
+			vary = append(vary, http.CanonicalHeaderKey(headerName(ep.Params[i].Name)))
+		case "cookie":
+			cookie = true
+		}
+	}
+	if cookie {
+		vary = append(vary, "Cookie")
+	}
+	if ep.hasClaimParams() {
+		vary = append(vary, "Authorization")
+	}
+	return
+}
+
+// writeCacheable writes out a complete response body along with the ETag,
+// Last-Modified and Cache-Control headers. Conditional GET and HEAD requests
+// (with If-None-Match or If-Modified-Since headers) get a 304 instead if the
+// body has not changed. Range requests are not supported, the full body is
+// always written.
+func writeCacheable(resp http.ResponseWriter, req *http.Request, ep *Endpoint,
+	contentType string, body []byte, modified time.Time, maxAge time.Duration) {
+
+	etag := makeETag(body)
+	h := resp.Header()
+	h.Set("ETag", etag)
+	setCacheControl(h, ep, maxAge)
+	if !modified.IsZero() {
+		h.Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	}
+	if (req.Method == http.MethodGet || req.Method == http.MethodHead) &&
+		notModified(req, etag, modified) {
+		resp.WriteHeader(http.StatusNotModified)
+		return
+	}
+	h.Set("Content-Type", contentType)
+	h.Set("Content-Length", strconv.Itoa(len(body)))
+	resp.WriteHeader(http.StatusOK)
+	if req.Method != http.MethodHead {
+		resp.Write(body)
+	}
+}
+
+// notModified returns true if the conditional headers of the request show
+// that the client already has the body with the given ETag and modification
+// time. If-Modified-Since is considered only in the absence of If-None-Match,
+// and ETags are compared weakly, as per RFC 9110.
+func notModified(req *http.Request, etag string, modified time.Time) bool {
+	if inm := req.Header.Get("If-None-Match"); inm != "" {
+		for _, t := range strings.Split(inm, ",") {
+			t = strings.TrimSpace(t)
+			if t == "*" || strings.TrimPrefix(t, "W/") == strings.TrimPrefix(etag, "W/") {
+				return true
+			}
+		}
+		return false
+	}
+	ims := req.Header.Get("If-Modified-Since")
+	if ims == "" || modified.IsZero() {
+		return false
+	}
+	t, err := http.ParseTime(ims)
+	return err == nil && !modified.Truncate(time.Second).After(t)
+}
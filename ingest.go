@@ -0,0 +1,613 @@
+/*
+ * Copyright 2022 RapidLoop, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rapidrows
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	"github.com/rs/zerolog"
+)
+
+// ingestResult is the response of an ingest type endpoint. Line is the line
+// number in the input at which the error occured, if known.
+type ingestResult struct {
+	RowsCopied   int64  `json:"rowsCopied"`
+	RowsAffected *int64 `json:"rowsAffected,omitempty"`
+	Error        string `json:"error,omitempty"`
+	Line         int    `json:"line,omitempty"`
+}
+
+// ingestError is an error in the input of an ingest type endpoint.
+type ingestError struct {
+	line int // 0 if not known
+	err  error
+}
+
+func (e *ingestError) Error() string {
+	if e.line > 0 {
+		return fmt.Sprintf("line %d: %v", e.line, e.err)
+	}
+	return e.err.Error()
+}
+
+// ingestFormat returns the format of the request body of an ingest type
+// endpoint, or an empty string if it could not be determined.
+func ingestFormat(req *http.Request, ep *Endpoint) string {
+	if ep.Ingest.Format != "" {
+		return ep.Ingest.Format
+	}
+	switch getCT(req) {
+	case "text/csv":
+		return "csv"
+	case "application/x-ndjson":
+		return "ndjson"
+	case "application/json":
+		return "json"
+	}
+	return ""
+}
+
+func (a *APIServer) serveIngest(resp http.ResponseWriter, req *http.Request,
+	ep *Endpoint, params []any, logger zerolog.Logger) {
+
+	// Do debug logs only if debugging is turned on for this endpoint. Caller
+	// can also wrap in "if ep.Debug" to avoid compute.
+	debug := func() *zerolog.Event {
+		e := logger.Debug()
+		if !ep.Debug {
+			e = e.Discard()
+		}
+		return e
+	}
+
+	// helper function to write the result
+	writeResult := func(code int, ir *ingestResult) {
+		resp.Header().Set("Content-Type", "application/json")
+		resp.WriteHeader(code)
+		enc := json.NewEncoder(resp)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(ir); err != nil {
+			logger.Error().Err(err).Msg("error writing response")
+		}
+	}
+	writeError := func(code int, err error) {
+		ir := ingestResult{Error: err.Error()}
+		var ie *ingestError
+		if errors.As(err, &ie) {
+			ir.Error, ir.Line = ie.err.Error(), ie.line
+		}
+		writeResult(code, &ir)
+	}
+
+	// setup reading of the body
+	format := ingestFormat(req, ep)
+	if format == "" {
+		logger.Error().Str("content-type", req.Header.Get("Content-Type")).
+			Msg("unsupported content type for ingest")
+		writeError(http.StatusUnsupportedMediaType,
+			errors.New("content type must be one of text/csv, application/x-ndjson or application/json"))
+		return
+	}
+	body, err := decodeBody(req)
+	if err != nil {
+		logger.Error().Err(err).Msg("failed to read request body")
+		writeError(http.StatusBadRequest, err)
+		return
+	}
+	defer body.Close()
+	src, err := newIngestSource(body, format, ep)
+	if err != nil {
+		logger.Error().Err(err).Msg("failed to read input")
+		writeError(http.StatusBadRequest, err)
+		return
+	}
+
+	// make context
+	ctx, cancel := a.queryContext(ep)
+	defer cancel()
+
+	// copy, and optionally merge, within a transaction
+	ing := ep.Ingest
+	txopt := ep.TxOptions
+	if txopt == nil {
+		txopt = &TxOptions{}
+	}
+	var ir ingestResult
+	var cr *copyReader
+	tq := time.Now()
+	cb := func(q querier) error {
+		table := pgx.Identifier(strings.Split(ing.Table, ".")).Sanitize()
+		cols := make([]string, len(src.cols))
+		for i, c := range src.cols {
+			cols[i] = pgx.Identifier{c}.Sanitize()
+		}
+		collist := strings.Join(cols, ", ")
+		if ing.Staging != "" {
+			staging := pgx.Identifier{ing.Staging}.Sanitize()
+			ddl := fmt.Sprintf("CREATE TEMPORARY TABLE %s ON COMMIT DROP AS SELECT %s FROM %s WITH NO DATA",
+				staging, collist, table)
+			if _, err := q.Exec(ctx, ddl); err != nil {
+				return err
+			}
+			table = staging
+		}
+		conn, ok := q.(interface{ Conn() *pgx.Conn })
+		if !ok { // should not happen
+			return errors.New("connection does not support copy")
+		}
+		sql := fmt.Sprintf("COPY %s (%s) FROM STDIN", table, collist)
+		cr = &copyReader{src: src}
+		tag, err := conn.Conn().PgConn().CopyFrom(ctx, cr, sql)
+		if err := cr.close(err); err != nil {
+			return err
+		}
+		ir.RowsCopied = tag.RowsAffected()
+		debug().Int64("rows", ir.RowsCopied).Float64("elapsed", float64(time.Since(tq))/1e6).
+			Msg("copy completed successfully")
+		if ing.Merge != "" {
+			tag, err := q.Exec(ctx, ing.Merge, params...)
+			if err != nil {
+				return err
+			}
+			n := tag.RowsAffected()
+			ir.RowsAffected = &n
+		}
+		return nil
+	}
+	if err := a.ds.withTx(ep.Datasource, txopt, cb); err != nil {
+		logger.Error().Err(err).Msg("ingest failed")
+		var ie *ingestError
+		writeError(pick(errors.As(err, &ie), http.StatusBadRequest, http.StatusInternalServerError), err)
+		return
+	}
+	debug().Float64("elapsed", float64(time.Since(tq))/1e6).Msg("ingest completed successfully")
+
+	// write output
+	writeResult(http.StatusOK, &ir)
+}
+
+// decodeBody returns a reader for the request body, decompressing it if
+// required.
+func decodeBody(req *http.Request) (io.ReadCloser, error) {
+	switch req.Header.Get("Content-Encoding") {
+	case "gzip":
+		r, err := gzip.NewReader(req.Body)
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize gzip reader: %v", err)
+		}
+		return r, nil
+	case "deflate":
+		return flate.NewReader(req.Body), nil
+	}
+	return io.NopCloser(req.Body), nil
+}
+
+//------------------------------------------------------------------------------
+// reading the input
+
+// ingestSource reads the rows from the request body of an ingest type
+// endpoint.
+type ingestSource struct {
+	fields []string // names of the fields in the input that are loaded
+	cols   []string // corresponding table columns
+	null   string   // for csv
+
+	// line numbers in the input of the most recently read rows
+	lines [ingestLineWindow]int
+	rows  int // number of rows read so far
+
+	// for csv
+	cr     *csv.Reader
+	csvIdx []int // index of each field in a csv record
+
+	// for ndjson
+	br   *bufio.Reader
+	line int
+
+	// for json
+	dec     *json.Decoder
+	lc      *lineCounter
+	pending map[string]any // first object, read in to find the fields
+	pline   int
+	strict  bool // error on unknown properties
+}
+
+func newIngestSource(r io.Reader, format string, ep *Endpoint) (*ingestSource, error) {
+	src := &ingestSource{}
+	switch format {
+	case "csv":
+		return src, src.initCSV(r, ep)
+	case "ndjson":
+		src.br = bufio.NewReader(r)
+		return src, src.initJSON(ep)
+	default:
+		src.lc = &lineCounter{r: r}
+		src.dec = json.NewDecoder(src.lc)
+		src.dec.UseNumber()
+		if tok, err := src.dec.Token(); err != nil {
+			return nil, src.jsonError(err)
+		} else if d, ok := tok.(json.Delim); !ok || d != '[' {
+			return nil, &ingestError{line: 1, err: errors.New("expected a json array")}
+		}
+		return src, src.initJSON(ep)
+	}
+}
+
+// initCSV reads the header and maps the fields to columns.
+func (src *ingestSource) initCSV(r io.Reader, ep *Endpoint) error {
+	// skip the UTF-8 BOM if present
+	br := bufio.NewReader(r)
+	if b, err := br.Peek(3); err == nil && bytes.Equal(b, []byte{0xef, 0xbb, 0xbf}) {
+		_, _ = br.Discard(3)
+	}
+	src.cr = csv.NewReader(br)
+	src.cr.ReuseRecord = true
+	if ep.CSV != nil {
+		src.null = ep.CSV.Null
+		switch ep.CSV.Delimiter {
+		case "tab":
+			src.cr.Comma = '\t'
+		case "semicolon":
+			src.cr.Comma = ';'
+		}
+	}
+	header, err := src.cr.Read()
+	if err == io.EOF {
+		return &ingestError{line: 1, err: errors.New("missing header")}
+	} else if err != nil {
+		return csvError(err)
+	}
+	for i, f := range header {
+		col := f
+		if m := ep.Ingest.Columns; m != nil {
+			if col = m[f]; col == "" {
+				continue
+			}
+		}
+		src.fields = append(src.fields, f)
+		src.cols = append(src.cols, col)
+		src.csvIdx = append(src.csvIdx, i)
+	}
+	if len(src.fields) == 0 {
+		return &ingestError{line: 1, err: errors.New("no columns to load in header")}
+	}
+	return nil
+}
+
+// initJSON maps the fields to columns, reading in the first object if the
+// columns are not configured.
+func (src *ingestSource) initJSON(ep *Endpoint) error {
+	if m := ep.Ingest.Columns; m != nil {
+		for f := range m {
+			src.fields = append(src.fields, f)
+		}
+		sort.Strings(src.fields)
+		for _, f := range src.fields {
+			src.cols = append(src.cols, m[f])
+		}
+		return nil
+	}
+	obj, line, err := src.nextObject()
+	if err == io.EOF {
+		return &ingestError{err: errors.New("no objects in input")}
+	} else if err != nil {
+		return err
+	}
+	for f := range obj {
+		src.fields = append(src.fields, f)
+	}
+	if len(src.fields) == 0 {
+		return &ingestError{line: line, err: errors.New("no columns to load in first object")}
+	}
+	sort.Strings(src.fields)
+	src.cols = src.fields
+	src.pending, src.pline = obj, line
+	src.strict = true
+	return nil
+}
+
+// next returns the values of the fields of the next row, or io.EOF if there
+// are no more rows.
+func (src *ingestSource) next() ([]any, error) {
+	if src.cr != nil {
+		return src.nextCSV()
+	}
+	obj, line, err := src.nextObject()
+	if err != nil {
+		return nil, err
+	}
+	vals := make([]any, len(src.fields))
+	found := 0
+	for i, f := range src.fields {
+		if v, ok := obj[f]; ok {
+			vals[i] = v
+			found++
+		}
+	}
+	if src.strict && found != len(obj) {
+		for k := range obj {
+			if !contains(src.fields, k) {
+				return nil, &ingestError{line: line, err: fmt.Errorf("unknown field %q", k)}
+			}
+		}
+	}
+	src.addLine(line)
+	return vals, nil
+}
+
+func (src *ingestSource) nextCSV() ([]any, error) {
+	rec, err := src.cr.Read()
+	if err == io.EOF {
+		return nil, err
+	} else if err != nil {
+		return nil, csvError(err)
+	}
+	line, _ := src.cr.FieldPos(0)
+	vals := make([]any, len(src.fields))
+	for i, idx := range src.csvIdx {
+		if rec[idx] != src.null {
+			vals[i] = rec[idx]
+		}
+	}
+	src.addLine(line)
+	return vals, nil
+}
+
+// ingestLineWindow is the number of most recently read rows for which the
+// line numbers in the input are remembered. Errors from PostgreSQL in rows
+// before these are reported without a line number. The rows PostgreSQL is
+// working on do not lag much behind those read, since the copy is streamed.
+const ingestLineWindow = 4096
+
+// addLine records the line number of the row just read.
+func (src *ingestSource) addLine(line int) {
+	src.lines[src.rows%ingestLineWindow] = line
+	src.rows++
+}
+
+// lineOf returns the line number in the input of the given row (starting
+// from 1), or 0 if it is not known.
+func (src *ingestSource) lineOf(row int) int {
+	if row <= 0 || row > src.rows || row <= src.rows-ingestLineWindow {
+		return 0
+	}
+	return src.lines[(row-1)%ingestLineWindow]
+}
+
+// nextObject reads the next json object from the input.
+func (src *ingestSource) nextObject() (obj map[string]any, line int, err error) {
+	if src.pending != nil {
+		obj, line = src.pending, src.pline
+		src.pending = nil
+		return
+	}
+	var raw []byte
+	if src.br != nil {
+		// ndjson, skip blank lines
+		for len(bytes.TrimSpace(raw)) == 0 {
+			if raw, err = src.br.ReadBytes('\n'); err == io.EOF && len(raw) > 0 {
+				err = nil
+			} else if err != nil {
+				return
+			}
+			src.line++
+		}
+		line = src.line
+	} else {
+		// json array
+		if !src.dec.More() {
+			if _, err = src.dec.Token(); err != nil { // closing bracket
+				err = src.jsonError(err)
+				return
+			}
+			err = io.EOF
+			return
+		}
+		var rm json.RawMessage
+		if err = src.dec.Decode(&rm); err != nil {
+			err = src.jsonError(err)
+			return
+		}
+		line = src.lc.lineAt(src.dec.InputOffset() - int64(len(rm)))
+		raw = rm
+	}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	if err = dec.Decode(&obj); err != nil || obj == nil {
+		err = &ingestError{line: line, err: errors.New("expected a json object")}
+	}
+	return
+}
+
+// jsonError adds the line number to json syntax errors.
+func (src *ingestSource) jsonError(err error) error {
+	var se *json.SyntaxError
+	if errors.As(err, &se) {
+		return &ingestError{line: src.lc.lineAt(se.Offset), err: err}
+	} else if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return &ingestError{err: errors.New("unexpected end of input")}
+	}
+	return &ingestError{err: err}
+}
+
+// csvError adds the line number to csv parse errors.
+func csvError(err error) error {
+	var pe *csv.ParseError
+	if errors.As(err, &pe) {
+		return &ingestError{line: pe.Line, err: pe.Err}
+	}
+	return &ingestError{err: err}
+}
+
+// lineCounter counts the lines in the data read through it, so that the line
+// number at a given offset can be found. The offsets must be queried in
+// increasing order.
+type lineCounter struct {
+	r     io.Reader
+	off   int64   // offset of the data read so far
+	nls   []int64 // offsets of newlines not yet passed
+	lines int     // number of newlines passed
+}
+
+func (lc *lineCounter) Read(p []byte) (n int, err error) {
+	n, err = lc.r.Read(p)
+	for i := 0; i < n; i++ {
+		if p[i] == '\n' {
+			lc.nls = append(lc.nls, lc.off+int64(i))
+		}
+	}
+	lc.off += int64(n)
+	return
+}
+
+func (lc *lineCounter) lineAt(off int64) int {
+	i := 0
+	for i < len(lc.nls) && lc.nls[i] < off {
+		i++
+	}
+	lc.lines += i
+	lc.nls = lc.nls[i:]
+	return lc.lines + 1
+}
+
+//------------------------------------------------------------------------------
+// copy
+
+// copyReader supplies the rows from an ingestSource in the text format of
+// the PostgreSQL COPY command, one row per line.
+type copyReader struct {
+	mu     sync.Mutex
+	src    *ingestSource
+	buf    []byte
+	err    error // error from src, io.EOF at end
+	closed bool
+}
+
+func (cr *copyReader) Read(p []byte) (int, error) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	for len(cr.buf) == 0 && cr.err == nil && !cr.closed {
+		vals, err := cr.src.next()
+		if err != nil {
+			cr.err = err
+			break
+		}
+		for i, v := range vals {
+			if i > 0 {
+				cr.buf = append(cr.buf, '\t')
+			}
+			cr.buf = appendCopyText(cr.buf, v)
+		}
+		cr.buf = append(cr.buf, '\n')
+	}
+	if cr.closed {
+		return 0, io.EOF
+	}
+	n := copy(p, cr.buf)
+	cr.buf = cr.buf[n:]
+	if n == 0 {
+		return 0, cr.err
+	}
+	return n, nil
+}
+
+var rxCopyLine = regexp.MustCompile(`\bline ([0-9]+)\b`)
+
+// close stops further reads from the source, and returns the error, if any,
+// that caused the copy with the given result to fail. Errors caused by the
+// input are returned as *ingestError, with the line number in the input if
+// it is known.
+func (cr *copyReader) close(copyErr error) error {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	cr.closed = true
+	if cr.err != nil && cr.err != io.EOF {
+		return cr.err // error in reading the input
+	}
+	if copyErr == nil {
+		return nil
+	}
+	// errors for a row of data have the row number in the context
+	var pgErr *pgconn.PgError
+	if !errors.As(copyErr, &pgErr) {
+		return copyErr
+	}
+	line := 0
+	if m := rxCopyLine.FindStringSubmatch(pgErr.Where); m != nil {
+		if row, err := strconv.Atoi(m[1]); err == nil {
+			line = cr.src.lineOf(row)
+		}
+	}
+	// data exceptions (class 22) and integrity constraint violations (class
+	// 23) are caused by the input, even if the line is not known
+	if line > 0 || strings.HasPrefix(pgErr.Code, "22") || strings.HasPrefix(pgErr.Code, "23") {
+		return &ingestError{line: line, err: copyErr}
+	}
+	return copyErr
+}
+
+// appendCopyText appends a value in the text format of the COPY command.
+func appendCopyText(buf []byte, v any) []byte {
+	var s string
+	switch v := v.(type) {
+	case nil:
+		return append(buf, `\N`...)
+	case string:
+		s = v
+	case json.Number:
+		s = v.String()
+	case bool:
+		s = strconv.FormatBool(v)
+	default: // json objects and arrays
+		b, _ := json.Marshal(v)
+		s = string(b)
+	}
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '\\':
+			buf = append(buf, `\\`...)
+		case '\n':
+			buf = append(buf, `\n`...)
+		case '\r':
+			buf = append(buf, `\r`...)
+		case '\t':
+			buf = append(buf, `\t`...)
+		default:
+			buf = append(buf, c)
+		}
+	}
+	return buf
+}
@@ -103,7 +103,7 @@ func (a *APIServer) runJob(job *Job) {
 			return
 		}
 	} else if job.Type == "javascript" {
-		if _, _, err := a.runScript(job.Script, make(map[string]any), logger, job.Debug); err != nil {
+		if _, _, _, err := a.runScript(job.Script, make(map[string]any), nil, logger, job.Debug); err != nil {
 			logger.Error().Err(err).Msg("javascript execution failed")
 		}
 	}
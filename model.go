@@ -64,6 +64,13 @@ type APIServerConfig struct {
 	// on for individual URIs.
 	Compression bool `json:"compression,omitempty"`
 
+	// CursorKey is the secret key used to sign the cursors of paginated
+	// endpoints, so that clients cannot tamper with them. It is required if
+	// any endpoint is paginated, and should be a random string of at least
+	// 32 characters. Changing the key invalidates all cursors issued so far.
+	// See the documentation of Pagination struct for more info.
+	CursorKey string `json:"cursorKey,omitempty"`
+
 	// Endpoints is a list of all URIs implemented using queries or script.
 	// See the documentation of Endpoint struct for more info. Optional.
 	Endpoints []Endpoint `json:"endpoints,omitempty"`
@@ -118,8 +125,13 @@ type ValidationResult struct {
 // endpoint
 
 // Endpoint is a URI backed by an implementation that can:
-//   - perform a SELECT-like SQL query and return the results in JSON or CSV
+//   - perform a SELECT-like SQL query and return the results in JSON, NDJSON,
+//     CSV, Arrow or Parquet
 //   - execute a SQL query
+//   - run a batch of SQL queries in a transaction
+//   - load rows from the request body into a table
+//   - export the results of a SQL query using COPY
+//   - list, get, create, update and delete the rows of a table
 //   - serve a static JSON or plain text data
 //   - run the specified javascript code
 type Endpoint struct {
@@ -144,41 +156,243 @@ type Endpoint struct {
 	// the documentation for Param struct for more info.
 	Params []Param `json:"params,omitempty"`
 
-	// ImplType is one of `query-json`, `query-csv`, `exec`, `static-text`,
-	// `static-json` or `javascript`, and must be specified. For query-json,
-	// query-csv and exec, the `Script` field should be a valid SQL statement.
-	// For static-json the `Script` should be valid JSON. For javascript, the
-	// `Script` should contain the javascript code.
+	// BodySchema, if set, is a JSON Schema that the request body must be
+	// valid against. The body must then be a JSON document, and the server
+	// returns a HTTP status code 400 with the reason if it is missing or not
+	// valid. For SQL statements, the document is available as an additional
+	// bind variable of type jsonb after the params (that is, $N+1 where N is
+	// the number of params), which can also be referred to by name as
+	// `:body`, in which case it is cast to jsonb. For batch steps, it can be
+	// listed in Params as `body`. For javascript, it is available as
+	// $sys.body. Params cannot be in the body, nor named `body`. Applicable
+	// to query types, exec, export types, batch and javascript. Since every
+	// request must have a body, Methods should be set to some of `POST`,
+	// `PUT` or `PATCH`; GET requests always fail with status code 400.
+	// The schema is a subset of JSON Schema draft 2020-12, consisting of the
+	// keywords `type`, `enum`, `const`, `minimum`, `maximum`,
+	// `exclusiveMinimum`, `exclusiveMaximum`, `multipleOf`, `minLength`,
+	// `maxLength`, `pattern`, `format`, `items`, `prefixItems`, `minItems`,
+	// `maxItems`, `uniqueItems`, `properties`, `required`,
+	// `additionalProperties`, `minProperties`, `maxProperties`, `allOf`,
+	// `anyOf`, `oneOf` and `not`, along with annotations like `title` and
+	// `description`. Formats are always checked, and can be one of
+	// `date-time`, `date`, `time`, `email`, `uuid`, `uri`, `ipv4`, `ipv6` or
+	// `hostname`. Patterns use the syntax of Go regular expressions.
+	BodySchema map[string]any `json:"bodySchema,omitempty"`
+
+	// ImplType is one of `query`, `query-json`, `query-ndjson`, `query-csv`,
+	// `query-arrow`, `query-parquet`, `exec`, `batch`, `ingest`,
+	// `export-csv`, `export-binary`, `table`, `static-text`, `static-json`
+	// or `javascript`, and must be specified. For the query, exec and export
+	// types, the `Script` field should be a valid SQL statement. For
+	// static-json the `Script` should be valid JSON. For javascript, the
+	// `Script` should contain the javascript code. For batch, the SQL
+	// statements are specified in `Steps` instead, for ingest, the loading
+	// of rows is configured using `Ingest`, and for table, the table is
+	// specified in `Table`.
+	// The query type can output the results in any of the formats of the
+	// query-* types, chosen per request. See the documentation of Formats.
+	// The query-ndjson type outputs one JSON value per line for each row
+	// (newline-delimited JSON), with the content type `application/x-ndjson`.
+	// The query-arrow type outputs an Apache Arrow IPC stream (content type
+	// `application/vnd.apache.arrow.stream`) and query-parquet a Parquet file
+	// (content type `application/vnd.apache.parquet`). For these, boolean,
+	// integer, float, date, time, timestamp and bytea columns map to the
+	// corresponding Arrow types, timestamptz to timestamps in UTC, numeric
+	// with a precision of up to 38 to decimal128, and arrays of these to
+	// lists. Other types, including numeric without a precision, are output
+	// as strings in the same format as query-csv.
+	// The export-csv and export-binary types stream the output of
+	// `COPY (query) TO STDOUT` in the csv or binary format of PostgreSQL, with
+	// the content types `text/csv` and `application/octet-stream`. Since COPY
+	// does not support bind variables, the values of the parameters are
+	// substituted into the query as SQL literals. Errors that occur after the
+	// output has started are reported in the `X-Rapidrows-Error` trailer.
 	ImplType string `json:"implType"`
 
 	// Datasource refers to one of the datasources listed in
-	// APIServerConfig.Datasources. This field must be filled in for ImplType
-	// of query-json, query-csv and exec. Ignored for other types.
+	// APIServerConfig.Datasources. This field must be filled in for the
+	// query, export types, exec, batch, ingest and table. Ignored for other
+	// types.
 	Datasource string `json:"datasource,omitempty"`
 
-	// Script must be a valid SQL statement for query-json, query-csv or exec.
-	// For static-text, it will hold plain text. For static-json this must be
-	// valid JSON. For javascript, this should contain the javascript code.
-	// For type exec and no params, multiple SQL statements are allowed.
+	// Script must be a valid SQL statement for query types, export types or
+	// exec. For static-text, it will hold plain text. For static-json this
+	// must be valid JSON. For javascript, this should contain the javascript
+	// code. For type exec and no params, multiple SQL statements are allowed.
+	// Ignored for batch, ingest and table.
+	// In SQL statements, the values of the params are available as the bind
+	// variables $1, $2 etc., in the order of Params. They can also be
+	// referred to by name, as `:name` or `@name`, which are rewritten to
+	// $1, $2 etc. when the server starts. Names within string constants,
+	// quoted identifiers, dollar-quoted strings and comments are not
+	// rewritten, nor are type casts like `::text` and array slices like
+	// `a[lo : hi]` (use `a[lo : :hi]` for a param as the upper bound). An
+	// `@name` that is not the name of a param is left as it is, since `@` is
+	// also an operator.
+	// If named parameters are used, every param must be referred to in the
+	// statement.
 	Script string `json:"script,omitempty"`
 
-	// TxOptions allows running of query-json, query-csv and exec types within
-	// a transaction. Ignored for other types. See the documentation of
-	// TxOptions struct for more info.
+	// Steps lists the SQL statements of a batch type endpoint, which are run
+	// in order within a single transaction. The response is a JSON object
+	// with the result of each step as the value of a property named after
+	// the step. If any step fails, the transaction is rolled back and the
+	// server returns HTTP status code 500 with a JSON object that has the
+	// name of the failed step and the error. Required for batch, ignored for
+	// other types. See the documentation of BatchStep for more info.
+	Steps []BatchStep `json:"steps,omitempty"`
+
+	// Ingest configures how the rows in the request body of an ingest type
+	// endpoint are loaded into a table. Required for ingest, ignored for other
+	// types. See the documentation of IngestOptions for more info.
+	Ingest *IngestOptions `json:"ingest,omitempty"`
+
+	// Table is the name of the table, optionally schema-qualified, whose rows
+	// are served by a table type endpoint. The columns and the primary key of
+	// the table are read from the datasource when the server starts. The
+	// endpoint then serves:
+	//   - GET {uri}: list the rows, ordered by the primary key; the query
+	//     parameters `limit` (default and maximum 1000) and `offset` select
+	//     the rows returned
+	//   - POST {uri}: create a row, returns 201
+	//   - GET {uri}/{key}: get the row with the given primary key
+	//   - PUT {uri}/{key}: replace the row, setting the columns not given to
+	//     their defaults
+	//   - PATCH {uri}/{key}: update only the columns given
+	//   - DELETE {uri}/{key}: delete the row, returns 204
+	// For a composite primary key, {key} is the value of each key column as
+	// a separate path component, in order. Tables without a primary key can
+	// only be listed and created. Rows are sent and received as JSON objects
+	// with the column names as properties, and the values in the request are
+	// validated according to the types of the columns. Request bodies
+	// larger than 1 MiB are rejected with 413. Methods, if set, limits the
+	// operations that are served. Required for table, ignored for other
+	// types.
+	Table string `json:"table,omitempty"`
+
+	// TxOptions allows running of query, export, exec and table types within
+	// a transaction. The steps of batch types and the loading of rows for
+	// ingest types always run within a transaction, whose options can be set
+	// using this. Ignored for other types. See the documentation of TxOptions
+	// struct for more info.
 	TxOptions *TxOptions `json:"tx,omitempty"`
 
 	// Debug enables debug logging of all invocations of this endpoint.
 	Debug bool `json:"debug,omitempty"`
 
-	// Timeout in seconds for query-* and exec type. Ingored for other types.
+	// Timeout in seconds for query, export, exec, batch, ingest and table
+	// types.
+	// Ingored for other types.
 	// Ignored if <= 0.
 	Timeout *float64 `json:"timeout,omitempty"`
 
 	// Cache the result for these many seconds. The APIServer should be started
 	// with a RuntimeInterface that supports caching for this to work. The
 	// cache entry is specific to the exact values of parameters for the
-	// invocation. Ignored if <= 0.
+	// invocation. Ignored if <= 0. Responses of query types that are not
+	// streamed, as well as those served from the cache, include the (weak)
+	// `ETag`, `Last-Modified` and `Cache-Control: max-age=N` headers, where N
+	// is the number of seconds for which the result will remain in the cache.
+	// Conditional GET requests using `If-None-Match` or `If-Modified-Since`
+	// get a response with status 304 if the result has not changed. Concurrent
+	// requests for a result that is not in the cache share a single query,
+	// unless the endpoint streams its output. For javascript, the status code,
+	// content type and body of responses of scripts that ran successfully are
+	// cached. The script can set `$sys.nocache = true` to skip caching the
+	// response of an invocation, or set `$sys.cache` to a smaller number of
+	// seconds for which it should be cached instead.
 	Cache *float64 `json:"cache,omitempty"`
+
+	// StaleWhileRevalidate allows a cached result to be served for these many
+	// seconds after it has expired, while the query is run again in the
+	// background to refresh the cache. Only one such query is run at a time
+	// for each cache entry. Applicable only for query types that do not
+	// stream their output, and only if Cache is set. Ignored if <= 0.
+	StaleWhileRevalidate *float64 `json:"staleWhileRevalidate,omitempty"`
+
+	// CacheControl, if set, is used as the value of the `Cache-Control`
+	// header for successful responses of query types, instead of the one
+	// derived from Cache. Example: `public, max-age=60`, `no-store`.
+	CacheControl string `json:"cacheControl,omitempty"`
+
+	// InvalidateOn lists PostgreSQL channels, a notification on any of which
+	// discards all the cached results of this endpoint, irrespective of how
+	// long they have been cached. Applicable only if Cache is set. See the
+	// documentation of CacheInvalidation struct for more info.
+	InvalidateOn []CacheInvalidation `json:"invalidateOn,omitempty"`
+
+	// Rows selects how each row of the result is represented in the json and
+	// ndjson formats (query-json, query-ndjson and query). It is one of
+	// `arrays` (the default), where each row is an array of column values in
+	// the order of the SELECT, or `objects`, where each row is an object with
+	// the column names as keys. If a column name repeats, the later ones get a
+	// numeric suffix (id, id_2, id_3 ..) to keep the keys unique.
+	Rows string `json:"rows,omitempty"`
+
+	// Columns, if true, adds a `columns` array to the json format output
+	// (query-json and query), listing the name, PostgreSQL type OID and type
+	// name of each column. Applicable only if Rows is `arrays`.
+	Columns bool `json:"columns,omitempty"`
+
+	// Stream, if true, makes query endpoints write out rows to the client
+	// as they are read from the database, instead of collecting the whole
+	// resultset first. If an error occurs after the output has started, it is
+	// reported in the HTTP trailer `X-Rapidrows-Error`. For the json format it
+	// is also reported as the `error` property of the output, and for ndjson
+	// as a last line of the form `{"error": "..."}`. For the arrow and
+	// parquet formats, the output is left incomplete, without the
+	// end-of-stream marker or footer. When caching, outputs larger than
+	// 32 MiB are not cached.
+	Stream bool `json:"stream,omitempty"`
+
+	// CSV specifies the format of the csv output (query-csv and query). If
+	// omitted, the output is comma-separated, without a header row, and
+	// NULLs are written out as empty values. For ingest, the Delimiter and
+	// Null options are used to read csv input. For export-csv, all options
+	// other than CRLF and Quote `nonnumeric` are supported. See the
+	// documentation of CSVOptions struct for more info.
+	CSV *CSVOptions `json:"csv,omitempty"`
+
+	// Formats lists the output formats that an endpoint of type query can
+	// produce, out of `json`, `ndjson`, `csv`, `arrow` and `parquet`. These
+	// correspond to the output of the query-json, query-ndjson, query-csv,
+	// query-arrow and query-parquet types respectively. If omitted, all of
+	// them are available. The format for each request is chosen from the
+	// `format` query parameter if present (like `?format=csv`), else from
+	// the `Accept` header. If neither of these name an available format, the
+	// request fails with a status of 406.
+	Formats []string `json:"formats,omitempty"`
+
+	// Format is the output format of an endpoint of type query for requests
+	// that do not indicate a preference, and is preferred when the `Accept`
+	// header allows more than one. If omitted, defaults to the first of
+	// Formats, or to `json`.
+	Format string `json:"format,omitempty"`
+
+	// Result selects the shape of the json format output (query-json and
+	// query). It is one of `rows` (the default), where the output is an
+	// object with the rows in the `rows` property, `single`, where the output
+	// is the only row of the result as an object with the column names as
+	// keys, or `scalar`, where the output is the value of the first column of
+	// the first row. For `single` and `scalar`, the response has a status of
+	// 404 if the query returns no rows, and for `single`, a status of 500 if
+	// the query returns more than one row. Stream is ignored for `single` and
+	// `scalar`.
+	Result string `json:"result,omitempty"`
+
+	// Filter lets clients of query types filter, sort and limit the rows of
+	// the result using query parameters, like
+	// `?status=eq.paid&order=created_at.desc&limit=50`. The query is run as a
+	// subquery, with the conditions, ORDER BY and LIMIT/OFFSET applied to its
+	// result. See the documentation of FilterOptions struct for more info.
+	Filter *FilterOptions `json:"filter,omitempty"`
+
+	// Paginate enables keyset pagination for query types. Each request gets
+	// one page of rows, ordered by the key columns, along with a cursor for
+	// the next page. See the documentation of Pagination struct for more
+	// info.
+	Paginate *Pagination `json:"paginate,omitempty"`
 }
 
 // TxOptions specify what type of transaction to use for a SQL query. These
@@ -197,6 +411,200 @@ type TxOptions struct {
 	Deferrable bool `json:"deferrable,omitempty"`
 }
 
+// BatchStep is a single SQL statement of a batch type endpoint.
+type BatchStep struct {
+	// Name of the step, required. It has to be unique within the endpoint,
+	// and a C-like identifier (first character A-Z, a-z; optionally followed
+	// by A-Z, a-z, 0-9 or _.)
+	Name string `json:"name"`
+
+	// Mode is either `query`, in which case the result of the step is an
+	// object with the columns and rows returned by the statement, or `exec`,
+	// in which case it is an object with the number of rows affected.
+	// Required.
+	Mode string `json:"mode"`
+
+	// Script is the SQL statement to run, required.
+	Script string `json:"script"`
+
+	// Params lists the names of the endpoint's parameters whose values are
+	// passed to the statement as the bind variables $1, $2 etc., in that
+	// order. A parameter can be listed in any number of steps. Optional.
+	// The endpoint's parameters can also be referred to by name in Script,
+	// as `:name` or `@name`, in which case they need not be listed here.
+	Params []string `json:"params,omitempty"`
+}
+
+// IngestOptions specify how an ingest type endpoint loads the rows in the
+// request body into a table. The body can be CSV with a header row,
+// newline-delimited JSON objects or a JSON array of objects, indicated by
+// Format or else by the content type of the request (`text/csv`,
+// `application/x-ndjson` or `application/json`). Bodies compressed with gzip
+// or deflate are accepted. The rows are streamed into the table with the
+// COPY command, within a transaction. The values are passed as text, so
+// they must be in a format that PostgreSQL accepts as input for the type of
+// the column. JSON objects and arrays are passed as JSON text.
+//
+// The response is a JSON object with the number of rows loaded in the
+// property `rowsCopied` and, if Merge is set, the number of rows affected by
+// it in `rowsAffected`. If the load fails, the transaction is rolled back
+// and the server returns a JSON object with the error in `error`, and the
+// line number of the input that caused it in `line`, if known. The HTTP
+// status code is 400 for errors caused by the input, 500 otherwise.
+type IngestOptions struct {
+	// Table is the name of the table, optionally schema-qualified, into which
+	// the rows are loaded. Required.
+	Table string `json:"table"`
+
+	// Format is one of `csv`, `ndjson` or `json`. If omitted, the format is
+	// determined from the content type of the request. For csv, the delimiter
+	// and the string that represents NULL values (by default, an empty field)
+	// are taken from the endpoint's CSV options.
+	Format string `json:"format,omitempty"`
+
+	// Columns maps the names of fields in the input (the columns in the CSV
+	// header, or the properties of JSON objects) to the names of the columns
+	// of the table. Only the fields listed here are loaded, others are
+	// ignored. If omitted, all the fields are loaded into columns of the same
+	// name: for csv, the fields in the header, and for JSON, the properties
+	// of the first object. Other objects having properties not present in the
+	// first one is an error in this case.
+	Columns map[string]string `json:"columns,omitempty"`
+
+	// Staging, if set, is the name of a temporary table that is created with
+	// the columns of Table that are being loaded, and dropped at the end of
+	// the transaction. The rows are loaded into this table instead of Table,
+	// for Merge to process further.
+	Staging string `json:"staging,omitempty"`
+
+	// Merge is a SQL statement that is run after the rows are loaded, within
+	// the same transaction. It can, for example, be an `INSERT .. SELECT ..
+	// ON CONFLICT ..` statement that merges the rows from the staging table
+	// into Table. The values of the endpoint's parameters are available as
+	// $1, $2 etc., or by name as for Endpoint.Script. Required if Staging is
+	// set.
+	Merge string `json:"merge,omitempty"`
+}
+
+// FilterOptions specify the columns of the result of a query that clients can
+// filter and sort on. Only the columns listed here can be used, and the values
+// given by the clients are always passed as bind variables.
+//
+// A filter is a query parameter named after the column, with a value of the
+// form `operator.value`. The operators are `eq`, `neq`, `gt`, `gte`, `lt`,
+// `lte`, `like`, `ilike` (where `*` can be used in place of `%`), `in` (with
+// a list of values like `in.(1,2,3)`, values with commas or parentheses can
+// be double-quoted) and `is` (with one of the values `null`, `true`, `false`
+// or `unknown`). The operator can be prefixed with `not.` to negate the
+// condition. Values are converted to the type of the column by PostgreSQL.
+// Multiple filters, including those on the same column, must all match.
+//
+// The query parameter `order` is a comma-separated list of columns to sort
+// on, each optionally followed by `.asc` or `.desc`, and by `.nullsfirst` or
+// `.nullslast`. The query parameters `limit` and `offset` limit the rows
+// returned. Invalid filters result in a response with status code 400.
+type FilterOptions struct {
+	// Columns maps the names of the columns that can be filtered on to the
+	// operators that are allowed for each. If the list of operators of a
+	// column is empty, all operators are allowed.
+	Columns map[string][]string `json:"columns,omitempty"`
+
+	// Order lists the names of the columns that the rows can be sorted on.
+	Order []string `json:"order,omitempty"`
+
+	// Limit is the number of rows returned if the client does not specify a
+	// limit. If omitted or 0, all rows are returned.
+	Limit int `json:"limit,omitempty"`
+
+	// MaxLimit is the maximum limit that a client can specify. If set, it is
+	// also the default limit if Limit is not set.
+	MaxLimit int `json:"maxLimit,omitempty"`
+}
+
+// Pagination configures keyset (or cursor) pagination of the rows returned by
+// a query type endpoint. The query is run as a subquery, and its rows are
+// ordered by the key columns and limited to one page. Rather than skipping
+// rows using an offset, the next page starts after the key values of the last
+// row of the current one. This remains fast for large results, and no rows
+// are skipped or repeated if rows are inserted concurrently.
+//
+// If there are more rows, the response includes a `Link` header (RFC 8288)
+// with the URL of the next page and `rel="next"`. For the json format, the
+// cursor is also included in the output as the `next` property. The URL of
+// the next page is that of the request, with the query parameter `cursor`
+// set to the cursor. The query parameter `limit` sets the number of rows in
+// a page. Cursors are opaque to clients, and are signed using
+// APIServerConfig.CursorKey. Requests with an invalid cursor or limit get
+// a response with status code 400.
+//
+// Pagination can be combined with Filter, but the `order` and `offset` query
+// parameters of filters cannot be used. Stream is ignored for paginated
+// endpoints, and Result must be `rows`.
+type Pagination struct {
+	// Keys lists the columns of the result that the rows are ordered on,
+	// each optionally followed by `.asc` or `.desc`. Together, the key
+	// columns must uniquely identify a row, and must not be NULL. Required.
+	// Example: `[created_at.desc, id.desc]`
+	Keys []string `json:"keys"`
+
+	// Limit is the number of rows in a page if the client does not specify
+	// one. Defaults to 100, or to MaxLimit if that is smaller.
+	Limit int `json:"limit,omitempty"`
+
+	// MaxLimit is the maximum number of rows in a page that a client can
+	// specify.
+	MaxLimit int `json:"maxLimit,omitempty"`
+}
+
+// CacheInvalidation identifies a PostgreSQL channel, a notification on which
+// invalidates the cached results of an endpoint. The payload of the
+// notification is not used.
+type CacheInvalidation struct {
+	// Datasource is the name of the datasource listed in
+	// APIServerConfig.Datasources, and is required. The channel specified
+	// below will refer to a channel in this database.
+	Datasource string `json:"datasource"`
+
+	// Channel refers to the name of the PostgreSQL channel. Must be a valid
+	// channel name, and must be specified.
+	Channel string `json:"channel"`
+}
+
+// CSVOptions specify the dialect and formatting of the CSV output of query-csv
+// endpoints. Irrespective of these options, values are formatted based on
+// the type of the column: dates, times and timestamps are in ISO 8601 format
+// (timestamps with time zone include the offset), bytea values are in hex
+// with a `\x` prefix, json and jsonb values are JSON text, and numeric,
+// array, interval and other values are in the PostgreSQL text format.
+type CSVOptions struct {
+	// Header, if true, writes a header row with the names of the columns.
+	Header bool `json:"header,omitempty"`
+
+	// Null is the string written out for NULL values. Defaults to an empty
+	// string.
+	Null string `json:"null,omitempty"`
+
+	// Delimiter is one of `comma`, `tab` or `semicolon`. Defaults to `comma`.
+	// If set to `tab`, the content type of the output is
+	// `text/tab-separated-values` rather than `text/csv`.
+	Delimiter string `json:"delimiter,omitempty"`
+
+	// Quote is one of `minimal`, `all` or `nonnumeric`, and defaults to
+	// `minimal`. With `minimal`, only values that contain the delimiter,
+	// double quotes or newlines are quoted, as are empty strings if Null is
+	// also empty. With `all`, all values are quoted and with `nonnumeric`, all
+	// values other than numbers are quoted. NULLs are not quoted unless
+	// required, so that they can be distinguished from empty strings.
+	Quote string `json:"quote,omitempty"`
+
+	// CRLF, if true, uses \r\n as the line terminator instead of \n.
+	CRLF bool `json:"crlf,omitempty"`
+
+	// BOM, if true, writes a UTF-8 byte order mark at the start of the output.
+	// This helps Microsoft Excel recognize the file as UTF-8.
+	BOM bool `json:"bom,omitempty"`
+}
+
 // Param represents a single parameter of an endpoint. A parameter can be
 // passed in as part of the query parameters, as part of the URI path or
 // in a json or form-encoded HTTP body. Some level of validation of the
@@ -209,22 +617,83 @@ type Param struct {
 	// A-Z, a-z, 0-9 or _.)
 	Name string `json:"name"`
 
-	// In specifies how the parameter will be passed, and is required. Must be
-	// one of `query`, `path` or `body`. If `body` is specified, the parameter
-	// maybe passed either as a form (application/x-www-form-urlencoded) or
-	// a json object (application/json).
+	// In specifies how the parameter will be passed, and is required unless
+	// the value is computed by the server (see .Source). Must be one of
+	// `query`, `path`, `body`, `header` or `cookie`. If `body` is specified,
+	// the parameter maybe passed either as a form
+	// (application/x-www-form-urlencoded or multipart/form-data) or a json
+	// object (application/json). Parameters of ingest type endpoints cannot be
+	// passed in the body. For `header`, the name of the header is the name of
+	// the parameter with underscores replaced by hyphens, and is matched
+	// case-insensitively (the parameter `x_tenant_id` is read from the header
+	// `X-Tenant-Id`). For `cookie`, the name of the cookie is the name of the
+	// parameter. For array type parameters, each header or cookie of the
+	// given name is an element, and header values are also split at commas.
 	In string `json:"in"`
 
 	// Required indicates that the parameter, if not supplied, will be an
 	// error (the server will return a HTTP status code 400). If it is not
-	// required and not supplied, the SQL queries will receive a NULL as the
-	// value of this parameter.
+	// required and not supplied, the SQL queries will receive the Default, or
+	// a NULL if there is no default, as the value of this parameter.
 	Required bool `json:"required"`
 
+	// Default is the value of the parameter if it is not supplied. It must be
+	// a valid value for the parameter, and is specified as in a JSON request
+	// body (for example, a date as a string or an array as an array). Cannot
+	// be specified for parameters of type file. Not used if Required is set.
+	Default any `json:"default,omitempty"`
+
+	// Source, if set, makes the value of the parameter computed by the server
+	// rather than supplied by the client, and In must not be set. It is one
+	// of:
+	//   - `now`: the current time, for parameters of type timestamp
+	//   - `clientIP`: the IP address of the client, for parameters of type
+	//     string, as taken from the X-Forwarded-For or X-Real-Ip headers if
+	//     present, else from the connection
+	//   - `requestID`: the value of the X-Request-Id header if present, else a
+	//     newly generated UUID, for parameters of type string
+	//   - `claim`: the value of the claim named by .Claim, of the user that
+	//     made the request, as returned by RuntimeInterface.Claims
+	// If the value is not available, as for a claim that is not present, the
+	// parameter is treated as not supplied. Note that parameters with the
+	// sources `now` or `requestID` have a different value for each request,
+	// so the results of the endpoint are not cached even if Cache is set.
+	// Responses of endpoints with `claim` parameters include `Vary:
+	// Authorization`, and their `Cache-Control` header, unless set
+	// explicitly, is marked `private`.
+	Source string `json:"source,omitempty"`
+
+	// Claim is the name of the claim that is the value of the parameter, if
+	// Source is `claim`. Claims can be of any type that is valid for the
+	// parameter, like a string for a user ID or an array for a list of roles.
+	// For a json type parameter, the claim is used as is, any string is not
+	// parsed as JSON text.
+	Claim string `json:"claim,omitempty"`
+
 	// Type of the parameter, required. Must be one of `integer`, `number`,
-	// `string`, `boolean` or `array`. If the type is `number`, the value can
-	// either be an integer or a float. If it is an `array`, the type of the
-	// elements of the array have to be specified using the .ElemType field.
+	// `decimal`, `string`, `boolean`, `date`, `time`, `timestamp`, `uuid`,
+	// `json`, `array` or `file`. If the type is `number`, the value can either
+	// be an integer or a float. If it is an `array`, the type of the elements
+	// of the array have to be specified using the .ElemType field. Parameters
+	// of type `file` must be `in` the `body`, and are uploaded as a part of a
+	// multipart/form-data request. Their contents are passed to SQL queries as
+	// a bytea (or as text, see .Text) and to javascript as an array of bytes
+	// (or as a string).
+	//
+	// Values of type `decimal` are numbers of arbitrary precision, which are
+	// passed without rounding them to a float. Values of type `date` must be
+	// of the form `2006-01-02`, `time` of the form `15:04:05` or `15:04`
+	// with optional fractional seconds, and `timestamp` in the RFC 3339
+	// format, like `2006-01-02T15:04:05.999Z` or `2006-01-02T15:04:05+05:30`.
+	// The `T` can also be a space. Timestamps with an offset are converted to
+	// UTC, and those without one are passed as is, to be interpreted by
+	// PostgreSQL (in the session time zone for timestamptz). Values of type
+	// `uuid` must be of the form `a0eebc99-9c0b-4ef8-bb6d-6bb9bd380a11`.
+	// Values of type `json` can be any JSON value, and when passed in a query,
+	// path or form, must be valid JSON text. All of these are passed to SQL
+	// queries as text, which PostgreSQL converts to the type expected by the
+	// query (like numeric, timestamptz or jsonb). To javascript, json values
+	// are passed as is and the others as strings.
 	Type string `json:"type"`
 
 	// Enum can be used to specify a list of allowed values, only for types
@@ -232,14 +701,24 @@ type Param struct {
 	// types of validation (like mininum or maxLength) do not have any effect.
 	Enum []any `json:"enum,omitempty"`
 
-	// Minimum can be used to set the minimum allowed value for types integer
-	// or number.
+	// Minimum can be used to set the minimum allowed value for types integer,
+	// number or decimal.
 	Minimum *float64 `json:"minimum,omitempty"`
 
-	// Maximum can be used to set the maximum allowed value for types integer
-	// or number.
+	// Maximum can be used to set the maximum allowed value for types integer,
+	// number or decimal.
 	Maximum *float64 `json:"maximum,omitempty"`
 
+	// Earliest can be used to set the minimum allowed value for types date,
+	// time or timestamp. It must be in the same format as the values. For
+	// timestamps, values without an offset are compared as if they were in
+	// UTC.
+	Earliest string `json:"earliest,omitempty"`
+
+	// Latest can be used to set the maximum allowed value for types date,
+	// time or timestamp, like Earliest.
+	Latest string `json:"latest,omitempty"`
+
 	// MaxLength can be used to set the maximum length for values of type
 	// string.
 	MaxLength *int `json:"maxLength,omitempty"`
@@ -260,6 +739,20 @@ type Param struct {
 	// of `integer`, `number`, `string` or `boolean`. Elements of varying types
 	// and nested arrays are not allowed.
 	ElemType string `json:"elemType,omitempty"`
+
+	// MaxSize can be used to set the maximum size, in bytes, of the contents
+	// of a file type parameter. Defaults to 10 MiB.
+	MaxSize *int64 `json:"maxSize,omitempty"`
+
+	// ContentTypes, if set, is the list of allowed media types for a file type
+	// parameter, like `application/pdf` or `image/*`. Uploads with other
+	// content types are rejected. Parts without a content type are considered
+	// to be of type `application/octet-stream`.
+	ContentTypes []string `json:"contentTypes,omitempty"`
+
+	// Text indicates that the contents of a file type parameter should be
+	// passed as text rather than bytes. The contents must then be valid UTF-8.
+	Text bool `json:"text,omitempty"`
 }
 
 //------------------------------------------------------------------------------
@@ -487,8 +980,17 @@ type Job struct {
 // results
 
 type queryResult struct {
-	Rows  [][]any `json:"rows"`
-	Error string  `json:"error,omitempty"`
+	Columns []columnInfo `json:"columns,omitempty"`
+	Rows    [][]any      `json:"rows"`
+	Error   string       `json:"error,omitempty"`
+	Next    string       `json:"next,omitempty"`
+}
+
+type columnInfo struct {
+	Name     string `json:"name"`
+	TypeOID  uint32 `json:"typeOid"`
+	TypeName string `json:"typeName,omitempty"`
+	typeMod  int32
 }
 
 type execResult struct {
@@ -0,0 +1,122 @@
+/*
+ * Copyright 2022 RapidLoop, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rapidrows
+
+import (
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// queryFormats are the output formats available for endpoints of type query.
+// The first one is the default.
+var queryFormats = []string{"json", "ndjson", "csv", "arrow", "parquet"}
+
+// formatsOf returns the output formats available for an endpoint of type
+// query, and the default format.
+func formatsOf(ep *Endpoint) (formats []string, def string) {
+	formats = ep.Formats
+	if len(formats) == 0 {
+		formats = queryFormats
+	}
+	def = ep.Format
+	if def == "" {
+		def = formats[0]
+	}
+	return
+}
+
+// negotiateFormat returns the output format to use for a request to an
+// endpoint of type query, or an empty string if none of the available formats
+// are acceptable. The "format" query parameter, if present, takes precedence
+// over the Accept header.
+func negotiateFormat(req *http.Request, ep *Endpoint) string {
+	formats, def := formatsOf(ep)
+	if f := req.URL.Query().Get("format"); f != "" {
+		return pick(contains(formats, f), f, "")
+	}
+	ranges := parseAccept(strings.Join(req.Header.Values("Accept"), ","))
+	if len(ranges) == 0 {
+		return def
+	}
+	// check the default first, so that it wins ties
+	best, bestQ := "", 0.0
+	for _, f := range append([]string{def}, formats...) {
+		mt, _, _ := strings.Cut(contentTypeOf(ep, f), ";")
+		if q := acceptQuality(ranges, mt); q > bestQ {
+			best, bestQ = f, q
+		}
+	}
+	return best
+}
+
+// mediaRange is one entry of an Accept header.
+type mediaRange struct {
+	typ, subtype string
+	q            float64
+}
+
+// parseAccept parses the value of an Accept header. Invalid entries are
+// ignored.
+func parseAccept(accept string) (ranges []mediaRange) {
+	for _, part := range strings.Split(accept, ",") {
+		mt, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		typ, subtype, ok := strings.Cut(mt, "/")
+		if !ok {
+			if mt != "*" {
+				continue
+			}
+			typ, subtype = "*", "*" // sent by some clients instead of */*
+		}
+		q := 1.0
+		if qs, ok := params["q"]; ok {
+			if v, err := strconv.ParseFloat(qs, 64); err == nil && v >= 0 && v <= 1 {
+				q = v
+			}
+		}
+		ranges = append(ranges, mediaRange{typ: typ, subtype: subtype, q: q})
+	}
+	return
+}
+
+// acceptQuality returns the quality value for the media type from the most
+// specific matching media range, or 0 if none match.
+func acceptQuality(ranges []mediaRange, mediaType string) (q float64) {
+	typ, subtype, _ := strings.Cut(mediaType, "/")
+	best := -1
+	for _, r := range ranges {
+		var specificity int
+		switch {
+		case r.typ == typ && r.subtype == subtype:
+			specificity = 2
+		case r.typ == typ && r.subtype == "*":
+			specificity = 1
+		case r.typ == "*" && r.subtype == "*":
+			specificity = 0
+		default:
+			continue
+		}
+		if specificity > best {
+			best, q = specificity, r.q
+		}
+	}
+	return
+}
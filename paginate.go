@@ -0,0 +1,234 @@
+/*
+ * Copyright 2022 RapidLoop, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rapidrows
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// defaultPageSize is the number of rows in a page of a paginated endpoint if
+// neither the endpoint nor the client specify one.
+const defaultPageSize = 100
+
+// pageReserved are the names of the query parameters that are used for
+// pagination.
+var pageReserved = []string{"cursor", "limit"}
+
+// keysetPage is a request for a page of the result of a paginated endpoint.
+type keysetPage struct {
+	after []string // key values of the last row of the previous page, if any
+	limit int64    // number of rows in the page
+}
+
+// pageKey splits an item of Pagination.Keys into the column name and whether
+// the order is descending.
+func pageKey(k string) (col string, desc bool) {
+	if strings.HasSuffix(k, ".desc") {
+		return strings.TrimSuffix(k, ".desc"), true
+	}
+	return strings.TrimSuffix(k, ".asc"), false
+}
+
+// readPage returns the page requested by the query parameters of a request
+// to a paginated endpoint.
+func (a *APIServer) readPage(ep *Endpoint, urlData url.Values) (*keysetPage, error) {
+	p := ep.Paginate
+	page := &keysetPage{limit: defaultPageSize}
+	if p.Limit > 0 {
+		page.limit = int64(p.Limit)
+	} else if p.MaxLimit > 0 && p.MaxLimit < defaultPageSize {
+		page.limit = int64(p.MaxLimit)
+	}
+	if v := urlData.Get("limit"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("limit %q: not a valid number of rows", v)
+		} else if p.MaxLimit > 0 && n > int64(p.MaxLimit) {
+			return nil, fmt.Errorf("limit %q: exceeds the maximum of %d", v, p.MaxLimit)
+		}
+		page.limit = n
+	}
+	if v := urlData.Get("cursor"); v != "" {
+		after, err := a.parseCursor(ep, v)
+		if err != nil {
+			return nil, err
+		}
+		page.after = after
+	}
+	return page, nil
+}
+
+// keysetCond returns the SQL condition that selects the rows after the
+// given key values, in the order of the keys.
+func keysetCond(keys []string, after []string, arg func(any) string) string {
+	idents := make([]string, len(keys))
+	vals := make([]string, len(keys))
+	ops := make([]string, len(keys))
+	for i, k := range keys {
+		col, desc := pageKey(k)
+		idents[i] = pgx.Identifier{col}.Sanitize()
+		vals[i] = arg(after[i])
+		ops[i] = pick(desc, "<", ">")
+	}
+
+	// if all keys are in the same direction, a row comparison will do
+	same := true
+	for _, op := range ops {
+		same = same && op == ops[0]
+	}
+	if same {
+		if len(keys) == 1 {
+			return idents[0] + " " + ops[0] + " " + vals[0]
+		}
+		return "(" + strings.Join(idents, ", ") + ") " + ops[0] +
+			" (" + strings.Join(vals, ", ") + ")"
+	}
+
+	// else: (k1 > v1) OR (k1 = v1 AND k2 < v2) OR ...
+	terms := make([]string, len(keys))
+	for i := range keys {
+		var t []string
+		for j := 0; j < i; j++ {
+			t = append(t, idents[j]+" = "+vals[j])
+		}
+		t = append(t, idents[i]+" "+ops[i]+" "+vals[i])
+		terms[i] = "(" + strings.Join(t, " AND ") + ")"
+	}
+	return "(" + strings.Join(terms, " OR ") + ")"
+}
+
+// keysetOrder returns the SQL ORDER BY terms for the keys.
+func keysetOrder(keys []string) []string {
+	order := make([]string, len(keys))
+	for i, k := range keys {
+		col, desc := pageKey(k)
+		order[i] = pgx.Identifier{col}.Sanitize() + pick(desc, " DESC", " ASC")
+	}
+	return order
+}
+
+// nextPage trims the extra row, if any, that was fetched beyond the page
+// limit, and sets qr.Next to the cursor for the next page if there are more
+// rows.
+func (a *APIServer) nextPage(ep *Endpoint, page *keysetPage, qr *queryResult) error {
+	if int64(len(qr.Rows)) <= page.limit {
+		return nil // this is the last page
+	}
+	qr.Rows = qr.Rows[:page.limit]
+	last := qr.Rows[len(qr.Rows)-1]
+	after := make([]string, len(ep.Paginate.Keys))
+	for i, k := range ep.Paginate.Keys {
+		col, _ := pageKey(k)
+		idx := -1
+		for j := range qr.Columns {
+			if qr.Columns[j].Name == col {
+				idx = j
+				break
+			}
+		}
+		if idx == -1 {
+			return fmt.Errorf("pagination key column %q is not in the result", col)
+		} else if last[idx] == nil {
+			return fmt.Errorf("pagination key column %q is NULL", col)
+		}
+		after[i] = formatText(qr.Columns[idx].TypeOID, last[idx])
+	}
+	qr.Next = a.makeCursor(ep, after)
+	return nil
+}
+
+// makeCursor returns a cursor holding the given key values. The cursor is
+// the base64-encoded JSON array of the values, followed by a period and
+// the base64-encoded HMAC of the values and the endpoint URI.
+func (a *APIServer) makeCursor(ep *Endpoint, after []string) string {
+	payload, _ := json.Marshal(after) // cannot fail
+	return base64.RawURLEncoding.EncodeToString(payload) + "." +
+		base64.RawURLEncoding.EncodeToString(a.cursorMAC(ep, payload))
+}
+
+// parseCursor checks the signature of a cursor made by makeCursor and
+// returns the key values in it.
+func (a *APIServer) parseCursor(ep *Endpoint, cursor string) ([]string, error) {
+	errInvalid := errors.New("invalid cursor")
+	p, s, ok := strings.Cut(cursor, ".")
+	if !ok {
+		return nil, errInvalid
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(p)
+	if err != nil {
+		return nil, errInvalid
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || !hmac.Equal(sig, a.cursorMAC(ep, payload)) {
+		return nil, errInvalid
+	}
+	var after []string
+	if err := json.Unmarshal(payload, &after); err != nil || len(after) != len(ep.Paginate.Keys) {
+		return nil, errInvalid
+	}
+	return after, nil
+}
+
+// cursorMAC returns the HMAC-SHA256 of the payload of a cursor, bound to the
+// URI of the endpoint so that cursors of one endpoint cannot be used with
+// another.
+func (a *APIServer) cursorMAC(ep *Endpoint, payload []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(a.cfg.CursorKey))
+	mac.Write([]byte(a.cfg.CommonPrefix + ep.URI))
+	mac.Write([]byte{0})
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+// setNextLink adds a Link header with the URL of the next page, which is the
+// URL of the request with the cursor query parameter replaced.
+func setNextLink(h http.Header, req *http.Request, next string) {
+	if next == "" {
+		return
+	}
+	q := req.URL.Query()
+	q.Set("cursor", next)
+	u := url.URL{Path: req.URL.Path, RawQuery: q.Encode()}
+	h.Set("Link", "<"+u.String()+`>; rel="next"`)
+}
+
+// splitCached splits a value stored in the cache for an endpoint into the
+// time at which it was stored, the cursor for the next page if the endpoint
+// is paginated, and the body. For paginated endpoints, the cursor is stored
+// after the timestamp, terminated by a newline.
+func splitCached(ep *Endpoint, val []byte) (stored int64, next string, body []byte) {
+	stored, body = int64(binary.BigEndian.Uint64(val[0:8])), val[8:]
+	if ep.Paginate != nil {
+		if i := bytes.IndexByte(body, '\n'); i >= 0 {
+			next, body = string(body[:i]), body[i+1:]
+		}
+	}
+	return
+}
@@ -17,20 +17,27 @@
 package rapidrows
 
 import (
+	"bytes"
 	"compress/flate"
 	"compress/gzip"
+	"crypto/rand"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"math"
+	"math/big"
+	"mime"
 	"net/http"
 	"net/url"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
+	"unicode/utf8"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/jackc/pgtype"
 	"github.com/rs/zerolog"
 )
 
@@ -38,8 +45,11 @@ import (
 // parameters
 
 type paramInfo struct {
-	rx   *regexp.Regexp // compiled "^{.Pattern}$"
-	enum any            // []string, []int64 or []float64
+	rx       *regexp.Regexp // compiled "^{.Pattern}$"
+	enum     any            // []string, []int64 or []float64
+	earliest *time.Time     // parsed .Earliest
+	latest   *time.Time     // parsed .Latest
+	def      any            // checked and converted .Default
 }
 
 func (a *APIServer) prepareParams() {
@@ -102,14 +112,66 @@ func (a *APIServer) prepareParams() {
 				}
 			} // enum
 
-			if info.rx != nil || info.enum != nil {
+			// earliest, latest
+			if isTemporal(p.Type) {
+				if t, _, err := parseTemporal(p.Type, p.Earliest); err == nil {
+					info.earliest = &t
+				}
+				if t, _, err := parseTemporal(p.Type, p.Latest); err == nil {
+					info.latest = &t
+				}
+			}
+
+			if info.rx != nil || info.enum != nil || info.earliest != nil || info.latest != nil {
 				a.pinfo.Store(ep.URI+"#"+p.Name, &info)
 			}
 
+			// default, which is checked using the info stored above
+			if p.Default != nil && !p.Required {
+				if v, err := a.defaultValue(&ep, &p); err == nil {
+					info.def = v
+					a.pinfo.Store(ep.URI+"#"+p.Name, &info)
+				}
+			}
+
 		} // for each param
 	} // for each endpoint
 }
 
+// defaultValue returns the default value of a parameter, checked and
+// converted like a value in a JSON request body.
+func (a *APIServer) defaultValue(ep *Endpoint, p *Param) (any, error) {
+	bp := *p
+	bp.In = "body"
+	return a.isSuitable(ep, &bp, jsonValue(p.Default))
+}
+
+// jsonValue converts the integers in a value decoded from the configuration
+// to json.Number, as they would be in a JSON request body.
+func jsonValue(v any) any {
+	switch v := v.(type) {
+	case int:
+		return json.Number(strconv.Itoa(v))
+	case int64:
+		return json.Number(strconv.FormatInt(v, 10))
+	case uint64:
+		return json.Number(strconv.FormatUint(v, 10))
+	case []any:
+		out := make([]any, len(v))
+		for i := range v {
+			out[i] = jsonValue(v[i])
+		}
+		return out
+	case map[string]any:
+		out := make(map[string]any, len(v))
+		for k := range v {
+			out[k] = jsonValue(v[k])
+		}
+		return out
+	}
+	return v
+}
+
 func (a *APIServer) isSuitable(ep *Endpoint, p *Param, v any) (out any, err error) {
 	// note: in case of query param or POST form body, v is always a []string
 	var s string
@@ -142,8 +204,27 @@ func (a *APIServer) isSuitable(ep *Endpoint, p *Param, v any) (out any, err erro
 			return a.checkBoolAny(ep, p, s)
 		}
 		return a.checkBoolAny(ep, p, v)
+	case "decimal":
+		if sv {
+			return a.checkDecimalAny(ep, p, s)
+		}
+		return a.checkDecimalAny(ep, p, v)
+	case "date", "time", "timestamp":
+		if sv {
+			return a.checkTemporal(ep, p, s)
+		}
+		return nil, fmt.Errorf("not a %s", p.Type)
+	case "uuid":
+		if sv {
+			return checkUUID(s)
+		}
+		return nil, errors.New("not a uuid")
+	case "json":
+		return checkJSON(p, v)
 	case "array":
 		return a.checkArrayAny(ep, p, v)
+	case "file":
+		return checkFile(p, v)
 	}
 
 	// should not happen if valid cfg
@@ -190,6 +271,9 @@ func (a *APIServer) checkString(ep *Endpoint, p *Param, s string) (string, error
 }
 
 func (a *APIServer) checkIntegerAny(ep *Endpoint, p *Param, v any) (int64, error) {
+	if n, ok := v.(json.Number); ok {
+		v = string(n)
+	}
 	if s, ok := v.(string); ok {
 		// allow both "200.00" and "200"
 		if f, err := strconv.ParseFloat(s, 64); err == nil {
@@ -237,6 +321,9 @@ func (a *APIServer) checkInteger(ep *Endpoint, p *Param, i int64) (int64, error)
 }
 
 func (a *APIServer) checkFloatAny(ep *Endpoint, p *Param, v any) (float64, error) {
+	if n, ok := v.(json.Number); ok {
+		v = string(n)
+	}
 	if s, ok := v.(string); ok {
 		if f, err := strconv.ParseFloat(s, 64); err != nil {
 			return 0, errors.New("not a valid number")
@@ -300,6 +387,171 @@ func (a *APIServer) checkBoolAny(ep *Endpoint, p *Param, v any) (out bool, err e
 	return false, fmt.Errorf("cannot convert value of type %T to boolean", v)
 }
 
+// textValue is the value of a parameter of type decimal, date, time,
+// timestamp, uuid or json, in its canonical text form. It is passed to
+// PostgreSQL in the text format, so that it is converted to the type that the
+// query expects, like a date to a timestamptz or json to a jsonb.
+type textValue struct {
+	text string
+	json bool // text is JSON, rather than a string
+}
+
+func (v textValue) EncodeText(ci *pgtype.ConnInfo, buf []byte) ([]byte, error) {
+	return append(buf, v.text...), nil
+}
+
+// MarshalJSON encodes the value for javascript, as a string unless it is
+// already JSON.
+func (v textValue) MarshalJSON() ([]byte, error) {
+	if v.json {
+		return []byte(v.text), nil
+	}
+	return json.Marshal(v.text)
+}
+
+func (v textValue) String() string {
+	return v.text
+}
+
+var rxDecimal = regexp.MustCompile(`^[+-]?([0-9]+(\.[0-9]*)?|\.[0-9]+)([eE][+-]?[0-9]{1,4})?$`)
+
+func (a *APIServer) checkDecimalAny(ep *Endpoint, p *Param, v any) (out any, err error) {
+	var s string
+	switch v := v.(type) {
+	case string:
+		s = v
+	case json.Number:
+		s = string(v)
+	case float64:
+		s = strconv.FormatFloat(v, 'g', -1, 64)
+	default:
+		return nil, fmt.Errorf("cannot convert value of type %T to decimal", v)
+	}
+	if !rxDecimal.MatchString(s) {
+		return nil, errors.New("not a valid decimal")
+	}
+
+	// minimum, maximum: compare exactly, without converting to float
+	if p.Minimum != nil || p.Maximum != nil {
+		d, _ := new(big.Rat).SetString(s) // valid, as checked above
+		if p.Minimum != nil && d.Cmp(new(big.Rat).SetFloat64(*p.Minimum)) < 0 {
+			return nil, fmt.Errorf("is lower than the minimum of %g", *p.Minimum)
+		}
+		if p.Maximum != nil && d.Cmp(new(big.Rat).SetFloat64(*p.Maximum)) > 0 {
+			return nil, fmt.Errorf("is higher than the maximum of %g", *p.Maximum)
+		}
+	}
+
+	return textValue{text: s}, nil
+}
+
+func isTemporal(typ string) bool {
+	return typ == "date" || typ == "time" || typ == "timestamp"
+}
+
+// parseTemporal parses the value of a parameter of type date, time or
+// timestamp. For timestamps, hasZone indicates if the value had an offset,
+// else it is parsed as UTC.
+func parseTemporal(typ, s string) (t time.Time, hasZone bool, err error) {
+	var layouts []string
+	switch typ {
+	case "date":
+		layouts = []string{"2006-01-02"}
+	case "time":
+		// note: fractional seconds are accepted after the seconds when parsing
+		layouts = []string{"15:04:05", "15:04"}
+	case "timestamp":
+		s = strings.Replace(strings.ToUpper(s), " ", "T", 1)
+		if t, err = time.Parse(time.RFC3339, s); err == nil {
+			return t, true, nil
+		}
+		layouts = []string{"2006-01-02T15:04:05"}
+	}
+	for _, l := range layouts {
+		if t, err = time.Parse(l, s); err == nil {
+			return t, false, nil
+		}
+	}
+	return time.Time{}, false, fmt.Errorf("not a valid %s", typ)
+}
+
+func (a *APIServer) checkTemporal(ep *Endpoint, p *Param, s string) (out any, err error) {
+	t, hasZone, err := parseTemporal(p.Type, s)
+	if err != nil {
+		return nil, err
+	}
+
+	// earliest, latest
+	if p.Earliest != "" || p.Latest != "" {
+		if pi, ok := a.pinfo.Load(ep.URI + "#" + p.Name); ok && pi != nil {
+			info := pi.(*paramInfo)
+			if info.earliest != nil && t.Before(*info.earliest) {
+				return nil, fmt.Errorf("is earlier than %s", p.Earliest)
+			}
+			if info.latest != nil && t.After(*info.latest) {
+				return nil, fmt.Errorf("is later than %s", p.Latest)
+			}
+		}
+	}
+
+	switch {
+	case p.Type == "date":
+		s = t.Format("2006-01-02")
+	case p.Type == "time":
+		s = t.Format("15:04:05.999999")
+	case hasZone:
+		s = t.UTC().Format("2006-01-02T15:04:05.999999Z07:00")
+	default:
+		s = t.Format("2006-01-02T15:04:05.999999")
+	}
+	return textValue{text: s}, nil
+}
+
+var rxUUID = regexp.MustCompile(`^[0-9A-Fa-f]{8}-[0-9A-Fa-f]{4}-[0-9A-Fa-f]{4}-[0-9A-Fa-f]{4}-[0-9A-Fa-f]{12}$`)
+
+func checkUUID(s string) (out any, err error) {
+	if !rxUUID.MatchString(s) {
+		return nil, errors.New("not a valid uuid")
+	}
+	return textValue{text: strings.ToLower(s)}, nil
+}
+
+// checkJSON checks the value of a json type parameter. Values in the query,
+// path or form are JSON text, while those in a JSON body and those computed
+// by the server (like claims) are already decoded.
+func checkJSON(p *Param, v any) (out any, err error) {
+	var b []byte
+	if sa, ok := v.([]string); ok {
+		if len(sa) != 1 {
+			return nil, errors.New("not a single value")
+		}
+		b = []byte(sa[0])
+	} else if s, ok := v.(string); ok && p.In != "body" && p.Source == "" {
+		b = []byte(s)
+	} else if b, err = json.Marshal(v); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, b); err != nil {
+		return nil, errors.New("not valid JSON")
+	}
+	return textValue{text: buf.String(), json: true}, nil
+}
+
+func checkFile(p *Param, v any) (out any, err error) {
+	fv, ok := v.(*fileValue)
+	if !ok {
+		return nil, errors.New("not a file")
+	}
+	if p.Text {
+		if !utf8.Valid(fv.data) {
+			return nil, errors.New("file is not valid UTF-8 text")
+		}
+		return string(fv.data), nil
+	}
+	return fv.data, nil
+}
+
 func (a *APIServer) checkArrayAny(ep *Endpoint, p *Param, v any) (out any, err error) {
 	if sa, ok := v.([]string); ok {
 		aa := make([]any, len(sa))
@@ -377,6 +629,33 @@ func (a *APIServer) checkArray(ep *Endpoint, p *Param, v []any) (out any, err er
 	return nil, fmt.Errorf("invalid elemType %q", p.ElemType)
 }
 
+// newUUID returns a random (version 4) UUID.
+func newUUID() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// headerName returns the name of the header from which a header parameter is
+// read, which is the name of the parameter with underscores replaced by
+// hyphens.
+func headerName(param string) string {
+	return strings.ReplaceAll(param, "_", "-")
+}
+
+// splitHeaderValues splits each of the values of a header at commas, and
+// returns all the resulting elements after trimming whitespace around them.
+func splitHeaderValues(vals []string) (out []string) {
+	for _, v := range vals {
+		for _, e := range strings.Split(v, ",") {
+			out = append(out, strings.TrimSpace(e))
+		}
+	}
+	return
+}
+
 func getCT(req *http.Request) (out string) {
 	out = req.Header.Get("Content-Type")
 	if pos := strings.IndexByte(out, ';'); pos > 0 {
@@ -390,7 +669,149 @@ func getJSON(req *http.Request, data any) error {
 	if err != nil {
 		return err
 	}
-	return json.Unmarshal(b, data)
+	// keep numbers as json.Number, so that decimals are not rounded
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	if err := dec.Decode(data); err != nil {
+		return err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return errors.New("invalid data after top-level value")
+	}
+	return nil
+}
+
+// defaultMaxFileSize is the maximum size of the contents of file type params,
+// if not specified in the param.
+const defaultMaxFileSize = 10 << 20
+
+// maxFormSize is the maximum total size of the values of non-file fields in
+// a multipart/form-data request body.
+const maxFormSize = 10 << 20
+
+// fileValue is the value of a file type param as read from the request.
+type fileValue struct {
+	contentType string
+	data        []byte
+}
+
+// readMultipart reads a multipart/form-data request body. The values of the
+// fields that are not files are returned in form, and the contents of the
+// files that correspond to file type params are returned in files. Other
+// files are discarded. The body as a whole is limited by maxMultipartSize.
+func readMultipart(req *http.Request, ep *Endpoint) (form url.Values,
+	files map[string]*fileValue, err error) {
+
+	// no response writer is available here, but the server will not reuse
+	// the connection anyway if the rest of the body is left unread
+	req.Body = http.MaxBytesReader(nil, req.Body, maxMultipartSize(ep))
+	mr, err := req.MultipartReader()
+	if err != nil {
+		return nil, nil, err
+	}
+	form = make(url.Values)
+	files = make(map[string]*fileValue)
+	formSize := int64(0)
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, nil, err
+		}
+		name := part.FormName()
+		if name == "" {
+			continue
+		}
+		if part.FileName() == "" {
+			// a regular field
+			b, err := io.ReadAll(io.LimitReader(part, maxFormSize-formSize+1))
+			if err != nil {
+				return nil, nil, err
+			}
+			if formSize += int64(len(b)); formSize > maxFormSize {
+				return nil, nil, errors.New("multipart form fields too large")
+			}
+			form.Add(name, string(b))
+			continue
+		}
+		var p *Param
+		for i := range ep.Params {
+			if ep.Params[i].Name == name && ep.Params[i].In == "body" &&
+				ep.Params[i].Type == "file" {
+				p = &ep.Params[i]
+				break
+			}
+		}
+		if p == nil {
+			continue // not interested, NextPart will skip it
+		}
+		if _, ok := files[name]; ok {
+			return nil, nil, fmt.Errorf("param %q: more than one file supplied", name)
+		}
+		ct := part.Header.Get("Content-Type")
+		if ct == "" {
+			ct = "application/octet-stream"
+		}
+		if !contentTypeAllowed(ct, p.ContentTypes) {
+			return nil, nil, fmt.Errorf("param %q: content type %q not allowed", name, ct)
+		}
+		maxSize := int64(defaultMaxFileSize)
+		if p.MaxSize != nil {
+			maxSize = *p.MaxSize
+		}
+		b, err := io.ReadAll(io.LimitReader(part, maxSize+1))
+		if err != nil {
+			return nil, nil, err
+		}
+		if int64(len(b)) > maxSize {
+			return nil, nil, fmt.Errorf("param %q: file exceeds specified max size of %d bytes",
+				name, maxSize)
+		}
+		files[name] = &fileValue{contentType: ct, data: b}
+	}
+	return
+}
+
+// maxMultipartSize returns the maximum size of a multipart/form-data request
+// body for the endpoint, which is the sum of the max sizes of its file type
+// params and maxFormSize. The part headers and boundaries are also counted
+// within this.
+func maxMultipartSize(ep *Endpoint) int64 {
+	n := int64(maxFormSize)
+	for i := range ep.Params {
+		if p := &ep.Params[i]; p.In == "body" && p.Type == "file" {
+			maxSize := int64(defaultMaxFileSize)
+			if p.MaxSize != nil {
+				maxSize = *p.MaxSize
+			}
+			if n += maxSize; n < 0 { // overflow
+				return math.MaxInt64
+			}
+		}
+	}
+	return n
+}
+
+// contentTypeAllowed checks if the media type of the content type ct matches
+// any of the allowed types, which may be of the form "type/*". If allowed is
+// empty, all types are allowed.
+func contentTypeAllowed(ct string, allowed []string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	mt, _, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return false
+	}
+	for _, a := range allowed {
+		a = strings.ToLower(a)
+		if a == mt || a == "*/*" ||
+			(strings.HasSuffix(a, "/*") && strings.HasPrefix(mt, a[:len(a)-1])) {
+			return true
+		}
+	}
+	return false
 }
 
 func (a *APIServer) getParams(req *http.Request, ep *Endpoint,
@@ -400,8 +821,13 @@ func (a *APIServer) getParams(req *http.Request, ep *Endpoint,
 		jsonData map[string]any
 		formData url.Values
 		urlData  url.Values
+		fileData map[string]*fileValue
+		body     any
+		bodyErr  error = errBodyRequired
 	)
-	if req.Method == "GET" {
+	if req.Method == "GET" || ep.ImplType == "ingest" || ep.ImplType == "table" {
+		// the body of ingest and table endpoints is read by serveIngest and
+		// serveTable
 		urlData = req.URL.Query()
 	} else {
 		var wrapped bool
@@ -417,7 +843,10 @@ func (a *APIServer) getParams(req *http.Request, ep *Endpoint,
 			wrapped = true
 			req.Body = flate.NewReader(req.Body)
 		}
-		if ct := getCT(req); ct == "application/json" {
+		if ep.hasBody() {
+			// the whole body is the document validated against the schema
+			body, bodyErr = a.getBody(req, ep)
+		} else if ct := getCT(req); ct == "application/json" {
 			if err := getJSON(req, &jsonData); err != nil {
 				logger.Warn().Err(err).Msg("failed to decode json object in request body")
 				jsonData = nil
@@ -428,6 +857,12 @@ func (a *APIServer) getParams(req *http.Request, ep *Endpoint,
 			} else {
 				formData = req.PostForm
 			}
+		} else if ct == "multipart/form-data" {
+			var err error
+			if formData, fileData, err = readMultipart(req, ep); err != nil {
+				logger.Error().Err(err).Msg("failed to read multipart data in request body")
+				return nil, fmt.Errorf("failed to read multipart data in request body: %v", err)
+			}
 		}
 		if wrapped {
 			if rc, ok := req.Body.(io.Closer); ok {
@@ -439,17 +874,40 @@ func (a *APIServer) getParams(req *http.Request, ep *Endpoint,
 	}
 
 	// discard (the rest of the) body, ignore errors, no need to close req.Body
-	_, _ = io.CopyN(io.Discard, req.Body, 4096)
+	if ep.ImplType != "ingest" && ep.ImplType != "table" {
+		_, _ = io.CopyN(io.Discard, req.Body, 4096)
+	}
 
-	getParam := func(in, key string) (v any, ok bool) {
+	if ep.hasBody() && bodyErr != nil {
+		logger.Error().Err(bodyErr).Msg("invalid request body")
+		return nil, &bodyError{bodyErr}
+	}
+
+	getParam := func(in, key, typ string) (v any, ok bool) {
 		switch in {
 		case "path":
 			v = chi.URLParam(req, key)
 			ok = v != ""
 		case "query":
 			v, ok = urlData[key]
+		case "header":
+			vals := req.Header.Values(headerName(key))
+			if typ == "array" {
+				vals = splitHeaderValues(vals)
+			}
+			v, ok = vals, len(vals) > 0
+		case "cookie":
+			var vals []string
+			for _, c := range req.Cookies() {
+				if c.Name == key {
+					vals = append(vals, c.Value)
+				}
+			}
+			v, ok = vals, len(vals) > 0
 		case "body":
-			if jsonData != nil {
+			if typ == "file" {
+				v, ok = fileData[key]
+			} else if jsonData != nil {
 				v, ok = jsonData[key]
 			} else if formData != nil {
 				v, ok = formData[key]
@@ -458,23 +916,58 @@ func (a *APIServer) getParams(req *http.Request, ep *Endpoint,
 		return
 	}
 
+	// values computed by the server, the claims are fetched only if needed
+	var claims map[string]any
+	claimsDone := false
+	computeParam := func(p *Param) (v any, ok bool) {
+		switch p.Source {
+		case "now":
+			v, ok = time.Now().UTC().Format(time.RFC3339Nano), true
+		case "clientIP":
+			v, ok = strings.Trim(getRealIP(req), "[]"), true
+		case "requestID":
+			if v = req.Header.Get("X-Request-Id"); v == "" {
+				v = newUUID()
+			}
+			ok = true
+		case "claim":
+			if !claimsDone && a.rti != nil && a.rti.Claims != nil {
+				claims = a.rti.Claims(req)
+			}
+			claimsDone = true
+			v, ok = claims[p.Claim]
+			ok = ok && v != nil
+		}
+		return
+	}
+
 	out := make([]any, len(ep.Params))
 	for i := range ep.Params {
 		p := &ep.Params[i]
-		v, ok := getParam(p.In, p.Name)
+		var v any
+		var ok bool
+		if p.Source != "" {
+			v, ok = computeParam(p)
+		} else {
+			v, ok = getParam(p.In, p.Name, p.Type)
+		}
 		if !ok {
 			if p.Required {
 				logger.Error().Str("param", p.Name).Msg("value required but not supplied")
 				return nil, fmt.Errorf("param %q: value required but not supplied", p.Name)
+			} else if pi, ok := a.pinfo.Load(ep.URI + "#" + p.Name); ok && pi != nil {
+				out[i] = (pi.(*paramInfo)).def
+				continue
 			} else {
 				out[i] = nil
 				continue
 			}
 		}
-		// special case: boolean url/form parameters with no value will be considered
-		// as true
+		// special case: boolean url/form/header/cookie parameters with no value
+		// will be considered as true
 		if p.Type == "boolean" &&
-			(p.In == "query" || (p.In == "body" && jsonData == nil && formData != nil)) &&
+			(p.In == "query" || p.In == "header" || p.In == "cookie" ||
+				(p.In == "body" && jsonData == nil && formData != nil)) &&
 			ok {
 			if sa := v.([]string); len(sa) == 1 && len(sa[0]) == 0 {
 				v = true
@@ -488,5 +981,10 @@ func (a *APIServer) getParams(req *http.Request, ep *Endpoint,
 		}
 	}
 
+	// the request body, if any, is after the params
+	if ep.hasBody() {
+		out = append(out, body)
+	}
+
 	return out, nil
 }
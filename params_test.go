@@ -21,8 +21,11 @@ import (
 	"compress/flate"
 	"compress/gzip"
 	"encoding/json"
+	"fmt"
 	"io"
+	"mime/multipart"
 	"net/http"
+	"net/textproto"
 	"net/url"
 	"strings"
 	"testing"
@@ -1180,3 +1183,515 @@ func TestParamsComprDeflate(t *testing.T) {
 	r.Equal([]byte("success"), data)
 	s.Stop(time.Second * 5)
 }
+
+const cfgTestParamsFile = `{
+	"version": "1",
+	"listen": "127.0.0.1:60000",
+	"endpoints": [
+		{
+			"uri": "/",
+			"implType": "javascript",
+			"params": [
+				{ "name": "note", "in": "body", "type": "string" },
+				{ "name": "doc", "in": "body", "type": "file", "required": true, "maxSize": 8 },
+				{ "name": "txt", "in": "body", "type": "file", "text": true, "contentTypes": [ "text/*" ] }
+			],
+			"script": "$sys.result = { note: $sys.params.note, doc: $sys.params.doc, txt: $sys.params.txt }"
+		}
+	]
+}`
+
+func TestParamsFile(t *testing.T) {
+	r := require.New(t)
+
+	cfg := loadCfg(r, cfgTestParamsFile)
+	s := startServer(r, cfg)
+	time.Sleep(500 * time.Millisecond)
+
+	type file struct {
+		field, name, ct, data string
+	}
+	post := func(fields url.Values, files ...file) (map[string]any, int) {
+		var buf bytes.Buffer
+		mw := multipart.NewWriter(&buf)
+		for k, vs := range fields {
+			for _, v := range vs {
+				r.Nil(mw.WriteField(k, v))
+			}
+		}
+		for _, f := range files {
+			h := make(textproto.MIMEHeader)
+			h.Set("Content-Disposition",
+				fmt.Sprintf(`form-data; name="%s"; filename="%s"`, f.field, f.name))
+			if f.ct != "" {
+				h.Set("Content-Type", f.ct)
+			}
+			w, err := mw.CreatePart(h)
+			r.Nil(err)
+			_, err = w.Write([]byte(f.data))
+			r.Nil(err)
+		}
+		r.Nil(mw.Close())
+		resp, err := http.Post("http://127.0.0.1:60000/", mw.FormDataContentType(), &buf)
+		r.Nil(err)
+		defer resp.Body.Close()
+		var out map[string]any
+		if resp.StatusCode == 200 {
+			r.Nil(json.NewDecoder(resp.Body).Decode(&out))
+		}
+		return out, resp.StatusCode
+	}
+
+	// ok
+	out, code := post(url.Values{"note": {"hello"}},
+		file{"doc", "a.bin", "", "\x00\x01\xff"},
+		file{"txt", "a.txt", "text/plain; charset=utf-8", "héllo"},
+		file{"other", "b.bin", "", "ignored"})
+	r.Equal(200, code)
+	r.Equal(map[string]any{
+		"note": "hello",
+		"doc":  []any{float64(0), float64(1), float64(255)},
+		"txt":  "héllo",
+	}, out)
+	out, code = post(nil, file{"doc", "a.bin", "application/pdf", "12345678"})
+	r.Equal(200, code)
+	r.Nil(out["txt"])
+
+	// errors
+	_, code = post(url.Values{"note": {"hello"}})
+	r.Equal(400, code)
+	_, code = post(nil, file{"doc", "a.bin", "", "123456789"})
+	r.Equal(400, code)
+	_, code = post(nil, file{"doc", "a.bin", "", "1"}, file{"doc", "b.bin", "", "2"})
+	r.Equal(400, code)
+	_, code = post(nil, file{"doc", "a.bin", "", "1"}, file{"txt", "a.png", "image/png", "x"})
+	r.Equal(400, code)
+	_, code = post(nil, file{"doc", "a.bin", "", "1"}, file{"txt", "a.txt", "text/plain", "\xff\xfe"})
+	r.Equal(400, code)
+	checkParamError(r, "http://127.0.0.1:60000/", map[string]any{"doc": "not a file"})
+
+	// body larger than the sum of the limits, even if the files are ignored
+	_, code = post(nil, file{"doc", "a.bin", "", "1"},
+		file{"other", "b.bin", "", strings.Repeat("x", 21<<20)})
+	r.Equal(400, code)
+
+	s.Stop(time.Second * 5)
+}
+
+const cfgTestParamsTypes = `{
+	"version": "1",
+	"listen": "127.0.0.1:60000",
+	"endpoints": [
+		{
+			"uri": "/",
+			"implType": "javascript",
+			"params": [
+				{ "name": "d", "in": "body", "type": "date", "earliest": "2000-01-01" },
+				{ "name": "t", "in": "body", "type": "time", "latest": "18:00" },
+				{ "name": "ts", "in": "body", "type": "timestamp", "earliest": "2000-01-01T00:00:00Z", "latest": "2099-12-31T23:59:59Z" },
+				{ "name": "u", "in": "body", "type": "uuid" },
+				{ "name": "j", "in": "body", "type": "json" },
+				{ "name": "n", "in": "body", "type": "decimal", "minimum": 0, "maximum": 1e20 }
+			],
+			"script": "$sys.result = $sys.params"
+		}
+	]
+}`
+
+func TestParamsTypes(t *testing.T) {
+	r := require.New(t)
+
+	cfg := loadCfg(r, cfgTestParamsTypes)
+	s := startServer(r, cfg)
+	time.Sleep(500 * time.Millisecond)
+
+	get := func(data any) map[string]any {
+		body, resp := doAny(r, "http://127.0.0.1:60000/", data)
+		r.Equal(200, resp.StatusCode, "body was %q", string(body))
+		var out map[string]any
+		r.Nil(json.Unmarshal(body, &out))
+		return out
+	}
+
+	// json body
+	out := get(map[string]any{
+		"d":  "2022-02-28",
+		"t":  "09:30:15.25",
+		"ts": "2022-02-28T10:00:00.5+05:30",
+		"u":  "A0EEBC99-9C0B-4EF8-BB6D-6BB9BD380A11",
+		"j":  map[string]any{"a": []any{1, "x", nil}},
+		"n":  json.Number("12345678901234567.8901234567890"),
+	})
+	r.Equal(map[string]any{
+		"d":  "2022-02-28",
+		"t":  "09:30:15.25",
+		"ts": "2022-02-28T04:30:00.5Z",
+		"u":  "a0eebc99-9c0b-4ef8-bb6d-6bb9bd380a11",
+		"j":  map[string]any{"a": []any{float64(1), "x", nil}},
+		"n":  "12345678901234567.8901234567890",
+	}, out)
+
+	// form
+	out = get(url.Values{
+		"t":  {"18:00"},
+		"ts": {"2022-02-28 10:00:00"},
+		"j":  {`[1, 2]`},
+		"n":  {"1e3"},
+	})
+	r.Equal("18:00:00", out["t"])
+	r.Equal("2022-02-28T10:00:00", out["ts"])
+	r.Equal([]any{float64(1), float64(2)}, out["j"])
+	r.Equal("1e3", out["n"])
+	r.Nil(out["d"])
+
+	// errors
+	for _, data := range []map[string]any{
+		{"d": "2022-02-30"},
+		{"d": "1999-12-31"},
+		{"d": 20220228},
+		{"t": "18:00:01"},
+		{"t": "25:00"},
+		{"ts": "2022-02-28"},
+		{"ts": "2100-01-01T00:00:00Z"},
+		{"ts": "2000-01-01T04:00:00+05:00"},
+		{"u": "a0eebc99-9c0b-4ef8-bb6d"},
+		{"n": "1,000"},
+		{"n": -1},
+		{"n": "100000000000000000000.1"},
+	} {
+		checkParamError(r, "http://127.0.0.1:60000/", data)
+	}
+	checkParamError(r, "http://127.0.0.1:60000/", url.Values{"j": {"{"}})
+
+	s.Stop(time.Second * 5)
+}
+
+const cfgTestParamsHeaderCookie = `{
+	"version": "1",
+	"listen": "127.0.0.1:60000",
+	"endpoints": [
+		{
+			"uri": "/",
+			"implType": "javascript",
+			"params": [
+				{ "name": "x_tenant_id", "in": "header", "type": "integer", "required": true },
+				{ "name": "x_client_version", "in": "header", "type": "string", "pattern": "[0-9]+\\.[0-9]+" },
+				{ "name": "x_tags", "in": "header", "type": "array", "elemType": "string", "maxItems": 3 },
+				{ "name": "x_debug", "in": "header", "type": "boolean" },
+				{ "name": "session", "in": "cookie", "type": "string", "enum": [ "abc", "def" ] }
+			],
+			"script": "$sys.result = $sys.params"
+		}
+	]
+}`
+
+func TestParamsHeaderCookie(t *testing.T) {
+	r := require.New(t)
+
+	cfg := loadCfg(r, cfgTestParamsHeaderCookie)
+	s := startServer(r, cfg)
+	time.Sleep(500 * time.Millisecond)
+
+	get := func(h http.Header) (map[string]any, *http.Response) {
+		req, err := http.NewRequest("GET", "http://127.0.0.1:60000/", nil)
+		r.Nil(err)
+		req.Header = h
+		resp, err := http.DefaultClient.Do(req)
+		r.Nil(err)
+		defer resp.Body.Close()
+		var out map[string]any
+		if resp.StatusCode == 200 {
+			r.Nil(json.NewDecoder(resp.Body).Decode(&out))
+		}
+		return out, resp
+	}
+
+	// ok
+	out, resp := get(http.Header{
+		"x-tenant-id":      {"42"},
+		"X-Client-Version": {"1.2"},
+		"X-Tags":           {"a, b", "c"},
+		"X-Debug":          {""},
+		"Cookie":           {"other=1; session=def"},
+	})
+	r.Equal(200, resp.StatusCode)
+	r.Equal(map[string]any{
+		"x_tenant_id":      float64(42),
+		"x_client_version": "1.2",
+		"x_tags":           []any{"a", "b", "c"},
+		"x_debug":          true,
+		"session":          "def",
+	}, out)
+	r.Equal([]string{"X-Tenant-Id", "X-Client-Version", "X-Tags", "X-Debug", "Cookie"},
+		resp.Header.Values("Vary"))
+	out, resp = get(http.Header{"X-Tenant-Id": {"1"}})
+	r.Equal(200, resp.StatusCode)
+	r.Equal(map[string]any{"x_tenant_id": float64(1), "x_client_version": nil,
+		"x_tags": nil, "x_debug": nil, "session": nil}, out)
+
+	// errors
+	for _, h := range []http.Header{
+		{},
+		{"X-Tenant-Id": {"x"}},
+		{"X-Tenant-Id": {"1", "2"}},
+		{"X-Tenant-Id": {"1"}, "X-Client-Version": {"v1"}},
+		{"X-Tenant-Id": {"1"}, "X-Tags": {"a,b", "c,d"}},
+		{"X-Tenant-Id": {"1"}, "Cookie": {"session=xyz"}},
+	} {
+		_, resp := get(h)
+		r.Equal(400, resp.StatusCode, "%v", h)
+	}
+
+	s.Stop(time.Second * 5)
+}
+
+const cfgTestParamsDefault = `{
+	"version": "1",
+	"listen": "127.0.0.1:60000",
+	"endpoints": [
+		{
+			"uri": "/",
+			"implType": "javascript",
+			"params": [
+				{ "name": "limit", "in": "query", "type": "integer", "maximum": 100, "default": 50 },
+				{ "name": "sort", "in": "query", "type": "string", "enum": [ "asc", "desc" ], "default": "asc" },
+				{ "name": "ids", "in": "query", "type": "array", "elemType": "integer", "default": [ 1, 2 ] },
+				{ "name": "since", "in": "query", "type": "date", "default": "2020-01-01" },
+				{ "name": "now", "source": "now", "type": "timestamp" },
+				{ "name": "ip", "source": "clientIP", "type": "string" },
+				{ "name": "reqid", "source": "requestID", "type": "string" },
+				{ "name": "user", "source": "claim", "claim": "sub", "type": "integer", "required": true },
+				{ "name": "roles", "source": "claim", "claim": "roles", "type": "array", "elemType": "string", "default": [ "guest" ] },
+				{ "name": "org", "source": "claim", "claim": "org", "type": "json" }
+			],
+			"script": "$sys.result = $sys.params",
+			"cache": 60
+		}
+	]
+}`
+
+func TestParamsDefault(t *testing.T) {
+	r := require.New(t)
+
+	cfg := loadCfg(r, cfgTestParamsDefault)
+	s := startServerFull(r, cfg, func(rti *rapidrows.RuntimeInterface) {
+		rti.Claims = func(req *http.Request) map[string]any {
+			switch req.Header.Get("Authorization") {
+			case "Bearer alice":
+				return map[string]any{"sub": float64(1), "roles": []any{"admin"}, "org": "acme"}
+			case "Bearer bob":
+				return map[string]any{"sub": "2", "org": map[string]any{"id": float64(7)}}
+			}
+			return nil
+		}
+	})
+	time.Sleep(500 * time.Millisecond)
+
+	get := func(q, auth string, h ...string) (map[string]any, int) {
+		req, err := http.NewRequest("GET", "http://127.0.0.1:60000/?"+q, nil)
+		r.Nil(err)
+		if auth != "" {
+			req.Header.Set("Authorization", "Bearer "+auth)
+		}
+		for i := 0; i+1 < len(h); i += 2 {
+			req.Header.Set(h[i], h[i+1])
+		}
+		resp, err := http.DefaultClient.Do(req)
+		r.Nil(err)
+		defer resp.Body.Close()
+		var out map[string]any
+		if resp.StatusCode == 200 {
+			r.Nil(json.NewDecoder(resp.Body).Decode(&out))
+		}
+		return out, resp.StatusCode
+	}
+
+	// defaults and computed values
+	t0 := time.Now()
+	out, code := get("", "alice")
+	r.Equal(200, code)
+	r.Equal(float64(50), out["limit"])
+	r.Equal("asc", out["sort"])
+	r.Equal([]any{float64(1), float64(2)}, out["ids"])
+	r.Equal("2020-01-01", out["since"])
+	now, err := time.Parse(time.RFC3339, out["now"].(string))
+	r.Nil(err)
+	r.WithinDuration(t0, now, 5*time.Second)
+	r.Equal("127.0.0.1", out["ip"])
+	r.Regexp(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`, out["reqid"])
+	r.Equal(float64(1), out["user"])
+	r.Equal([]any{"admin"}, out["roles"])
+	r.Equal("acme", out["org"]) // claim values are not JSON text
+
+	// not cached, since now and reqid differ for each request
+	out2, code := get("", "alice")
+	r.Equal(200, code)
+	r.NotEqual(out["reqid"], out2["reqid"])
+	req, err := http.NewRequest("GET", "http://127.0.0.1:60000/", nil)
+	r.Nil(err)
+	req.Header.Set("Authorization", "Bearer alice")
+	resp, err := http.DefaultClient.Do(req)
+	r.Nil(err)
+	resp.Body.Close()
+	r.Equal([]string{"Authorization"}, resp.Header.Values("Vary"))
+
+	// supplied values
+	out, code = get("limit=10&sort=desc&ids=3&since=2022-02-02", "bob",
+		"X-Request-Id", "abc", "X-Forwarded-For", "10.1.2.3")
+	r.Equal(200, code)
+	r.Equal(float64(10), out["limit"])
+	r.Equal("desc", out["sort"])
+	r.Equal([]any{float64(3)}, out["ids"])
+	r.Equal("2022-02-02", out["since"])
+	r.Equal("10.1.2.3", out["ip"])
+	r.Equal("abc", out["reqid"])
+	r.Equal(float64(2), out["user"])
+	r.Equal([]any{"guest"}, out["roles"])
+	r.Equal(map[string]any{"id": float64(7)}, out["org"])
+
+	// errors
+	_, code = get("", "")
+	r.Equal(400, code)
+	_, code = get("limit=101", "alice")
+	r.Equal(400, code)
+
+	s.Stop(time.Second * 5)
+}
+
+const cfgTestParamsBodySchema = `{
+	"version": "1",
+	"listen": "127.0.0.1:60000",
+	"endpoints": [
+		{
+			"uri": "/orders/{store}",
+			"implType": "javascript",
+			"params": [
+				{ "name": "store", "in": "path", "type": "integer" }
+			],
+			"bodySchema": {
+				"$schema": "https://json-schema.org/draft/2020-12/schema",
+				"title": "order",
+				"type": "object",
+				"required": [ "customer", "items", "payment" ],
+				"additionalProperties": false,
+				"properties": {
+					"customer": { "type": "integer", "minimum": 1 },
+					"email": { "type": "string", "format": "email" },
+					"deliverOn": { "type": [ "string", "null" ], "format": "date" },
+					"items": {
+						"type": "array",
+						"minItems": 1,
+						"items": {
+							"type": "object",
+							"required": [ "sku", "qty" ],
+							"properties": {
+								"sku": { "type": "string", "pattern": "^[A-Z]{3}-[0-9]+$" },
+								"qty": { "type": "integer", "exclusiveMinimum": 0 },
+								"tags": { "type": "array", "items": { "type": "array", "items": { "type": "string" } } }
+							}
+						}
+					},
+					"payment": {
+						"oneOf": [
+							{
+								"type": "object",
+								"required": [ "method", "card" ],
+								"properties": { "method": { "const": "card" }, "card": { "type": "string", "minLength": 12 } }
+							},
+							{
+								"type": "object",
+								"required": [ "method" ],
+								"properties": { "method": { "enum": [ "invoice", "cash" ] } }
+							}
+						]
+					}
+				}
+			},
+			"script": "$sys.result = { store: $sys.params.store, body: $sys.body }"
+		}
+	]
+}`
+
+func TestParamsBodySchema(t *testing.T) {
+	r := require.New(t)
+
+	cfg := loadCfg(r, cfgTestParamsBodySchema)
+	s := startServer(r, cfg)
+	time.Sleep(500 * time.Millisecond)
+
+	u := "http://127.0.0.1:60000/orders/7"
+	order := func() map[string]any {
+		return map[string]any{
+			"customer":  42,
+			"email":     "jane@example.com",
+			"deliverOn": nil,
+			"items": []any{
+				map[string]any{"sku": "ABC-1", "qty": 2, "tags": []any{[]any{"gift"}, []any{}}},
+				map[string]any{"sku": "XYZ-22", "qty": 1},
+			},
+			"payment": map[string]any{"method": "card", "card": "4111111111111111"},
+		}
+	}
+
+	// valid body is available as $sys.body
+	body, resp := doPostJSON(r, u, order())
+	r.Equal(200, resp.StatusCode, string(body))
+	var out struct {
+		Store int            `json:"store"`
+		Body  map[string]any `json:"body"`
+	}
+	r.Nil(json.Unmarshal(body, &out))
+	r.Equal(7, out.Store)
+	r.Equal(float64(42), out.Body["customer"])
+	r.Len(out.Body["items"], 2)
+	r.Equal(map[string]any{"method": "card", "card": "4111111111111111"}, out.Body["payment"])
+
+	o := order()
+	o["payment"] = map[string]any{"method": "invoice"}
+	o["deliverOn"] = "2022-12-01"
+	body, resp = doPostJSON(r, u, o)
+	r.Equal(200, resp.StatusCode, string(body))
+
+	// invalid bodies, with the reason
+	check := func(f func(o map[string]any), reason string) {
+		o := order()
+		f(o)
+		body, resp := doPostJSON(r, u, o)
+		r.Equal(400, resp.StatusCode)
+		r.Contains(string(body), reason)
+	}
+	check(func(o map[string]any) { delete(o, "customer") }, `property "customer" is required`)
+	check(func(o map[string]any) { o["customer"] = 1.5 }, "/customer: must be of type integer")
+	check(func(o map[string]any) { o["customer"] = 0 }, "/customer: is lower than the minimum of 1")
+	check(func(o map[string]any) { o["note"] = "x" }, `property "note" is not allowed`)
+	check(func(o map[string]any) { o["email"] = "jane" }, "/email: is not a valid email")
+	check(func(o map[string]any) { o["deliverOn"] = "2022-02-30" }, "/deliverOn: is not a valid date")
+	check(func(o map[string]any) { o["items"] = []any{} }, "/items: has fewer than the minimum of 1 items")
+	check(func(o map[string]any) {
+		o["items"].([]any)[1].(map[string]any)["sku"] = "xyz-22"
+	}, "/items/1/sku: does not match pattern")
+	check(func(o map[string]any) {
+		o["items"].([]any)[0].(map[string]any)["qty"] = 0
+	}, "/items/0/qty: must be higher than 0")
+	check(func(o map[string]any) {
+		o["items"].([]any)[0].(map[string]any)["tags"] = []any{[]any{1}}
+	}, "/items/0/tags/0/0: must be of type string")
+	check(func(o map[string]any) { o["payment"] = map[string]any{"method": "cheque"} },
+		"/payment: does not match any of the schemas in oneOf")
+	check(func(o map[string]any) { o["payment"] = map[string]any{"method": "card"} },
+		"/payment: does not match any of the schemas in oneOf")
+
+	// missing body, wrong content type, invalid json
+	body, resp = doGet(r, u)
+	r.Equal(400, resp.StatusCode)
+	r.Contains(string(body), "request body is required")
+	body, resp = doPostForm(r, u, url.Values{"customer": {"42"}})
+	r.Equal(400, resp.StatusCode)
+	r.Contains(string(body), "is not application/json")
+	resp, err := http.Post(u, "application/json", strings.NewReader(`{"customer": 42`))
+	r.Nil(err)
+	resp.Body.Close()
+	r.Equal(400, resp.StatusCode)
+
+	s.Stop(time.Second * 5)
+}
@@ -0,0 +1,661 @@
+/*
+ * Copyright 2022 RapidLoop, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rapidrows
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// schemaDialect is the only allowed value of the $schema keyword.
+const schemaDialect = "https://json-schema.org/draft/2020-12/schema"
+
+// schema is a compiled JSON schema, used to validate the request bodies of
+// endpoints. See Endpoint.BodySchema for the supported keywords.
+type schema struct {
+	never bool // the schema is `false`, nothing is valid
+
+	types []string
+	enum  []any
+	cnst  []any // has one item if const is set, which can be nil
+
+	// numbers
+	minimum, maximum         *big.Rat
+	exclMinimum, exclMaximum *big.Rat
+	multipleOf               *big.Rat
+
+	// strings
+	minLength, maxLength int // -1 if not set
+	pattern              *regexp.Regexp
+	format               string
+
+	// arrays
+	prefixItems        []*schema
+	items              *schema
+	minItems, maxItems int // -1 if not set
+	uniqueItems        bool
+
+	// objects
+	properties                   map[string]*schema
+	required                     []string
+	additional                   *schema
+	minProperties, maxProperties int // -1 if not set
+
+	// combinations
+	allOf, anyOf, oneOf []*schema
+	not                 *schema
+}
+
+// schemaFormats are the supported values of the format keyword, along with
+// the functions that check if a string is of that format.
+var schemaFormats = map[string]func(s string) bool{
+	"date-time": func(s string) bool {
+		_, err := time.Parse(time.RFC3339Nano, s)
+		return err == nil
+	},
+	"date": func(s string) bool {
+		_, err := time.Parse("2006-01-02", s)
+		return err == nil
+	},
+	"time": func(s string) bool {
+		_, err := time.Parse("15:04:05.999999999Z07:00", s)
+		return err == nil
+	},
+	"email": func(s string) bool {
+		a, err := mail.ParseAddress(s)
+		return err == nil && a.Address == s
+	},
+	"uuid": rxUUID.MatchString,
+	"uri": func(s string) bool {
+		u, err := url.Parse(s)
+		return err == nil && u.IsAbs()
+	},
+	"ipv4": func(s string) bool {
+		ip := net.ParseIP(s)
+		return ip != nil && !strings.Contains(s, ":")
+	},
+	"ipv6": func(s string) bool {
+		ip := net.ParseIP(s)
+		return ip != nil && strings.Contains(s, ":")
+	},
+	"hostname": rxHostname.MatchString,
+}
+
+var rxHostname = regexp.MustCompile(`^(?i)[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?(\.[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?)*$`)
+
+// compileSchema compiles a JSON schema given as a value decoded from the
+// configuration. loc is the JSON pointer to the schema, used in errors.
+func compileSchema(v any, loc string) (*schema, error) {
+	s := &schema{minLength: -1, maxLength: -1, minItems: -1, maxItems: -1,
+		minProperties: -1, maxProperties: -1}
+	if b, ok := v.(bool); ok {
+		s.never = !b
+		return s, nil
+	}
+	m, ok := v.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("%s: must be an object or a boolean", pick(loc == "", "/", loc))
+	}
+
+	// go through the keywords in order, so that the same error is reported
+	// each time
+	for _, k := range sortedKeys(m) {
+		val, kloc := m[k], loc+"/"+k
+		var err error
+		switch k {
+		case "$schema":
+			if val != schemaDialect {
+				err = fmt.Errorf("%s: only %s is supported", kloc, schemaDialect)
+			}
+		case "$id", "$comment", "title", "description", "default", "examples",
+			"deprecated", "readOnly", "writeOnly":
+			// annotations, ignored
+		case "type":
+			s.types, err = schemaTypes(val, kloc)
+		case "enum":
+			if a, ok := val.([]any); !ok || len(a) == 0 {
+				err = fmt.Errorf("%s: must be a non-empty array", kloc)
+			} else {
+				s.enum = jsonValue(a).([]any)
+			}
+		case "const":
+			s.cnst = []any{jsonValue(val)}
+		case "minimum":
+			s.minimum, err = schemaNumber(val, kloc)
+		case "maximum":
+			s.maximum, err = schemaNumber(val, kloc)
+		case "exclusiveMinimum":
+			s.exclMinimum, err = schemaNumber(val, kloc)
+		case "exclusiveMaximum":
+			s.exclMaximum, err = schemaNumber(val, kloc)
+		case "multipleOf":
+			if s.multipleOf, err = schemaNumber(val, kloc); err == nil && s.multipleOf.Sign() <= 0 {
+				err = fmt.Errorf("%s: must be greater than 0", kloc)
+			}
+		case "minLength":
+			s.minLength, err = schemaCount(val, kloc)
+		case "maxLength":
+			s.maxLength, err = schemaCount(val, kloc)
+		case "minItems":
+			s.minItems, err = schemaCount(val, kloc)
+		case "maxItems":
+			s.maxItems, err = schemaCount(val, kloc)
+		case "minProperties":
+			s.minProperties, err = schemaCount(val, kloc)
+		case "maxProperties":
+			s.maxProperties, err = schemaCount(val, kloc)
+		case "pattern":
+			if p, ok := val.(string); !ok {
+				err = fmt.Errorf("%s: must be a string", kloc)
+			} else if s.pattern, err = regexp.Compile(p); err != nil {
+				err = fmt.Errorf("%s: %v", kloc, err)
+			}
+		case "format":
+			if f, ok := val.(string); !ok || schemaFormats[f] == nil {
+				err = fmt.Errorf("%s: unsupported format %v", kloc, val)
+			} else {
+				s.format = f
+			}
+		case "uniqueItems":
+			if s.uniqueItems, ok = val.(bool); !ok {
+				err = fmt.Errorf("%s: must be a boolean", kloc)
+			}
+		case "items":
+			s.items, err = compileSchema(val, kloc)
+		case "additionalProperties":
+			s.additional, err = compileSchema(val, kloc)
+		case "not":
+			s.not, err = compileSchema(val, kloc)
+		case "prefixItems":
+			s.prefixItems, err = schemaList(val, kloc)
+		case "allOf":
+			s.allOf, err = schemaList(val, kloc)
+		case "anyOf":
+			s.anyOf, err = schemaList(val, kloc)
+		case "oneOf":
+			s.oneOf, err = schemaList(val, kloc)
+		case "properties":
+			props, ok := val.(map[string]any)
+			if !ok {
+				err = fmt.Errorf("%s: must be an object", kloc)
+				break
+			}
+			s.properties = make(map[string]*schema, len(props))
+			for _, name := range sortedKeys(props) {
+				if s.properties[name], err = compileSchema(props[name], kloc+"/"+pointerEscape(name)); err != nil {
+					break
+				}
+			}
+		case "required":
+			a, ok := val.([]any)
+			if !ok {
+				err = fmt.Errorf("%s: must be an array of strings", kloc)
+				break
+			}
+			for _, name := range a {
+				n, ok := name.(string)
+				if !ok {
+					err = fmt.Errorf("%s: must be an array of strings", kloc)
+					break
+				}
+				s.required = append(s.required, n)
+			}
+		default:
+			err = fmt.Errorf("%s: unsupported keyword", kloc)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// schemaTypes returns the value of the type keyword, which is either a
+// string or an array of strings.
+func schemaTypes(v any, loc string) ([]string, error) {
+	var types []string
+	if t, ok := v.(string); ok {
+		types = []string{t}
+	} else if a, ok := v.([]any); ok && len(a) > 0 {
+		for _, t := range a {
+			if t, ok := t.(string); ok {
+				types = append(types, t)
+			} else {
+				return nil, fmt.Errorf("%s: must be a string or an array of strings", loc)
+			}
+		}
+	} else {
+		return nil, fmt.Errorf("%s: must be a string or an array of strings", loc)
+	}
+	for _, t := range types {
+		switch t {
+		case "null", "boolean", "object", "array", "number", "integer", "string":
+		default:
+			return nil, fmt.Errorf("%s: invalid type %q", loc, t)
+		}
+	}
+	return types, nil
+}
+
+// schemaNumber returns the value of a keyword like minimum, which must be a
+// number.
+func schemaNumber(v any, loc string) (*big.Rat, error) {
+	r, ok := toRat(v)
+	if !ok {
+		return nil, fmt.Errorf("%s: must be a number", loc)
+	}
+	return r, nil
+}
+
+// schemaCount returns the value of a keyword like minLength, which must be a
+// non-negative integer.
+func schemaCount(v any, loc string) (int, error) {
+	r, ok := toRat(v)
+	if !ok || !r.IsInt() || r.Sign() < 0 || !r.Num().IsInt64() || r.Num().Int64() > 1<<31 {
+		return -1, fmt.Errorf("%s: must be a non-negative integer", loc)
+	}
+	return int(r.Num().Int64()), nil
+}
+
+// schemaList returns the value of a keyword like oneOf, which must be a
+// non-empty array of schemas.
+func schemaList(v any, loc string) ([]*schema, error) {
+	a, ok := v.([]any)
+	if !ok || len(a) == 0 {
+		return nil, fmt.Errorf("%s: must be a non-empty array", loc)
+	}
+	list := make([]*schema, len(a))
+	for i := range a {
+		var err error
+		if list[i], err = compileSchema(a[i], loc+"/"+strconv.Itoa(i)); err != nil {
+			return nil, err
+		}
+	}
+	return list, nil
+}
+
+// toRat returns the value of a number, as decoded from a JSON request body
+// (json.Number) or from the configuration (float64 or an integer type).
+func toRat(v any) (*big.Rat, bool) {
+	switch v := v.(type) {
+	case json.Number:
+		// limit the exponent, as Rat.SetString can take a long time for
+		// large ones
+		if i := strings.IndexAny(string(v), "eE"); i >= 0 {
+			if exp, err := strconv.Atoi(string(v[i+1:])); err != nil || exp > 400 || exp < -400 {
+				return nil, false
+			}
+		}
+		return new(big.Rat).SetString(string(v))
+	case float64:
+		if r := new(big.Rat).SetFloat64(v); r != nil {
+			return r, true
+		}
+	case int:
+		return new(big.Rat).SetInt64(int64(v)), true
+	case int64:
+		return new(big.Rat).SetInt64(v), true
+	case uint64:
+		return new(big.Rat).SetFrac(new(big.Int).SetUint64(v), big.NewInt(1)), true
+	}
+	return nil, false
+}
+
+// jsonEqual checks if two JSON values are equal, with numbers being equal if
+// they have the same value.
+func jsonEqual(a, b any) bool {
+	ra, aok := toRat(a)
+	rb, bok := toRat(b)
+	if aok || bok {
+		return aok && bok && ra.Cmp(rb) == 0
+	}
+	switch a := a.(type) {
+	case []any:
+		b, ok := b.([]any)
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if !jsonEqual(a[i], b[i]) {
+				return false
+			}
+		}
+		return true
+	case map[string]any:
+		b, ok := b.(map[string]any)
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for k := range a {
+			if bv, ok := b[k]; !ok || !jsonEqual(a[k], bv) {
+				return false
+			}
+		}
+		return true
+	}
+	return a == b // nil, bool or string
+}
+
+// sortedKeys returns the keys of a map in sorted order.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// pointerEscape escapes a property name for use in a JSON pointer.
+func pointerEscape(s string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(s, "~", "~0"), "/", "~1")
+}
+
+// schemaError returns an error for a value at the given JSON pointer.
+func schemaError(path, f string, args ...any) error {
+	if path == "" {
+		return fmt.Errorf(f, args...)
+	}
+	return fmt.Errorf("%s: %s", path, fmt.Sprintf(f, args...))
+}
+
+// validate checks if a value decoded from a JSON request body is valid as
+// per the schema. path is the JSON pointer to the value, used in errors.
+func (s *schema) validate(v any, path string) error {
+	if s.never {
+		return schemaError(path, "is not allowed")
+	}
+
+	// type, enum, const
+	if len(s.types) > 0 && !s.hasType(v) {
+		return schemaError(path, "must be of type %s", strings.Join(s.types, " or "))
+	}
+	if len(s.enum) > 0 {
+		found := false
+		for _, e := range s.enum {
+			if jsonEqual(v, e) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return schemaError(path, "does not match any of the enumerated values")
+		}
+	}
+	if len(s.cnst) > 0 && !jsonEqual(v, s.cnst[0]) {
+		return schemaError(path, "does not match the constant value")
+	}
+
+	switch v := v.(type) {
+	case json.Number:
+		if err := s.validateNumber(v, path); err != nil {
+			return err
+		}
+	case string:
+		if err := s.validateString(v, path); err != nil {
+			return err
+		}
+	case []any:
+		if err := s.validateArray(v, path); err != nil {
+			return err
+		}
+	case map[string]any:
+		if err := s.validateObject(v, path); err != nil {
+			return err
+		}
+	}
+
+	// combinations
+	for _, sub := range s.allOf {
+		if err := sub.validate(v, path); err != nil {
+			return err
+		}
+	}
+	if len(s.anyOf) > 0 {
+		var err error
+		for _, sub := range s.anyOf {
+			if err = sub.validate(v, path); err == nil {
+				break
+			}
+		}
+		if err != nil {
+			return schemaError(path, "does not match any of the schemas in anyOf")
+		}
+	}
+	if len(s.oneOf) > 0 {
+		n := 0
+		for _, sub := range s.oneOf {
+			if sub.validate(v, path) == nil {
+				n++
+			}
+		}
+		if n == 0 {
+			return schemaError(path, "does not match any of the schemas in oneOf")
+		} else if n > 1 {
+			return schemaError(path, "matches more than one of the schemas in oneOf")
+		}
+	}
+	if s.not != nil && s.not.validate(v, path) == nil {
+		return schemaError(path, "must not match the schema in not")
+	}
+	return nil
+}
+
+func (s *schema) hasType(v any) bool {
+	for _, t := range s.types {
+		switch v := v.(type) {
+		case nil:
+			if t == "null" {
+				return true
+			}
+		case bool:
+			if t == "boolean" {
+				return true
+			}
+		case json.Number:
+			if t == "number" {
+				return true
+			} else if r, ok := toRat(v); ok && t == "integer" && r.IsInt() {
+				return true
+			}
+		case string:
+			if t == "string" {
+				return true
+			}
+		case []any:
+			if t == "array" {
+				return true
+			}
+		case map[string]any:
+			if t == "object" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (s *schema) validateNumber(v json.Number, path string) error {
+	r, ok := toRat(v)
+	if !ok {
+		return schemaError(path, "is not a valid number")
+	}
+	if s.minimum != nil && r.Cmp(s.minimum) < 0 {
+		return schemaError(path, "is lower than the minimum of %s", s.minimum.RatString())
+	}
+	if s.maximum != nil && r.Cmp(s.maximum) > 0 {
+		return schemaError(path, "is higher than the maximum of %s", s.maximum.RatString())
+	}
+	if s.exclMinimum != nil && r.Cmp(s.exclMinimum) <= 0 {
+		return schemaError(path, "must be higher than %s", s.exclMinimum.RatString())
+	}
+	if s.exclMaximum != nil && r.Cmp(s.exclMaximum) >= 0 {
+		return schemaError(path, "must be lower than %s", s.exclMaximum.RatString())
+	}
+	if s.multipleOf != nil && !new(big.Rat).Quo(r, s.multipleOf).IsInt() {
+		return schemaError(path, "is not a multiple of %s", s.multipleOf.RatString())
+	}
+	return nil
+}
+
+func (s *schema) validateString(v string, path string) error {
+	n := utf8.RuneCountInString(v)
+	if s.minLength >= 0 && n < s.minLength {
+		return schemaError(path, "is shorter than the minimum length of %d", s.minLength)
+	}
+	if s.maxLength >= 0 && n > s.maxLength {
+		return schemaError(path, "exceeds the maximum length of %d", s.maxLength)
+	}
+	if s.pattern != nil && !s.pattern.MatchString(v) {
+		return schemaError(path, "does not match pattern %s", s.pattern)
+	}
+	if s.format != "" && !schemaFormats[s.format](v) {
+		return schemaError(path, "is not a valid %s", s.format)
+	}
+	return nil
+}
+
+func (s *schema) validateArray(v []any, path string) error {
+	if s.minItems >= 0 && len(v) < s.minItems {
+		return schemaError(path, "has fewer than the minimum of %d items", s.minItems)
+	}
+	if s.maxItems >= 0 && len(v) > s.maxItems {
+		return schemaError(path, "has more than the maximum of %d items", s.maxItems)
+	}
+	if s.uniqueItems {
+		for i := range v {
+			for j := 0; j < i; j++ {
+				if jsonEqual(v[i], v[j]) {
+					return schemaError(path, "items %d and %d are equal", j, i)
+				}
+			}
+		}
+	}
+	for i := range v {
+		sub := s.items
+		if i < len(s.prefixItems) {
+			sub = s.prefixItems[i]
+		}
+		if sub != nil {
+			if err := sub.validate(v[i], path+"/"+strconv.Itoa(i)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *schema) validateObject(v map[string]any, path string) error {
+	if s.minProperties >= 0 && len(v) < s.minProperties {
+		return schemaError(path, "has fewer than the minimum of %d properties", s.minProperties)
+	}
+	if s.maxProperties >= 0 && len(v) > s.maxProperties {
+		return schemaError(path, "has more than the maximum of %d properties", s.maxProperties)
+	}
+	for _, name := range s.required {
+		if _, ok := v[name]; !ok {
+			return schemaError(path, "property %q is required", name)
+		}
+	}
+	for _, name := range sortedKeys(v) {
+		sub, ok := s.properties[name]
+		if !ok {
+			sub = s.additional
+		}
+		if sub != nil {
+			if err := sub.validate(v[name], path+"/"+pointerEscape(name)); err != nil {
+				if sub.never && !ok {
+					return schemaError(path, "property %q is not allowed", name)
+				}
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// hasBody returns true if the request body of the endpoint is validated
+// against a schema, and passed to the handler after the params.
+func (ep *Endpoint) hasBody() bool {
+	return ep.BodySchema != nil && (hasSQLScript(ep.ImplType) ||
+		ep.ImplType == "batch" || ep.ImplType == "javascript")
+}
+
+// prepareSchemas compiles the body schemas of the endpoints.
+func (a *APIServer) prepareSchemas() {
+	for i := range a.cfg.Endpoints {
+		ep := &a.cfg.Endpoints[i]
+		if !ep.hasBody() {
+			continue
+		}
+		if s, err := compileSchema(ep.BodySchema, ""); err == nil { // cfg is valid
+			a.schemas.Store(ep.URI, s)
+		}
+	}
+}
+
+// bodyError is an error in the request body of an endpoint with a body
+// schema. Unlike other errors in the request, the reason is sent to the
+// client.
+type bodyError struct {
+	err error
+}
+
+func (e *bodyError) Error() string {
+	return e.err.Error()
+}
+
+// errBodyRequired is returned if an endpoint with a body schema is called
+// without a request body.
+var errBodyRequired = errors.New("request body is required")
+
+// getBody reads the JSON request body of an endpoint with a body schema, and
+// returns it as a json text value after validating it against the schema.
+func (a *APIServer) getBody(req *http.Request, ep *Endpoint) (any, error) {
+	if ct := getCT(req); ct != "" && ct != "application/json" {
+		return nil, fmt.Errorf("content type %q is not application/json", ct)
+	}
+	var doc any
+	if err := getJSON(req, &doc); err == io.EOF {
+		return nil, errBodyRequired
+	} else if err != nil {
+		return nil, fmt.Errorf("invalid json: %v", err)
+	}
+	if s, ok := a.schemas.Load(ep.URI); ok && s != nil {
+		if err := s.(*schema).validate(doc, ""); err != nil {
+			return nil, err
+		}
+	}
+	b, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	return textValue{text: string(b), json: true}, nil
+}
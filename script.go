@@ -17,12 +17,15 @@
 package rapidrows
 
 import (
+	"bytes"
 	"context"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
 	"runtime"
+	"strconv"
 	"time"
 
 	"github.com/jackc/pgx/v4/pgxpool"
@@ -207,21 +210,23 @@ func setfnProp(ctx *qjs.Context, obj qjs.Value, name string, f qjs.Function) {
 	obj.SetProperty(name, fv)
 }
 
-// doQuery runs a sql query with args on a pgxpool connection and collects the
-// resultset into a queryResult. If the query failed, the error will be present
-// in queryResult.Error.
-func doQuery(ctx context.Context, conn *pgxpool.Conn, query string, args ...any) (qr queryResult) {
-	rows, err := conn.Query(ctx, query, args...)
+// doQuery runs a sql query with args on a pgxpool connection or transaction
+// and collects the resultset into a queryResult. If the query failed, the
+// error will be present in queryResult.Error.
+func doQuery(ctx context.Context, q querier, query string, args ...any) (qr queryResult) {
+	rows, err := q.Query(ctx, query, args...)
 	if err != nil {
 		qr.Error = err.Error()
 		return
 	}
 	defer rows.Close()
 
+	qr.Columns = fields2cols(rows.FieldDescriptions())
 	qr.Rows = make([][]any, 0)
 	for rows.Next() {
 		vals, err := rows.Values()
 		if err != nil {
+			qr.Columns = nil
 			qr.Rows = nil
 			qr.Error = err.Error()
 			return
@@ -230,6 +235,7 @@ func doQuery(ctx context.Context, conn *pgxpool.Conn, query string, args ...any)
 	}
 	err = rows.Err()
 	if err != nil {
+		qr.Columns = nil
 		qr.Rows = nil
 		qr.Error = err.Error()
 	}
@@ -237,10 +243,10 @@ func doQuery(ctx context.Context, conn *pgxpool.Conn, query string, args ...any)
 	return
 }
 
-// doExec runs a sql query with args on a pgxpool connection. It returns the
-// rows affected or the error in an execResult.
-func doExec(ctx context.Context, conn *pgxpool.Conn, query string, args ...any) (er execResult) {
-	tag, err := conn.Exec(ctx, query, args...)
+// doExec runs a sql query with args on a pgxpool connection or transaction.
+// It returns the rows affected or the error in an execResult.
+func doExec(ctx context.Context, q querier, query string, args ...any) (er execResult) {
+	tag, err := q.Exec(ctx, query, args...)
 	if err != nil {
 		er.Error = err.Error()
 		return
@@ -278,49 +284,191 @@ func parseArgs(f string, args []qjs.Value) (q string, sqlArgs []any, err error)
 func (a *APIServer) runScriptHandler(resp http.ResponseWriter, req *http.Request,
 	ep *Endpoint, params []any, logger zerolog.Logger) {
 
+	// Do debug logs only if debugging is turned on for this endpoint.
+	debug := func() *zerolog.Event {
+		e := logger.Debug()
+		if !ep.Debug {
+			e = e.Discard()
+		}
+		return e
+	}
+
+	// if not caching, simply run the script and write out the response
+	var cacheTTLNanos int64
+	if ep.cachesResults() {
+		cacheTTLNanos = int64(*ep.Cache * float64(time.Second))
+	}
+	if cacheTTLNanos == 0 || !a.canCache() {
+		sr, _ := a.runScriptForResponse(ep, params, logger)
+		sr.write(resp, logger)
+		return
+	}
+
+	// else check the cache first
+	uri := a.cfg.CommonPrefix + ep.URI
+	cacheKey := makeCacheKey(uri, "", a.cacheGen(uri), params, logger)
+	if cacheKey == 0 {
+		// should not happen, error computing cache key
+		logger.Error().Msg("internal error computing cache key, won't cache this one")
+		sr, _ := a.runScriptForResponse(ep, params, logger)
+		sr.write(resp, logger)
+		return
+	}
+	if val, ok := a.rti.CacheGet(cacheKey); ok {
+		if sr, stored, ttl, ok := decodeScriptResponse(val); !ok {
+			logger.Error().Uint64("cachekey", cacheKey).Msg("invalid cache entry, deleting")
+			a.cacheSet(uri, cacheKey, nil)
+		} else if time.Now().UnixNano()-stored <= pick(ttl > 0, ttl, cacheTTLNanos) {
+			debug().Uint64("cachekey", cacheKey).Msg("cache hit, cache still valid, serving from cache")
+			sr.write(resp, logger)
+			return // we're done serving the script from the cache
+		} else {
+			debug().Uint64("cachekey", cacheKey).Msg("cache hit but value is stale, deleting")
+			a.cacheSet(uri, cacheKey, nil)
+		}
+	} else {
+		debug().Uint64("cachekey", cacheKey).Msg("cache miss")
+	}
+
+	// run the script, sharing the response with concurrent requests for the
+	// same cache entry, and store the response in the cache unless the script
+	// failed or asked not to
+	v, _, shared := a.sf.Do(strconv.FormatUint(cacheKey, 16), func() (any, error) {
+		sr, opts := a.runScriptForResponse(ep, params, logger)
+		if opts.nocache {
+			debug().Uint64("cachekey", cacheKey).Msg("script opted out of caching")
+			return sr, nil
+		}
+		if sr.code != http.StatusOK && sr.code != http.StatusNoContent {
+			return sr, nil
+		}
+		// a TTL set by the script is stored with the entry, and can only be
+		// shorter than that of the endpoint, since the cache itself may not
+		// keep the entry for longer than that
+		var ttl int64
+		if opts.ttl > 0 {
+			ttl = int64(opts.ttl * float64(time.Second))
+			if ttl <= 0 || ttl > cacheTTLNanos {
+				ttl = cacheTTLNanos
+			}
+		}
+		a.cacheSet(uri, cacheKey, sr.encode(time.Now().UnixNano(), ttl))
+		return sr, nil
+	})
+	if shared {
+		debug().Uint64("cachekey", cacheKey).Msg("response shared with concurrent requests")
+	}
+	v.(*scriptResponse).write(resp, logger)
+}
+
+// scriptResponse is the HTTP response of a javascript endpoint.
+type scriptResponse struct {
+	code        int
+	contentType string // not set if empty
+	body        []byte
+}
+
+func (sr *scriptResponse) write(resp http.ResponseWriter, logger zerolog.Logger) {
+	if sr.contentType != "" {
+		resp.Header().Set("Content-Type", sr.contentType)
+	}
+	resp.WriteHeader(sr.code)
+	if _, err := resp.Write(sr.body); err != nil {
+		logger.Error().Err(err).Msg("error writing response")
+	}
+}
+
+// encode returns the cache entry for the response. This is the 8-byte
+// timestamp as required for cache entries, followed by the 8-byte TTL in
+// nanoseconds (0 if that of the endpoint applies), the 2-byte status code,
+// the 2-byte length of the content type, the content type and the body.
+func (sr *scriptResponse) encode(stored, ttl int64) []byte {
+	val := make([]byte, 20, 20+len(sr.contentType)+len(sr.body))
+	binary.BigEndian.PutUint64(val[0:8], uint64(stored))
+	binary.BigEndian.PutUint64(val[8:16], uint64(ttl))
+	binary.BigEndian.PutUint16(val[16:18], uint16(sr.code))
+	binary.BigEndian.PutUint16(val[18:20], uint16(len(sr.contentType)))
+	val = append(val, sr.contentType...)
+	return append(val, sr.body...)
+}
+
+// decodeScriptResponse decodes a cache entry created by scriptResponse.encode.
+func decodeScriptResponse(val []byte) (sr *scriptResponse, stored, ttl int64, ok bool) {
+	if len(val) < 20 {
+		return
+	}
+	ctlen := int(binary.BigEndian.Uint16(val[18:20]))
+	if len(val) < 20+ctlen {
+		return
+	}
+	sr = &scriptResponse{
+		code:        int(binary.BigEndian.Uint16(val[16:18])),
+		contentType: string(val[20 : 20+ctlen]),
+		body:        val[20+ctlen:],
+	}
+	stored = int64(binary.BigEndian.Uint64(val[0:8]))
+	ttl = int64(binary.BigEndian.Uint64(val[8:16]))
+	return sr, stored, ttl, true
+}
+
+// runScriptForResponse runs the script of a javascript endpoint and returns
+// the HTTP response to be sent, along with the caching options set by the
+// script.
+func (a *APIServer) runScriptForResponse(ep *Endpoint, params []any,
+	logger zerolog.Logger) (*scriptResponse, scriptCacheOpts) {
+
 	// convert params to a map
 	paramsMap := make(map[string]any, len(ep.Params))
 	for i := range ep.Params {
-		paramsMap[ep.Params[i].Name] = params[i]
+		if b, ok := params[i].([]byte); ok {
+			paramsMap[ep.Params[i].Name] = jsBytes(b)
+		} else {
+			paramsMap[ep.Params[i].Name] = params[i]
+		}
+	}
+
+	// the request body, if any, is after the params
+	var body any
+	if ep.hasBody() {
+		body = params[len(ep.Params)]
 	}
 
 	// actually run the script
-	result, tag, err := a.runScript(ep.Script, paramsMap, logger, ep.Debug)
+	result, tag, opts, err := a.runScript(ep.Script, paramsMap, body, logger, ep.Debug)
 
-	// helper function to write string/object results
-	writeResult := func(code int) bool {
+	// helper function to make responses from string/object results
+	makeResult := func(code int) *scriptResponse {
 		// is it a string?
 		if tag == qjs.TagString {
-			resp.Header().Set("Content-Type", "text/plain; charset=utf8")
-			resp.WriteHeader(code)
-			if _, err := resp.Write([]byte(result.(string))); err != nil {
-				logger.Error().Err(err).Msg("error writing response")
+			return &scriptResponse{
+				code:        code,
+				contentType: "text/plain; charset=utf8",
+				body:        []byte(result.(string)),
 			}
-			return true
 		}
 
 		// else we'll also accept an object, as long as it is not an array
 		if tag == qjs.TagObject {
 			if _, ok := result.([]any); !ok {
-				resp.Header().Set("Content-Type", "application/json")
-				resp.WriteHeader(code)
-				enc := json.NewEncoder(resp)
+				var buf bytes.Buffer
+				enc := json.NewEncoder(&buf)
 				enc.SetIndent("", "  ")
 				if err := enc.Encode(result); err != nil {
 					logger.Error().Err(err).Msg("error encoding result object")
 				}
-				return true
+				return &scriptResponse{
+					code:        code,
+					contentType: "application/json",
+					body:        buf.Bytes(),
+				}
 			}
 		}
 
-		return false
+		return nil
 	}
 
-	write500Body := func(body string) {
-		resp.WriteHeader(500)
-		if _, err := resp.Write([]byte(body)); err != nil {
-			logger.Error().Err(err).Msg("error writing response")
-		}
+	make500Body := func(body string) *scriptResponse {
+		return &scriptResponse{code: 500, body: []byte(body)}
 	}
 
 	// did we get any result at all?
@@ -330,36 +478,61 @@ func (a *APIServer) runScriptHandler(resp http.ResponseWriter, req *http.Request
 	if err != nil {
 		if noResult {
 			logger.Error().Err(err).Msg("script failed")
-			write500Body(err.Error())
-		} else {
-			if writeResult(500) {
-				logger.Error().Err(err).Msg("script failed with result")
-			} else {
-				logger.Error().Msg("script failed, also unsupported result type from script")
-				write500Body("script error")
-			}
+			return make500Body(err.Error()), opts
 		}
-		return
+		if sr := makeResult(500); sr != nil {
+			logger.Error().Err(err).Msg("script failed with result")
+			return sr, opts
+		}
+		logger.Error().Msg("script failed, also unsupported result type from script")
+		return make500Body("script error"), opts
 	}
 
 	// success, but no $sys.result
 	if noResult {
-		resp.WriteHeader(204)
-		return
+		return &scriptResponse{code: 204}, opts
 	}
 
 	// success with $sys.result of supported type
-	if writeResult(200) {
-		return
+	if sr := makeResult(200); sr != nil {
+		return sr, opts
 	}
 
 	// $sys.result is not usable
-	http.Error(resp, "unsupported result type from script", http.StatusInternalServerError)
 	logger.Error().Msg("unsupported result type from script")
+	return &scriptResponse{
+		code:        http.StatusInternalServerError,
+		contentType: "text/plain; charset=utf-8",
+		body:        []byte("unsupported result type from script\n"),
+	}, opts
+}
+
+// jsBytes is a byte slice that is encoded as a JSON array of numbers rather
+// than as a base64 string, so that scripts get the contents of file type
+// params as an array of bytes.
+type jsBytes []byte
+
+func (b jsBytes) MarshalJSON() ([]byte, error) {
+	out := make([]byte, 0, 2+4*len(b))
+	out = append(out, '[')
+	for i, c := range b {
+		if i > 0 {
+			out = append(out, ',')
+		}
+		out = strconv.AppendUint(out, uint64(c), 10)
+	}
+	return append(out, ']'), nil
 }
 
-func (a *APIServer) runScript(script string, paramsMap map[string]any,
-	logger zerolog.Logger, debug bool) (result any, tag int, err error) {
+// scriptCacheOpts are the caching options set by a script using $sys.nocache
+// and $sys.cache.
+type scriptCacheOpts struct {
+	nocache bool
+	ttl     float64 // in seconds, ignored if <= 0
+}
+
+func (a *APIServer) runScript(script string, paramsMap map[string]any, body any,
+	logger zerolog.Logger, debug bool) (result any, tag int, opts scriptCacheOpts, err error) {
 	// make the quickjs code run entirely on the same thread
 	runtime.LockOSThread()
 	defer runtime.UnlockOSThread()
@@ -374,6 +547,11 @@ func (a *APIServer) runScript(script string, paramsMap map[string]any,
 	// set params
 	paramsObj, _ := ctx.ObjectViaJSON(paramsMap)
 	sys.SetProperty("params", paramsObj)
+	// set body, if any
+	if body != nil {
+		bodyObj, _ := ctx.ObjectViaJSON(body)
+		sys.SetProperty("body", bodyObj)
+	}
 	// set acquire
 	setfnProp(ctx, sys, "acquire", sctx.acquire)
 	// set into global
@@ -395,6 +573,18 @@ func (a *APIServer) runScript(script string, paramsMap map[string]any,
 		tag = resultObj.Tag()
 		result = resultObj.Any()
 		resultObj.Free()
+		// also get the caching options, if set
+		nocacheObj := sys.GetProperty("nocache")
+		opts.nocache, _ = nocacheObj.Any().(bool)
+		nocacheObj.Free()
+		cacheObj := sys.GetProperty("cache")
+		switch v := cacheObj.Any().(type) {
+		case int64:
+			opts.ttl = float64(v)
+		case float64:
+			opts.ttl = v
+		}
+		cacheObj.Free()
 	} else {
 		// else return the errObj as "result", also set "err"
 		tag = errObjTag
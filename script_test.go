@@ -17,9 +17,12 @@
 package rapidrows_test
 
 import (
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/rapidloop/rapidrows"
+	"github.com/rapidloop/rapidrows/qjs"
 	"github.com/stretchr/testify/require"
 )
 
@@ -224,3 +227,101 @@ func TestScriptAcquire(t *testing.T) {
 
 	s.Stop(time.Second)
 }
+
+const cfgTestScriptCache = `{
+	"version": "1",
+	"listen": "127.0.0.1:60000",
+	"endpoints": [
+		{
+			"uri": "/count",
+			"implType": "javascript",
+			"script": "$sys.result = { n: counter(), p: $sys.params.p }",
+			"cache": 60,
+			"params": [ { "name": "p", "in": "query", "type": "integer" } ]
+		},
+		{
+			"uri": "/count-text",
+			"implType": "javascript",
+			"script": "$sys.result = '' + counter()",
+			"cache": 60
+		},
+		{
+			"uri": "/count-nocache",
+			"implType": "javascript",
+			"script": "$sys.nocache = true; $sys.result = '' + counter()",
+			"cache": 60
+		},
+		{
+			"uri": "/count-ttl",
+			"implType": "javascript",
+			"script": "$sys.cache = 0.5; $sys.result = '' + counter()",
+			"cache": 60
+		},
+		{
+			"uri": "/count-fail",
+			"implType": "javascript",
+			"script": "counter(); throw 'failed'",
+			"cache": 60
+		}
+	]
+}`
+
+func TestScriptCache(t *testing.T) {
+	r := require.New(t)
+
+	var n atomic.Int64
+	initJSCtx := func(rti *rapidrows.RuntimeInterface) {
+		rti.InitJSCtx = func(ctx *qjs.Context) {
+			g := ctx.Global()
+			g.SetProperty("counter", ctx.NewFunction("counter",
+				func(ctx *qjs.Context, this qjs.Value, args []qjs.Value) qjs.Value {
+					return ctx.Int(int(n.Add(1)))
+				}))
+			g.Free()
+		}
+	}
+	cfg := loadCfg(r, cfgTestScriptCache)
+	s := startServerFull(r, cfg, initJSCtx)
+
+	// cached per param value, along with status and content type
+	body, resp := doGet(r, "http://127.0.0.1:60000/count?p=1")
+	r.Equal(200, resp.StatusCode)
+	r.Equal("application/json", resp.Header.Get("Content-Type"))
+	r.JSONEq(`{"n": 1, "p": 1}`, string(body))
+	body, resp = doGet(r, "http://127.0.0.1:60000/count?p=1")
+	r.Equal(200, resp.StatusCode)
+	r.Equal("application/json", resp.Header.Get("Content-Type"))
+	r.JSONEq(`{"n": 1, "p": 1}`, string(body))
+	body, _ = doGet(r, "http://127.0.0.1:60000/count?p=2")
+	r.JSONEq(`{"n": 2, "p": 2}`, string(body))
+
+	body, resp = doGet(r, "http://127.0.0.1:60000/count-text")
+	r.Equal("3", string(body))
+	r.Equal("text/plain; charset=utf8", resp.Header.Get("Content-Type"))
+	body, _ = doGet(r, "http://127.0.0.1:60000/count-text")
+	r.Equal("3", string(body))
+
+	// opt out of caching
+	body, _ = doGet(r, "http://127.0.0.1:60000/count-nocache")
+	r.Equal("4", string(body))
+	body, _ = doGet(r, "http://127.0.0.1:60000/count-nocache")
+	r.Equal("5", string(body))
+
+	// custom ttl
+	body, _ = doGet(r, "http://127.0.0.1:60000/count-ttl")
+	r.Equal("6", string(body))
+	body, _ = doGet(r, "http://127.0.0.1:60000/count-ttl")
+	r.Equal("6", string(body))
+	time.Sleep(600 * time.Millisecond)
+	body, _ = doGet(r, "http://127.0.0.1:60000/count-ttl")
+	r.Equal("7", string(body))
+
+	// failures are not cached
+	_, resp = doGet(r, "http://127.0.0.1:60000/count-fail")
+	r.Equal(500, resp.StatusCode)
+	_, resp = doGet(r, "http://127.0.0.1:60000/count-fail")
+	r.Equal(500, resp.StatusCode)
+	r.Equal(int64(9), n.Load())
+
+	s.Stop(time.Second)
+}
@@ -20,7 +20,6 @@ import (
 	"bytes"
 	"context"
 	"encoding/binary"
-	"encoding/csv"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -40,6 +39,7 @@ import (
 	"github.com/robfig/cron/v3"
 	"github.com/rs/cors"
 	"github.com/rs/zerolog"
+	"golang.org/x/sync/singleflight"
 )
 
 const (
@@ -57,8 +57,16 @@ type APIServer struct {
 	srv         *http.Server
 	logger      zerolog.Logger
 	ds          *datasources
-	pinfo       sync.Map // parameter information
-	nd          sync.Map // datasource name -> notification dispatcher
+	pinfo       sync.Map           // parameter information
+	nd          sync.Map           // datasource name -> notification dispatcher
+	cachegen    sync.Map           // endpoint uri -> *atomic.Uint64, cache generation
+	purging     sync.Map           // endpoint uri -> true, if pending purge
+	purgewake   chan struct{}      // wakes up the purger
+	purgestop   chan struct{}      // closed to stop the purger
+	purgedone   chan struct{}      // closed when the purger has stopped
+	tables      sync.Map           // endpoint uri -> *tableInfo, for table type endpoints
+	schemas     sync.Map           // endpoint uri -> *schema, for endpoints with a body schema
+	sf          singleflight.Group // coalesces queries to fill the same cache entry
 	c           *cron.Cron
 	bgctx       context.Context
 	bgctxcancel context.CancelFunc
@@ -77,7 +85,7 @@ func NewAPIServer(cfg *APIServerConfig, rti *RuntimeInterface) (*APIServer, erro
 	}
 
 	a := &APIServer{
-		cfg: cfg,
+		cfg: bindConfig(cfg),
 		rti: rti,
 		ds:  new(datasources),
 	}
@@ -104,6 +112,7 @@ func (a *APIServer) Start() (err error) {
 
 	// prepare, cache
 	a.prepareParams()
+	a.prepareSchemas()
 
 	// connect to datasources
 	if err := a.ds.start(a.bgctx, a.cfg.Datasources); err != nil {
@@ -111,7 +120,14 @@ func (a *APIServer) Start() (err error) {
 		return err
 	}
 
-	// setup & start notification dispatchers
+	// read the structure of tables for table type endpoints
+	if err := a.prepareTables(); err != nil {
+		return err // already logged
+	}
+
+	// start purging invalidated cache entries, and the notification
+	// dispatchers that invalidate them
+	a.startPurger()
 	if err := a.startNotifDispatchers(); err != nil {
 		return err // already logged
 	}
@@ -170,6 +186,9 @@ func (a *APIServer) Stop(timeout time.Duration) error {
 	// stop notification dispatchers
 	a.stopNotifDispatchers()
 
+	// purge whatever the dispatchers have invalidated so far
+	a.stopPurger()
+
 	// stop running handlers & http server
 	if err := a.srv.Shutdown(ctx); err != nil {
 		return err
@@ -228,6 +247,11 @@ func (a *APIServer) setupEndpoint(r *chi.Mux, ep *Endpoint) {
 		a.serve(resp, req, ep)
 	}
 
+	if ep.ImplType == "table" {
+		a.setupTable(r, ep, handler)
+		return
+	}
+
 	if len(ep.Methods) == 0 {
 		r.HandleFunc(a.cfg.CommonPrefix+ep.URI, handler)
 	} else {
@@ -278,7 +302,11 @@ func (a *APIServer) serve(resp http.ResponseWriter, req *http.Request,
 	params, err := a.getParams(req, ep, logger)
 	if err != nil {
 		logger.Error().Err(err).Msg("failed to get valid parameter values from client")
-		http.Error(resp, "invalid parameter values", http.StatusBadRequest)
+		if be := new(bodyError); errors.As(err, &be) {
+			http.Error(resp, "invalid request body: "+be.Error(), http.StatusBadRequest)
+		} else {
+			http.Error(resp, "invalid parameter values", http.StatusBadRequest)
+		}
 		return
 	}
 
@@ -293,13 +321,32 @@ func (a *APIServer) serve(resp http.ResponseWriter, req *http.Request,
 	}
 
 	// actually serve
+	for _, v := range varyOf(ep) {
+		resp.Header().Add("Vary", v)
+	}
 	switch ep.ImplType {
 	case "static-text", "static-json":
 		a.serveStatic(resp, req, ep, logger)
-	case "query-json", "query-csv":
-		a.serveQuery(resp, req, ep, params, logger)
+	case "query-json", "query-ndjson", "query-csv", "query-arrow", "query-parquet":
+		a.serveQuery(resp, req, ep, strings.TrimPrefix(ep.ImplType, "query-"), params, logger)
+	case "query":
+		if format := negotiateFormat(req, ep); format != "" {
+			a.serveQuery(resp, req, ep, format, params, logger)
+		} else {
+			formats, _ := formatsOf(ep)
+			http.Error(resp, "not acceptable, available formats are: "+
+				strings.Join(formats, ", "), http.StatusNotAcceptable)
+		}
 	case "exec":
 		a.serveExec(resp, req, ep, params, logger)
+	case "batch":
+		a.serveBatch(resp, req, ep, params, logger)
+	case "ingest":
+		a.serveIngest(resp, req, ep, params, logger)
+	case "export-csv", "export-binary":
+		a.serveExport(resp, req, ep, strings.TrimPrefix(ep.ImplType, "export-"), params, logger)
+	case "table":
+		a.serveTable(resp, req, ep, logger)
 	case "javascript":
 		a.runScriptHandler(resp, req, ep, params, logger)
 	default: // should not happen with valid config
@@ -316,9 +363,10 @@ func (a *APIServer) serve(resp http.ResponseWriter, req *http.Request,
 	}
 }
 
-// serveQuery handles a query-json or query-csv type endpoint.
+// serveQuery handles a query or query-* type endpoint, writing out the
+// results in the given output format.
 func (a *APIServer) serveQuery(resp http.ResponseWriter, req *http.Request,
-	ep *Endpoint, params []any, logger zerolog.Logger) {
+	ep *Endpoint, format string, params []any, logger zerolog.Logger) {
 
 	// Do debug logs only if debugging is turned on for this endpoint. Caller
 	// can also wrap in "if ep.Debug" to avoid compute.
@@ -331,25 +379,46 @@ func (a *APIServer) serveQuery(resp http.ResponseWriter, req *http.Request,
 	}
 
 	// helper function for writing header
-	var contentType string
-	var encoder func(*queryResult, io.Writer) error
-	if ep.ImplType == "query-json" {
-		contentType = "application/json"
-		encoder = qr2json
-	} else {
-		contentType = "text/csv; charset=utf-8"
-		encoder = qr2csv
+	contentType := contentTypeOf(ep, format)
+
+	// compose the query, applying the filters and pagination in the url if
+	// any
+	var page *keysetPage
+	if ep.Paginate != nil {
+		var err error
+		if page, err = a.readPage(ep, req.URL.Query()); err != nil {
+			logger.Error().Err(err).Msg("invalid page")
+			http.Error(resp, err.Error(), http.StatusBadRequest)
+			return
+		}
 	}
+	query, args, err := filterQuery(ep, req.URL.Query(), params, page)
+	if err != nil {
+		logger.Error().Err(err).Msg("invalid filter")
+		http.Error(resp, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// streamed results are written out as the rows are read
+	streamed := ep.Stream && !isSingleRow(ep, format) && page == nil
 
 	// caching support: fetch from cache if configured
-	var cacheTTLNanos uint64
-	if ep.Cache != nil && *ep.Cache > 0 {
+	var cacheTTLNanos, staleNanos uint64
+	if ep.cachesResults() {
 		cacheTTLNanos = uint64(*ep.Cache * float64(time.Second))
+		if ep.StaleWhileRevalidate != nil && *ep.StaleWhileRevalidate > 0 && !streamed {
+			staleNanos = uint64(*ep.StaleWhileRevalidate * float64(time.Second))
+		}
 	}
-	useCache := cacheTTLNanos > 0 && a.rti != nil && a.rti.CacheSet != nil && a.rti.CacheGet != nil
+	uri := a.cfg.CommonPrefix + ep.URI
+	useCache := cacheTTLNanos > 0 && a.canCache()
 	var cacheKey uint64
 	if useCache {
-		cacheKey = makeCacheKey(a.cfg.CommonPrefix+ep.URI, params, logger)
+		keyArgs := args
+		if ep.Filter != nil || ep.Paginate != nil {
+			keyArgs = append(args[:len(args):len(args)], query)
+		}
+		cacheKey = makeCacheKey(uri, format, a.cacheGen(uri), keyArgs, logger)
 		if cacheKey == 0 {
 			// should not happen, error computing cache key
 			logger.Error().Msg("internal error computing cache key, won't cache this one")
@@ -357,20 +426,28 @@ func (a *APIServer) serveQuery(resp http.ResponseWriter, req *http.Request,
 			// continue to the actual query
 		} else if val, ok := a.rti.CacheGet(cacheKey); ok && len(val) >= 8 {
 			// got data from cache, check TTL
-			elapsed := uint64(time.Now().UnixNano()) - binary.BigEndian.Uint64(val[0:8])
+			stored, next, body := splitCached(ep, val)
+			elapsed := uint64(time.Now().UnixNano() - stored)
 			if elapsed <= cacheTTLNanos {
 				debug().Uint64("cachekey", cacheKey).Msg("cache hit, cache still valid, serving from cache")
-				// cached object is valid, write header & body
-				resp.Header().Set("Content-Type", contentType)
-				resp.Header().Set("Content-Length", strconv.Itoa(len(val[8:])))
-				if _, err := resp.Write(val[8:]); err != nil {
-					logger.Error().Err(err).Msg("error writing response")
-				}
+				// cached object is valid, write headers & body
+				setNextLink(resp.Header(), req, next)
+				writeCacheable(resp, req, ep, contentType, body,
+					time.Unix(0, stored), time.Duration(cacheTTLNanos-elapsed))
+				return // we're done serving the query from the cache
+			} else if elapsed <= cacheTTLNanos+staleNanos {
+				// cached results are stale but still usable, serve them and
+				// refresh the cache in the background
+				debug().Uint64("cachekey", cacheKey).Msg("cache hit but value is stale, serving from cache and revalidating")
+				setNextLink(resp.Header(), req, next)
+				writeCacheable(resp, req, ep, contentType, body,
+					time.Unix(0, stored), 0)
+				a.revalidate(ep, format, query, args, page, cacheKey, logger)
 				return // we're done serving the query from the cache
 			} else {
 				// cached results too old, delete from cache
 				debug().Uint64("cachekey", cacheKey).Msg("cache hit but value is stale, deleting")
-				a.rti.CacheSet(cacheKey, nil)
+				a.cacheSet(uri, cacheKey, nil)
 				// continue to the actual query
 			}
 		} else {
@@ -379,68 +456,360 @@ func (a *APIServer) serveQuery(resp http.ResponseWriter, req *http.Request,
 		}
 	}
 
-	// make context
-	ctx := a.bgctx
-	if ep.Timeout != nil && *ep.Timeout > 0 {
-		var cancel context.CancelFunc
-		ctx, cancel = context.WithTimeout(ctx, time.Duration(*ep.Timeout*float64(time.Second)))
+	// if streaming, write out the rows as they are read
+	singleRow := isSingleRow(ep, format)
+	if streamed {
+		ctx, cancel := a.queryContext(ep)
 		defer cancel()
+		a.streamQuery(ctx, resp, ep, format, query, args, contentType, pick(useCache, cacheKey, 0), logger)
+		return
 	}
 
-	// perform query
+	// write header & body directly if the endpoint is not cacheable
+	if cacheTTLNanos == 0 {
+		ctx, cancel := a.queryContext(ep)
+		defer cancel()
+		qr, err := a.runQuery(ctx, ep, query, args, singleRow, logger)
+		if err == nil && page != nil {
+			err = a.nextPage(ep, page, qr)
+		}
+		if err != nil {
+			writeRunQueryError(resp, err, logger)
+			return
+		}
+		setNextLink(resp.Header(), req, qr.Next)
+		resp.Header().Set("Content-Type", contentType)
+		setCacheControl(resp.Header(), ep, 0)
+		if err := encodeResult(newRowEncoder(ep, format, resp), qr); err != nil {
+			logger.Error().Err(err).Msg("error writing response")
+		}
+		return
+	}
+
+	// else get the encoded body, prefixed with the timestamp as required for
+	// the cache entry, and write it out along with the ETag etc. If caching,
+	// concurrent requests for the same cache entry share a single query.
+	var val []byte
+	if useCache {
+		var v any
+		var shared bool
+		v, err, shared = a.sf.Do(strconv.FormatUint(cacheKey, 16), func() (any, error) {
+			return a.fillCache(ep, format, query, args, page, cacheKey, logger)
+		})
+		if shared {
+			debug().Uint64("cachekey", cacheKey).Msg("result shared with concurrent requests")
+		}
+		val, _ = v.([]byte)
+	} else {
+		val, err = a.fillCache(ep, format, query, args, page, 0, logger)
+	}
+	if err != nil {
+		writeRunQueryError(resp, err, logger)
+		return
+	}
+	stored, next, body := splitCached(ep, val)
+	setNextLink(resp.Header(), req, next)
+	writeCacheable(resp, req, ep, contentType, body, time.Unix(0, stored),
+		time.Duration(cacheTTLNanos))
+}
+
+// queryContext returns the context for running the query of an endpoint,
+// with the endpoint's timeout if one is specified.
+func (a *APIServer) queryContext(ep *Endpoint) (context.Context, context.CancelFunc) {
+	if ep.Timeout != nil && *ep.Timeout > 0 {
+		return context.WithTimeout(a.bgctx, time.Duration(*ep.Timeout*float64(time.Second)))
+	}
+	return context.WithCancel(a.bgctx)
+}
+
+// errNoRows is returned by runQuery if an endpoint with a single row result
+// did not get any rows.
+var errNoRows = errors.New("query returned no rows")
+
+// runQuery performs the query of a query type endpoint and collects the
+// resultset. If singleRow is true, only enough rows are collected to check
+// that there is exactly one.
+func (a *APIServer) runQuery(ctx context.Context, ep *Endpoint, query string,
+	args []any, singleRow bool, logger zerolog.Logger) (*queryResult, error) {
+
 	qr := queryResult{Rows: make([][]any, 0)}
 	tq := time.Now()
 	cb := func(q querier) error {
-		rows, err := q.Query(ctx, ep.Script, params...)
+		rows, err := q.Query(ctx, query, args...)
 		if err != nil {
 			return err
 		}
 		defer rows.Close()
+		qr.Columns = fields2cols(rows.FieldDescriptions())
 		for rows.Next() {
 			vals, err := rows.Values()
 			if err != nil {
 				return err
 			}
 			qr.Rows = append(qr.Rows, vals)
+			// for single and scalar, we need only enough rows to check
+			if singleRow && len(qr.Rows) == 2 {
+				break
+			}
 		}
 		return rows.Err()
 	}
 	if err := a.ds.withTx(ep.Datasource, ep.TxOptions, cb); err != nil {
+		return nil, err
+	}
+	if singleRow && len(qr.Rows) == 0 {
+		return nil, errNoRows
+	}
+	if ep.Result == "single" && singleRow && len(qr.Rows) > 1 {
+		return nil, errors.New("query returned more than one row")
+	}
+	if ep.Debug {
+		logger.Debug().Float64("elapsed", float64(time.Since(tq)/1e6)).
+			Msg("query completed successfully")
+	}
+	return &qr, nil
+}
+
+// writeRunQueryError writes out an error returned by runQuery or fillCache.
+func writeRunQueryError(resp http.ResponseWriter, err error, logger zerolog.Logger) {
+	if errors.Is(err, errNoRows) {
+		http.Error(resp, "not found", http.StatusNotFound)
+		return
+	}
+	logger.Error().Err(err).Msg("query failed")
+	writeQueryError(resp, err, logger)
+}
+
+// fillCache performs the query of a query type endpoint, and returns the
+// result encoded in the given format, prefixed with the current timestamp
+// and, for paginated endpoints, the cursor for the next page, as required for
+// a cache entry (see splitCached). If cacheKey is not 0, the value is also stored
+// in the cache. Streamed results are never filled in this way, they are cached
+// by streamQuery instead.
+func (a *APIServer) fillCache(ep *Endpoint, format, query string, args []any,
+	page *keysetPage, cacheKey uint64, logger zerolog.Logger) ([]byte, error) {
+
+	ctx, cancel := a.queryContext(ep)
+	defer cancel()
+	qr, err := a.runQuery(ctx, ep, query, args, isSingleRow(ep, format), logger)
+	if err == nil && page != nil {
+		err = a.nextPage(ep, page, qr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.BigEndian, uint64(time.Now().UnixNano()))
+	if page != nil {
+		buf.WriteString(qr.Next)
+		buf.WriteByte('\n')
+	}
+	if err := encodeResult(newRowEncoder(ep, format, buf), qr); err != nil {
+		logger.Error().Err(err).Msg("error encoding response")
+		return nil, err
+	}
+
+	if cacheKey != 0 {
+		if ep.Debug {
+			logger.Debug().Uint64("cachekey", cacheKey).Int("valuelen", buf.Len()).
+				Msg("storing result in cache")
+		}
+		a.cacheSet(a.cfg.CommonPrefix+ep.URI, cacheKey, buf.Bytes())
+	}
+	return buf.Bytes(), nil
+}
+
+// revalidate refreshes a cache entry in the background, unless the same entry
+// is already being fetched.
+func (a *APIServer) revalidate(ep *Endpoint, format, query string, args []any,
+	page *keysetPage, cacheKey uint64, logger zerolog.Logger) {
+
+	// note: the result channel is buffered, so it is ok to not receive
+	_ = a.sf.DoChan(strconv.FormatUint(cacheKey, 16), func() (any, error) {
+		val, err := a.fillCache(ep, format, query, args, page, cacheKey, logger)
+		if err != nil && !errors.Is(err, errNoRows) {
+			logger.Error().Err(err).Msg("failed to revalidate cached result")
+		}
+		return val, err
+	})
+}
+
+const (
+	// streamFlushRows and streamFlushInterval control how often the output
+	// is flushed to the client when streaming query results.
+	streamFlushRows     = 1000
+	streamFlushInterval = time.Second
+
+	// maxStreamCacheSize is the maximum size of the output of a streamed
+	// query that will be stored in the cache.
+	maxStreamCacheSize = 32 * 1024 * 1024
+
+	// streamErrorTrailer is the HTTP trailer used to report errors that occur
+	// after streaming of the output has started.
+	streamErrorTrailer = "X-Rapidrows-Error"
+)
+
+// streamQuery performs the query for a query type endpoint that has
+// streaming enabled, and writes out each row as it is read. If
+// cacheKey is not 0, the output is also stored in the cache, unless it turns
+// out to be larger than maxStreamCacheSize.
+func (a *APIServer) streamQuery(ctx context.Context, resp http.ResponseWriter,
+	ep *Endpoint, format, query string, args []any, contentType string,
+	cacheKey uint64, logger zerolog.Logger) {
+
+	// Do debug logs only if debugging is turned on for this endpoint. Caller
+	// can also wrap in "if ep.Debug" to avoid compute.
+	debug := func() *zerolog.Event {
+		e := logger.Debug()
+		if !ep.Debug {
+			e = e.Discard()
+		}
+		return e
+	}
+
+	// write body to resp, and also to a size-limited buffer if caching
+	var out io.Writer = resp
+	var tee *cacheTee
+	if cacheKey != 0 {
+		tee = newCacheTee(maxStreamCacheSize)
+		out = io.MultiWriter(resp, tee)
+	}
+	enc := newRowEncoder(ep, format, out)
+	flusher, _ := resp.(http.Flusher)
+
+	// Start the output only when the first row is available, so that errors
+	// that happen before that can still be reported with a status code of 500.
+	var cols []columnInfo
+	started := false
+	start := func() error {
+		started = true
+		resp.Header().Set("Content-Type", contentType)
+		resp.Header().Set("Trailer", streamErrorTrailer)
+		setCacheControl(resp.Header(), ep, 0) // only if explicitly specified
+		return enc.begin(cols)
+	}
+
+	// perform query, write out rows as they come
+	var werr error // error writing to client
+	nrows := 0
+	tq := time.Now()
+	lastFlush := tq
+	cb := func(q querier) error {
+		rows, err := q.Query(ctx, query, args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		cols = fields2cols(rows.FieldDescriptions())
+		for rows.Next() {
+			vals, err := rows.Values()
+			if err != nil {
+				return err
+			}
+			if !started {
+				if werr = start(); werr != nil {
+					return werr
+				}
+			}
+			if werr = enc.row(vals); werr != nil {
+				return werr
+			}
+			nrows++
+			if nrows%streamFlushRows == 0 || time.Since(lastFlush) >= streamFlushInterval {
+				if werr = enc.flush(); werr != nil {
+					return werr
+				}
+				if flusher != nil {
+					flusher.Flush()
+				}
+				lastFlush = time.Now()
+			}
+		}
+		return rows.Err()
+	}
+	err := a.ds.withTx(ep.Datasource, ep.TxOptions, cb)
+	if werr != nil {
+		logger.Error().Err(werr).Msg("error writing response")
+		return
+	}
+	if err != nil && !started {
 		logger.Error().Err(err).Msg("query failed")
-		// send error as a JSON object with response code 500
-		qr.Rows = nil
-		qr.Error = err.Error()
-		resp.Header().Set("Content-Type", "application/json")
-		resp.WriteHeader(http.StatusInternalServerError)
-		if err2 := qr2json(&qr, resp); err2 != nil {
-			logger.Error().Err(err2).Msg("error writing response")
+		writeQueryError(resp, err, logger)
+		return
+	}
+
+	// complete the output, including the error if there was one
+	if !started {
+		if werr = start(); werr != nil {
+			logger.Error().Err(werr).Msg("error writing response")
+			return
 		}
+	}
+	if err != nil {
+		logger.Error().Err(err).Int("rows", nrows).Msg("query failed after output started")
+		msg := strings.NewReplacer("\r", " ", "\n", " ").Replace(err.Error())
+		resp.Header().Set(streamErrorTrailer, msg)
+	}
+	if werr = enc.end(err); werr != nil {
+		logger.Error().Err(werr).Msg("error writing response")
 		return
 	}
-	debug().Float64("elapsed", float64(time.Since(tq)/1e6)).
+	if err != nil {
+		return
+	}
+	debug().Float64("elapsed", float64(time.Since(tq)/1e6)).Int("rows", nrows).
 		Msg("query completed successfully")
 
-	// write header
-	resp.Header().Set("Content-Type", contentType)
+	// if caching, store the result in the cache if it was not too big
+	if tee != nil {
+		if tee.over {
+			debug().Uint64("cachekey", cacheKey).Msg("result too large, not caching")
+		} else {
+			debug().Uint64("cachekey", cacheKey).Int("valuelen", tee.buf.Len()).
+				Msg("storing result in cache")
+			a.cacheSet(a.cfg.CommonPrefix+ep.URI, cacheKey, tee.buf.Bytes())
+		}
+	}
+}
 
-	// write body directly (not caching) or write to resp+bytes.Buffer (if caching)
-	var out io.Writer
-	var cacheValueBuf *bytes.Buffer
-	if useCache {
-		cacheValueBuf = &bytes.Buffer{}
-		binary.Write(cacheValueBuf, binary.BigEndian, uint64(time.Now().UnixNano()))
-		out = io.MultiWriter(resp, cacheValueBuf)
-	} else {
-		out = resp
+// writeQueryError writes out the error from a query as a JSON object, with
+// a response code of 500.
+func writeQueryError(resp http.ResponseWriter, err error, logger zerolog.Logger) {
+	qr := queryResult{Error: err.Error()}
+	resp.Header().Set("Content-Type", "application/json")
+	resp.WriteHeader(http.StatusInternalServerError)
+	if err2 := qr2json(&qr, resp); err2 != nil {
+		logger.Error().Err(err2).Msg("error writing response")
 	}
-	if err := encoder(&qr, out); err != nil {
-		logger.Error().Err(err).Msg("error writing response")
-	} else if useCache && cacheKey > 0 {
-		// if caching, store the result in the cache
-		debug().Uint64("cachekey", cacheKey).Int("valuelen", cacheValueBuf.Len()).
-			Msg("storing result in cache")
-		a.rti.CacheSet(cacheKey, cacheValueBuf.Bytes())
+}
+
+// cacheTee is an io.Writer that collects everything written into it, prefixed
+// with the current timestamp as required for a cache entry. If the total size
+// exceeds the limit, it discards what it has collected so far and everything
+// written after.
+type cacheTee struct {
+	buf   bytes.Buffer
+	limit int
+	over  bool
+}
+
+func newCacheTee(limit int) *cacheTee {
+	t := &cacheTee{limit: limit}
+	binary.Write(&t.buf, binary.BigEndian, uint64(time.Now().UnixNano()))
+	return t
+}
+
+func (t *cacheTee) Write(p []byte) (int, error) {
+	if !t.over {
+		if t.buf.Len()+len(p) > t.limit {
+			t.over = true
+			t.buf = bytes.Buffer{}
+		} else {
+			t.buf.Write(p)
+		}
 	}
+	return len(p), nil
 }
 
 var (
@@ -448,12 +817,14 @@ var (
 	endOfValue   = []byte{3}
 )
 
-// makeCacheKey returns a non-cryptographic 64-bit hash value over the URI
-// and the specific set of arg values for a given endpoint call.
-func makeCacheKey(uri string, args []any, logger zerolog.Logger) uint64 {
+// makeCacheKey returns a non-cryptographic 64-bit hash value over the URI,
+// the output format, the cache generation and the specific set of arg values
+// for a given endpoint call.
+func makeCacheKey(uri, format string, gen uint64, args []any, logger zerolog.Logger) uint64 {
 	// NOTE: the values in 'args' can only be nil, bool, int64, float64, string,
-	// []bool, []int64, []float64 and []string. Out of this, nil, string and []string
-	// have to be handled explicitly, rest can go to binary.Write directly.
+	// textValue, []bool, []int64, []float64, []string and []byte. Out of this,
+	// nil, string, textValue and []string have to be handled explicitly, rest
+	// can go to binary.Write directly.
 	d := xxhash.New()
 
 	// write uri
@@ -461,11 +832,23 @@ func makeCacheKey(uri string, args []any, logger zerolog.Logger) uint64 {
 	d.Write([]byte(uri))
 	d.Write(endOfValue)
 
+	// write output format
+	d.Write(startOfValue)
+	d.WriteString(format)
+	d.Write(endOfValue)
+
+	// write cache generation
+	d.Write(startOfValue)
+	binary.Write(d, binary.BigEndian, gen)
+	d.Write(endOfValue)
+
 	// write args
 	for _, a := range args {
 		d.Write(startOfValue)
 		if s, ok := a.(string); ok {
 			d.WriteString(s)
+		} else if tv, ok := a.(textValue); ok {
+			d.WriteString(tv.text)
 		} else if sa, ok := a.([]string); ok {
 			for _, s := range sa {
 				d.Write(startOfValue)
@@ -495,28 +878,6 @@ func qr2json(qr *queryResult, w io.Writer) error {
 	return enc.Encode(qr)
 }
 
-// qr2csv encodes a queryResult into CSV and writes it to an io.Writer.
-func qr2csv(qr *queryResult, w io.Writer) error {
-	nrows := len(qr.Rows)
-	if nrows == 0 {
-		return nil
-	}
-	ncols := len(qr.Rows[0])
-	strrow := make([]string, ncols)
-
-	enc := csv.NewWriter(w)
-	for _, row := range qr.Rows {
-		for i := range row {
-			strrow[i] = fmt.Sprintf("%v", row[i])
-		}
-		if err := enc.Write(strrow); err != nil {
-			return err
-		}
-	}
-	enc.Flush()
-	return enc.Error()
-}
-
 // serveStatic handles a static text or json endpoint.
 func (a *APIServer) serveStatic(resp http.ResponseWriter, req *http.Request,
 	ep *Endpoint, logger zerolog.Logger) {
@@ -620,7 +981,27 @@ type RuntimeInterface struct {
 	// return whether the value was present or not also.
 	CacheGet func(key uint64) (value []byte, found bool)
 
+	// CacheSetTagged, if set, will be called instead of CacheSet to store or
+	// delete a cache entry. The tag identifies the endpoint that the entry
+	// belongs to (it is the URI of the endpoint, including the common prefix),
+	// and can be used to implement CachePurge.
+	CacheSetTagged func(key uint64, tag string, value []byte)
+
+	// CachePurge, if set, will be called to delete all the cache entries that
+	// were stored with the given tag, when the cached results of an endpoint
+	// are invalidated. Invalidated entries are never served even if this is
+	// not set, this only allows them to be removed sooner. It is called from
+	// a background goroutine, one tag at a time. Purges that are pending when
+	// the server is stopped are completed before Stop returns.
+	CachePurge func(tag string)
+
 	// InitJSCtx is called to perform further optional initialization of the
 	// javascript context.
 	InitJSCtx func(ctx *qjs.Context)
+
+	// Claims, if set, is called to get the claims of the authenticated user
+	// that made a request, like the claims of a verified JWT bearer token.
+	// It should return nil if the request is not authenticated. The claims
+	// are the values of parameters with the source `claim`.
+	Claims func(req *http.Request) map[string]any
 }
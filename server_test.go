@@ -17,13 +17,24 @@
 package rapidrows_test
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
 	"io"
 	"net"
+	"net/http"
 	"net/url"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/apache/arrow/go/v11/arrow/array"
+	"github.com/apache/arrow/go/v11/arrow/ipc"
+	"github.com/apache/arrow/go/v11/arrow/memory"
+	"github.com/apache/arrow/go/v11/parquet/file"
+	"github.com/apache/arrow/go/v11/parquet/pqarrow"
 	"github.com/rapidloop/rapidrows"
 	"github.com/rapidloop/rapidrows/qjs"
 	"github.com/rs/zerolog"
@@ -98,6 +109,143 @@ const cfgTestServerBasic = `{
 			"datasource": "default",
 			"cache": 3600
 		},
+		{
+			"uri": "/movies-objects",
+			"implType": "query-json",
+			"script": "select * from movies order by year desc",
+			"datasource": "default",
+			"rows": "objects"
+		},
+		{
+			"uri": "/movies-columns",
+			"implType": "query-json",
+			"script": "select * from movies where year = 1972",
+			"datasource": "default",
+			"columns": true
+		},
+		{
+			"uri": "/movies-stream",
+			"implType": "query-json",
+			"script": "select * from movies order by year desc",
+			"datasource": "default",
+			"stream": true
+		},
+		{
+			"uri": "/movies-csv-stream",
+			"implType": "query-csv",
+			"script": "select * from movies order by year desc",
+			"datasource": "default",
+			"stream": true,
+			"cache": 3600
+		},
+		{
+			"uri": "/stream-error",
+			"implType": "query-json",
+			"script": "select 1/(3-g) from generate_series(1,5) g",
+			"datasource": "default",
+			"stream": true
+		},
+		{
+			"uri": "/stream-error-early",
+			"implType": "query-json",
+			"script": "syntax error",
+			"datasource": "default",
+			"stream": true
+		},
+		{
+			"uri": "/movies-csv-opts",
+			"implType": "query-csv",
+			"script": "select name, year, null::text as notes from movies where year < 1975 order by year desc",
+			"datasource": "default",
+			"csv": { "header": true, "null": "NULL", "delimiter": "semicolon", "quote": "nonnumeric" }
+		},
+		{
+			"uri": "/movies-tsv",
+			"implType": "query-csv",
+			"script": "select * from movies where year = 1972",
+			"datasource": "default",
+			"csv": { "header": true, "delimiter": "tab", "crlf": true }
+		},
+		{
+			"uri": "/csv-types",
+			"implType": "query-csv",
+			"script": "select 1.50::numeric, '2022-01-02'::date, '\\x01ab'::bytea, '{\"a\": 1}'::jsonb, array[1,2], null",
+			"datasource": "default"
+		},
+		{
+			"uri": "/movies-ndjson",
+			"implType": "query-ndjson",
+			"script": "select * from movies order by year desc",
+			"datasource": "default",
+			"cache": 3600
+		},
+		{
+			"uri": "/movies-ndjson-objects",
+			"implType": "query-ndjson",
+			"script": "select * from movies order by year desc",
+			"datasource": "default",
+			"rows": "objects",
+			"stream": true
+		},
+		{
+			"uri": "/ndjson-error",
+			"implType": "query-ndjson",
+			"script": "select 1/(3-g) from generate_series(1,5) g",
+			"datasource": "default",
+			"stream": true
+		},
+		{
+			"uri": "/movies-arrow",
+			"implType": "query-arrow",
+			"script": "select * from movies order by year desc",
+			"datasource": "default",
+			"cache": 3600
+		},
+		{
+			"uri": "/movies-parquet",
+			"implType": "query-parquet",
+			"script": "select * from movies order by year desc",
+			"datasource": "default",
+			"stream": true
+		},
+		{
+			"uri": "/arrow-types",
+			"implType": "query-arrow",
+			"script": "select 1.50::numeric(5,2), 1.5::numeric, true, '2022-01-02'::date, '2022-01-02 03:04:05+00'::timestamptz, '\\x01ab'::bytea, array[1,2], '{\"a\": 1}'::jsonb, null::int8",
+			"datasource": "default"
+		},
+		{
+			"uri": "/movies-query",
+			"implType": "query",
+			"script": "select * from movies order by year desc",
+			"datasource": "default",
+			"formats": ["json", "ndjson", "csv"],
+			"cache": 3600,
+			"cacheControl": "public, max-age=60"
+		},
+		{
+			"uri": "/movie/{year}",
+			"implType": "query-json",
+			"script": "select * from movies where year = $1",
+			"datasource": "default",
+			"params": [ { "name": "year", "in": "path", "type": "integer" } ],
+			"result": "single"
+		},
+		{
+			"uri": "/movies-any",
+			"implType": "query-json",
+			"script": "select * from movies",
+			"datasource": "default",
+			"result": "single"
+		},
+		{
+			"uri": "/movies-count/{year}",
+			"implType": "query",
+			"script": "select count(*), $1::int from movies where year > $1 having count(*) > 0",
+			"datasource": "default",
+			"params": [ { "name": "year", "in": "path", "type": "integer" } ],
+			"result": "scalar"
+		},
 		{
 			"uri": "/setup",
 			"implType": "exec",
@@ -237,6 +385,92 @@ const expMoviesJson = `{
 }
 `
 
+const expMoviesObjects = `{
+  "rows": [
+    {
+      "name": "The Dark Knight",
+      "year": 2008
+    },
+    {
+      "name": "The Shawshank Redemption",
+      "year": 1994
+    },
+    {
+      "name": "The Godfather Part II",
+      "year": 1974
+    },
+    {
+      "name": "The Godfather",
+      "year": 1972
+    },
+    {
+      "name": "12 Angry Men",
+      "year": 1957
+    }
+  ]
+}
+`
+
+const expMoviesColumns = `{
+  "columns": [
+    {
+      "name": "name",
+      "typeOid": 25,
+      "typeName": "text"
+    },
+    {
+      "name": "year",
+      "typeOid": 23,
+      "typeName": "int4"
+    }
+  ],
+  "rows": [
+    [
+      "The Godfather",
+      1972
+    ]
+  ]
+}
+`
+
+const expMoviesJs = `{
+  "columns": [
+    {
+      "name": "name",
+      "typeName": "text",
+      "typeOid": 25
+    },
+    {
+      "name": "year",
+      "typeName": "int4",
+      "typeOid": 23
+    }
+  ],
+  "rows": [
+    [
+      "The Dark Knight",
+      2008
+    ],
+    [
+      "The Shawshank Redemption",
+      1994
+    ],
+    [
+      "The Godfather Part II",
+      1974
+    ],
+    [
+      "The Godfather",
+      1972
+    ],
+    [
+      "12 Angry Men",
+      1957
+    ]
+  ]
+}
+`
+
 const expMoviesCsv = `The Dark Knight,2008
 The Shawshank Redemption,1994
 The Godfather Part II,1974
@@ -244,6 +478,52 @@ The Godfather,1972
 12 Angry Men,1957
 `
 
+const expMoviesCsvOpts = `"name";"year";"notes"
+"The Godfather Part II";1974;NULL
+"The Godfather";1972;NULL
+"12 Angry Men";1957;NULL
+`
+
+const expMoviesNdjson = `["The Dark Knight",2008]
+["The Shawshank Redemption",1994]
+["The Godfather Part II",1974]
+["The Godfather",1972]
+["12 Angry Men",1957]
+`
+
+const expMoviesNdjsonObjects = `{"name":"The Dark Knight","year":2008}
+{"name":"The Shawshank Redemption","year":1994}
+{"name":"The Godfather Part II","year":1974}
+{"name":"The Godfather","year":1972}
+{"name":"12 Angry Men","year":1957}
+`
+
+const expMoviesArrow = `name: utf8
+year: int32
+name ["The Dark Knight" "The Shawshank Redemption" "The Godfather Part II" "The Godfather" "12 Angry Men"]
+year [2008 1994 1974 1972 1957]
+`
+
+const expArrowTypes = `numeric: decimal(5, 2)
+numeric: utf8
+bool: bool
+date: date32
+timestamptz: timestamp[us, tz=UTC]
+bytea: binary
+array: list<item: int32, nullable>
+jsonb: utf8
+int8: int64
+numeric [{150 0}]
+numeric ["1.5"]
+bool [true]
+date [18994]
+timestamptz [1641092645000000]
+bytea ["\x01\xab"]
+array [[1 2]]
+jsonb ["{\"a\":1}"]
+int8 [(null)]
+`
+
 const expMoviesTx1 = `{
   "rowsAffected": 0
 }
@@ -273,7 +553,7 @@ func checkGetOK(r *require.Assertions, u string) {
 	r.Equal(200, resp.StatusCode)
 }
 
-func startServerFull(r *require.Assertions, cfg *rapidrows.APIServerConfig, dest ...io.Writer) *rapidrows.APIServer {
+func startServerFull(r *require.Assertions, cfg *rapidrows.APIServerConfig, opts ...any) *rapidrows.APIServer {
 	var cache sync.Map
 	cacheSet := func(key uint64, value []byte) {
 		if len(value) == 0 {
@@ -288,12 +568,9 @@ func startServerFull(r *require.Assertions, cfg *rapidrows.APIServerConfig, dest
 		}
 		return nil, false
 	}
-	var logger zerolog.Logger
-	if len(dest) > 0 {
-		logger = zerolog.New(dest[0])
-	} else {
-		logger = zerolog.Nop()
-	}
+	// opts can be an io.Writer for the logs, or a function to further
+	// modify the runtime interface
+	logger := zerolog.Nop()
 	rti := &rapidrows.RuntimeInterface{
 		Logger:       &logger,
 		CacheSet:     cacheSet,
@@ -301,6 +578,14 @@ func startServerFull(r *require.Assertions, cfg *rapidrows.APIServerConfig, dest
 		ReportMetric: func(name string, labels []string, value float64) {},
 		InitJSCtx:    func(ctx *qjs.Context) {},
 	}
+	for _, o := range opts {
+		switch o := o.(type) {
+		case io.Writer:
+			logger = zerolog.New(o)
+		case func(*rapidrows.RuntimeInterface):
+			o(rti)
+		}
+	}
 	s, err := rapidrows.NewAPIServer(cfg, rti)
 	r.NotNil(s, "error was %v", err)
 	r.Nil(err)
@@ -340,7 +625,15 @@ func TestServerBasic(t *testing.T) {
 	r.Equal(200, resp.StatusCode)
 
 	body, resp = doGet(r, "http://127.0.0.1:60000/movies-js")
-	r.Equal(expMoviesJson, string(body))
+	r.Equal(expMoviesJs, string(body))
+	r.Equal(200, resp.StatusCode)
+
+	body, resp = doGet(r, "http://127.0.0.1:60000/movies-objects")
+	r.Equal(expMoviesObjects, string(body))
+	r.Equal(200, resp.StatusCode)
+
+	body, resp = doGet(r, "http://127.0.0.1:60000/movies-columns")
+	r.Equal(expMoviesColumns, string(body))
 	r.Equal(200, resp.StatusCode)
 
 	body, resp = doGet(r, "http://127.0.0.1:60000/movies-tx1")
@@ -378,6 +671,125 @@ func TestServerBasic(t *testing.T) {
 	r.Equal(expMoviesTestCache, string(body))
 	r.Equal(200, resp.StatusCode)
 
+	// csv options and formatting
+	body, resp = doGet(r, "http://127.0.0.1:60000/movies-csv-opts")
+	r.Equal(expMoviesCsvOpts, string(body))
+	r.Equal(200, resp.StatusCode)
+	r.Equal("text/csv; charset=utf-8", resp.Header.Get("Content-Type"))
+
+	body, resp = doGet(r, "http://127.0.0.1:60000/movies-tsv")
+	r.Equal("name\tyear\r\nThe Godfather\t1972\r\n", string(body))
+	r.Equal(200, resp.StatusCode)
+	r.Equal("text/tab-separated-values; charset=utf-8", resp.Header.Get("Content-Type"))
+
+	body, resp = doGet(r, "http://127.0.0.1:60000/csv-types")
+	r.Equal("1.50,2022-01-02,\\x01ab,\"{\"\"a\"\":1}\",\"{1,2}\",\n", string(body))
+	r.Equal(200, resp.StatusCode)
+
+	// ndjson, with cache, and as objects with streaming
+	for i := 0; i < 2; i++ {
+		body, resp = doGet(r, "http://127.0.0.1:60000/movies-ndjson")
+		r.Equal(expMoviesNdjson, string(body))
+		r.Equal(200, resp.StatusCode)
+		r.Equal("application/x-ndjson", resp.Header.Get("Content-Type"))
+	}
+	body, resp = doGet(r, "http://127.0.0.1:60000/movies-ndjson-objects")
+	r.Equal(expMoviesNdjsonObjects, string(body))
+	r.Equal(200, resp.StatusCode)
+	r.Equal("application/x-ndjson", resp.Header.Get("Content-Type"))
+
+	// arrow, with cache, and parquet with streaming
+	for i := 0; i < 2; i++ {
+		body, resp = doGet(r, "http://127.0.0.1:60000/movies-arrow")
+		r.Equal(200, resp.StatusCode)
+		r.Equal("application/vnd.apache.arrow.stream", resp.Header.Get("Content-Type"))
+		r.Equal(expMoviesArrow, readArrow(r, body))
+	}
+	body, resp = doGet(r, "http://127.0.0.1:60000/movies-parquet")
+	r.Equal(200, resp.StatusCode)
+	r.Equal("application/vnd.apache.parquet", resp.Header.Get("Content-Type"))
+	r.Equal(expMoviesArrow, readParquet(r, body))
+	body, resp = doGet(r, "http://127.0.0.1:60000/arrow-types")
+	r.Equal(200, resp.StatusCode)
+	r.Equal(expArrowTypes, readArrow(r, body))
+
+	// content negotiation, with cache
+	for i := 0; i < 2; i++ {
+		body, resp = doGet(r, "http://127.0.0.1:60000/movies-query")
+		r.Equal(expMoviesJson, string(body))
+		r.Equal(200, resp.StatusCode)
+		r.Equal("Accept", resp.Header.Get("Vary"))
+		body, resp = doGetHeader(r, "http://127.0.0.1:60000/movies-query", "Accept", "text/csv")
+		r.Equal(expMoviesCsv, string(body))
+		r.Equal("text/csv; charset=utf-8", resp.Header.Get("Content-Type"))
+		body, resp = doGetHeader(r, "http://127.0.0.1:60000/movies-query", "Accept", "text/*;q=0.4, application/x-ndjson;q=0.5")
+		r.Equal(expMoviesNdjson, string(body))
+		r.Equal("application/x-ndjson", resp.Header.Get("Content-Type"))
+		body, resp = doGetHeader(r, "http://127.0.0.1:60000/movies-query?format=csv", "Accept", "application/json")
+		r.Equal(expMoviesCsv, string(body))
+		r.Equal(200, resp.StatusCode)
+	}
+	_, resp = doGetHeader(r, "http://127.0.0.1:60000/movies-query", "Accept", "application/xml")
+	r.Equal(406, resp.StatusCode)
+	_, resp = doGet(r, "http://127.0.0.1:60000/movies-query?format=parquet")
+	r.Equal(406, resp.StatusCode)
+	_, resp = doGet(r, "http://127.0.0.1:60000/movies-query")
+	r.Equal("public, max-age=60", resp.Header.Get("Cache-Control"))
+
+	// etag, cache-control and conditional requests
+	body, resp = doGet(r, "http://127.0.0.1:60000/movies-ndjson")
+	r.Equal(expMoviesNdjson, string(body))
+	etag := resp.Header.Get("ETag")
+	r.Regexp(`^W/"[0-9a-f]{16}"$`, etag)
+	r.Regexp(`^max-age=(3600|3599)$`, resp.Header.Get("Cache-Control"))
+	r.NotEmpty(resp.Header.Get("Last-Modified"))
+	body, resp = doGetHeader(r, "http://127.0.0.1:60000/movies-ndjson", "If-None-Match", etag)
+	r.Equal(304, resp.StatusCode)
+	r.Empty(body)
+	body, resp = doGetHeader(r, "http://127.0.0.1:60000/movies-ndjson", "If-None-Match", `W/"0000000000000000"`)
+	r.Equal(200, resp.StatusCode)
+	r.Equal(expMoviesNdjson, string(body))
+	r.Equal(etag, resp.Header.Get("ETag"))
+	body, resp = doGetHeader(r, "http://127.0.0.1:60000/movies-ndjson", "Range", "bytes=0-3")
+	r.Equal(200, resp.StatusCode)
+	r.Equal(expMoviesNdjson, string(body))
+	_, resp = doGet(r, "http://127.0.0.1:60000/movies-objects")
+	r.Empty(resp.Header.Get("ETag"))
+	r.Empty(resp.Header.Get("Cache-Control"))
+
+	// single and scalar results
+	body, resp = doGet(r, "http://127.0.0.1:60000/movie/1972")
+	r.Equal("{\n  \"name\": \"The Godfather\",\n  \"year\": 1972\n}\n", string(body))
+	r.Equal(200, resp.StatusCode)
+	_, resp = doGet(r, "http://127.0.0.1:60000/movie/1973")
+	r.Equal(404, resp.StatusCode)
+	body, resp = doGet(r, "http://127.0.0.1:60000/movies-any")
+	r.Equal(`{
+  "rows": null,
+  "error": "query returned more than one row"
+}
+`, string(body))
+	r.Equal(500, resp.StatusCode)
+	body, resp = doGet(r, "http://127.0.0.1:60000/movies-count/1970")
+	r.Equal("4\n", string(body))
+	r.Equal(200, resp.StatusCode)
+	body, resp = doGet(r, "http://127.0.0.1:60000/movies-count/1970?format=csv")
+	r.Equal("4,1970\n", string(body))
+	r.Equal(200, resp.StatusCode)
+	_, resp = doGet(r, "http://127.0.0.1:60000/movies-count/2010")
+	r.Equal(404, resp.StatusCode)
+
+	// streaming, with and without cache
+	body, resp = doGet(r, "http://127.0.0.1:60000/movies-stream")
+	r.Equal(expMoviesJson, string(body))
+	r.Equal(200, resp.StatusCode)
+	r.Equal("", resp.Trailer.Get("X-Rapidrows-Error"))
+	for i := 0; i < 2; i++ {
+		body, resp = doGet(r, "http://127.0.0.1:60000/movies-csv-stream")
+		r.Equal(expMoviesCsv, string(body))
+		r.Equal(200, resp.StatusCode)
+	}
+
 	// query-csv that returns no rows
 	body, resp = doGet(r, "http://127.0.0.1:60000/test-csv-no-rows")
 	r.Equal("", string(body))
@@ -386,6 +798,58 @@ func TestServerBasic(t *testing.T) {
 	s.Stop(time.Second)
 }
 
+func doGetHeader(r *require.Assertions, u, key, value string) (body []byte, resp *http.Response) {
+	req, err := http.NewRequest("GET", u, nil)
+	r.Nil(err)
+	req.Header.Set(key, value)
+	resp, err = http.DefaultClient.Do(req)
+	r.Nil(err)
+	body, err = io.ReadAll(resp.Body)
+	r.Nil(err)
+	resp.Body.Close()
+	return
+}
+
+// readArrow decodes an Arrow IPC stream into a printable form.
+func readArrow(r *require.Assertions, body []byte) string {
+	rdr, err := ipc.NewReader(bytes.NewReader(body))
+	r.Nil(err)
+	defer rdr.Release()
+	var out strings.Builder
+	for _, f := range rdr.Schema().Fields() {
+		fmt.Fprintf(&out, "%s: %s\n", f.Name, f.Type)
+	}
+	for rdr.Next() {
+		rec := rdr.Record()
+		for i, col := range rec.Columns() {
+			fmt.Fprintln(&out, rec.ColumnName(i), col)
+		}
+	}
+	r.Nil(rdr.Err())
+	return out.String()
+}
+
+// readParquet decodes a Parquet file into the same printable form as
+// readArrow.
+func readParquet(r *require.Assertions, body []byte) string {
+	pf, err := file.NewParquetReader(bytes.NewReader(body))
+	r.Nil(err)
+	fr, err := pqarrow.NewFileReader(pf, pqarrow.ArrowReadProperties{}, memory.DefaultAllocator)
+	r.Nil(err)
+	tbl, err := fr.ReadTable(context.Background())
+	r.Nil(err)
+	defer tbl.Release()
+	var buf bytes.Buffer
+	w := ipc.NewWriter(&buf, ipc.WithSchema(tbl.Schema()))
+	tr := array.NewTableReader(tbl, -1)
+	defer tr.Release()
+	for tr.Next() {
+		r.Nil(w.Write(tr.Record()))
+	}
+	r.Nil(w.Close())
+	return readArrow(r, buf.Bytes())
+}
+
 const expExecError = `{"rowsAffected":0,"error":"ERROR: syntax error at or near \"syntax\" (SQLSTATE 42601)"}
 `
 
@@ -395,6 +859,19 @@ const expQueryError = `{
 }
 `
 
+const expStreamError = `{
+  "rows": [
+    [
+      0
+    ],
+    [
+      1
+    ]
+  ],
+  "error": "ERROR: division by zero (SQLSTATE 22012)"
+}
+`
+
 func TestServerErrors(t *testing.T) {
 	r := require.New(t)
 
@@ -413,6 +890,20 @@ func TestServerErrors(t *testing.T) {
 	r.Equal(500, resp.StatusCode)
 	r.Equal("application/json", resp.Header.Get("Content-Type"))
 
+	body, resp = doGet(r, "http://127.0.0.1:60000/stream-error")
+	r.Equal(expStreamError, string(body))
+	r.Equal(200, resp.StatusCode)
+	r.Equal("ERROR: division by zero (SQLSTATE 22012)", resp.Trailer.Get("X-Rapidrows-Error"))
+
+	body, resp = doGet(r, "http://127.0.0.1:60000/ndjson-error")
+	r.Equal("[0]\n[1]\n{\"error\":\"ERROR: division by zero (SQLSTATE 22012)\"}\n", string(body))
+	r.Equal(200, resp.StatusCode)
+	r.Equal("ERROR: division by zero (SQLSTATE 22012)", resp.Trailer.Get("X-Rapidrows-Error"))
+
+	body, resp = doGet(r, "http://127.0.0.1:60000/stream-error-early")
+	r.Equal(expQueryError, string(body))
+	r.Equal(500, resp.StatusCode)
+
 	_, resp = doGet(r, "http://127.0.0.1:60000/script-error-1")
 	r.Equal(500, resp.StatusCode)
 
@@ -428,6 +919,980 @@ func TestServerErrors(t *testing.T) {
 	s.Stop(time.Second)
 }
 
+const cfgTestServerCacheInvalidate = `{
+	"version": "1",
+	"listen": "127.0.0.1:60000",
+	"endpoints": [
+		{
+			"uri": "/setup",
+			"implType": "exec",
+			"script": "drop table if exists movies; create table movies (name text, year integer); insert into movies values ('The Godfather', 1972);",
+			"datasource": "default"
+		},
+		{
+			"uri": "/movies-count",
+			"implType": "query-json",
+			"script": "select count(*) from movies",
+			"datasource": "default",
+			"cache": 3600,
+			"invalidateOn": [ { "datasource": "default", "channel": "moviesinval" } ]
+		},
+		{
+			"uri": "/movies-add",
+			"implType": "exec",
+			"script": "insert into movies values ('The Godfather Part II', 1974)",
+			"datasource": "default"
+		},
+		{
+			"uri": "/movies-notify",
+			"implType": "exec",
+			"script": "notify moviesinval",
+			"datasource": "default"
+		}
+	],
+	"datasources": [
+		{
+			"name": "default",
+			"timeout": 5
+		}
+	]
+}`
+
+func TestServerCacheInvalidate(t *testing.T) {
+	r := require.New(t)
+
+	var purged []string
+	var purgedMtx sync.Mutex
+	cfg := loadCfg(r, cfgTestServerCacheInvalidate)
+	s := startServerFull(r, cfg, func(rti *rapidrows.RuntimeInterface) {
+		rti.CachePurge = func(tag string) {
+			purgedMtx.Lock()
+			purged = append(purged, tag)
+			purgedMtx.Unlock()
+		}
+	})
+
+	checkGetOK(r, "http://127.0.0.1:60000/setup")
+
+	body, resp := doGet(r, "http://127.0.0.1:60000/movies-count")
+	r.Equal(200, resp.StatusCode)
+	r.Equal("{\n  \"rows\": [\n    [\n      1\n    ]\n  ]\n}\n", string(body))
+
+	// change is not visible until invalidation, as the result is cached
+	checkGetOK(r, "http://127.0.0.1:60000/movies-add")
+	body, _ = doGet(r, "http://127.0.0.1:60000/movies-count")
+	r.Equal("{\n  \"rows\": [\n    [\n      1\n    ]\n  ]\n}\n", string(body))
+
+	// notify, and wait for it to be delivered
+	checkGetOK(r, "http://127.0.0.1:60000/movies-notify")
+	time.Sleep(500 * time.Millisecond)
+	body, _ = doGet(r, "http://127.0.0.1:60000/movies-count")
+	r.Equal("{\n  \"rows\": [\n    [\n      2\n    ]\n  ]\n}\n", string(body))
+
+	purgedMtx.Lock()
+	r.Equal([]string{"/movies-count"}, purged)
+	purgedMtx.Unlock()
+
+	s.Stop(time.Second)
+}
+
+const cfgTestServerCacheCoalesce = `{
+	"version": "1",
+	"listen": "127.0.0.1:60000",
+	"endpoints": [
+		{
+			"uri": "/setup",
+			"implType": "exec",
+			"script": "drop sequence if exists cacheseq; create sequence cacheseq",
+			"datasource": "default"
+		},
+		{
+			"uri": "/next-slow",
+			"implType": "query-json",
+			"script": "select nextval('cacheseq') from pg_sleep(0.5)",
+			"datasource": "default",
+			"result": "scalar",
+			"cache": 3600
+		},
+		{
+			"uri": "/next-swr",
+			"implType": "query-json",
+			"script": "select nextval('cacheseq')",
+			"datasource": "default",
+			"result": "scalar",
+			"cache": 1,
+			"staleWhileRevalidate": 60
+		}
+	],
+	"datasources": [
+		{
+			"name": "default",
+			"timeout": 5
+		}
+	]
+}`
+
+func TestServerCacheCoalesce(t *testing.T) {
+	r := require.New(t)
+
+	cfg := loadCfg(r, cfgTestServerCacheCoalesce)
+	s := startServerFull(r, cfg)
+
+	checkGetOK(r, "http://127.0.0.1:60000/setup")
+
+	// concurrent requests for the same entry should all get the result of
+	// the same query
+	var wg sync.WaitGroup
+	bodies := make([]string, 5)
+	for i := range bodies {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if resp, err := http.Get("http://127.0.0.1:60000/next-slow"); err == nil {
+				body, _ := io.ReadAll(resp.Body)
+				resp.Body.Close()
+				bodies[i] = string(body)
+			}
+		}(i)
+	}
+	wg.Wait()
+	for _, b := range bodies {
+		r.Equal("1\n", b)
+	}
+
+	// stale result is served while it is refreshed in the background
+	body, _ := doGet(r, "http://127.0.0.1:60000/next-swr")
+	r.Equal("2\n", string(body))
+	time.Sleep(1100 * time.Millisecond)
+	body, resp := doGet(r, "http://127.0.0.1:60000/next-swr")
+	r.Equal("2\n", string(body))
+	r.Empty(resp.Header.Get("Cache-Control"))
+	time.Sleep(200 * time.Millisecond)
+	body, _ = doGet(r, "http://127.0.0.1:60000/next-swr")
+	r.Equal("3\n", string(body))
+
+	s.Stop(time.Second)
+}
+
+const cfgTestServerBatch = `{
+	"version": "1",
+	"listen": "127.0.0.1:60000",
+	"endpoints": [
+		{
+			"uri": "/setup",
+			"implType": "exec",
+			"script": "drop table if exists orders; create table orders (id integer primary key, qty integer)",
+			"datasource": "default"
+		},
+		{
+			"uri": "/order",
+			"implType": "batch",
+			"datasource": "default",
+			"methods": ["POST"],
+			"params": [
+				{ "name": "id", "in": "body", "type": "integer", "required": true },
+				{ "name": "qty", "in": "body", "type": "integer", "required": true }
+			],
+			"steps": [
+				{ "name": "insert", "mode": "exec", "script": "insert into orders values ($1, $2)", "params": ["id", "qty"] },
+				{ "name": "check", "mode": "exec", "script": "select 1/(100-sum(qty)) from orders" },
+				{ "name": "total", "mode": "query", "script": "select count(*), sum(qty) from orders" }
+			]
+		}
+	],
+	"datasources": [
+		{
+			"name": "default",
+			"timeout": 5
+		}
+	]
+}`
+
+func TestServerBatch(t *testing.T) {
+	r := require.New(t)
+
+	cfg := loadCfg(r, cfgTestServerBatch)
+	s := startServerFull(r, cfg)
+
+	checkGetOK(r, "http://127.0.0.1:60000/setup")
+
+	// results are keyed by step name, in order
+	body, resp := doPostJSON(r, "http://127.0.0.1:60000/order", map[string]any{"id": 1, "qty": 10})
+	r.Equal(200, resp.StatusCode, string(body))
+	r.Regexp(`(?s)^\{\s*"insert".*"check".*"total"`, string(body))
+	var result struct {
+		Insert struct {
+			RowsAffected int64 `json:"rowsAffected"`
+		} `json:"insert"`
+		Total struct {
+			Rows [][]int64 `json:"rows"`
+		} `json:"total"`
+	}
+	r.Nil(json.Unmarshal(body, &result))
+	r.Equal(int64(1), result.Insert.RowsAffected)
+	r.Equal([][]int64{{1, 10}}, result.Total.Rows)
+
+	// failure of a step rolls back the earlier steps
+	body, resp = doPostJSON(r, "http://127.0.0.1:60000/order", map[string]any{"id": 2, "qty": 90})
+	r.Equal(500, resp.StatusCode)
+	var be struct {
+		Step  string `json:"step"`
+		Error string `json:"error"`
+	}
+	r.Nil(json.Unmarshal(body, &be))
+	r.Equal("check", be.Step)
+	r.Contains(be.Error, "division by zero")
+
+	body, resp = doPostJSON(r, "http://127.0.0.1:60000/order", map[string]any{"id": 1, "qty": 5})
+	r.Equal(500, resp.StatusCode)
+	r.Nil(json.Unmarshal(body, &be))
+	r.Equal("insert", be.Step)
+
+	body, resp = doPostJSON(r, "http://127.0.0.1:60000/order", map[string]any{"id": 3, "qty": 5})
+	r.Equal(200, resp.StatusCode, string(body))
+	r.Nil(json.Unmarshal(body, &result))
+	r.Equal([][]int64{{2, 15}}, result.Total.Rows)
+
+	s.Stop(time.Second)
+}
+
+const cfgTestServerIngest = `{
+	"version": "1",
+	"listen": "127.0.0.1:60000",
+	"endpoints": [
+		{
+			"uri": "/setup",
+			"implType": "exec",
+			"script": "drop table if exists items; create table items (id integer primary key, name text, price numeric, tags jsonb)",
+			"datasource": "default"
+		},
+		{
+			"uri": "/items",
+			"implType": "ingest",
+			"datasource": "default",
+			"ingest": {
+				"table": "items"
+			}
+		},
+		{
+			"uri": "/items-mapped",
+			"implType": "ingest",
+			"datasource": "default",
+			"ingest": {
+				"table": "public.items",
+				"format": "csv",
+				"columns": { "ID": "id", "Name": "name" }
+			},
+			"csv": { "delimiter": "semicolon", "null": "NULL" }
+		},
+		{
+			"uri": "/items-merge/{factor}",
+			"implType": "ingest",
+			"datasource": "default",
+			"params": [ { "name": "factor", "in": "path", "type": "integer", "required": true } ],
+			"ingest": {
+				"table": "items",
+				"staging": "items_staging",
+				"merge": "insert into items (id, price) select id, price * $1 from items_staging on conflict (id) do update set price = excluded.price"
+			}
+		},
+		{
+			"uri": "/count",
+			"implType": "query-json",
+			"script": "select count(*), sum(price)::float8 from items",
+			"datasource": "default",
+			"result": "single"
+		}
+	],
+	"datasources": [
+		{
+			"name": "default",
+			"timeout": 5
+		}
+	]
+}`
+
+func TestServerIngest(t *testing.T) {
+	r := require.New(t)
+
+	cfg := loadCfg(r, cfgTestServerIngest)
+	s := startServerFull(r, cfg)
+
+	post := func(u, ct, body string) (map[string]any, int) {
+		resp, err := http.Post("http://127.0.0.1:60000"+u, ct, strings.NewReader(body))
+		r.Nil(err)
+		defer resp.Body.Close()
+		var out map[string]any
+		if resp.Header.Get("Content-Type") == "application/json" {
+			r.Nil(json.NewDecoder(resp.Body).Decode(&out))
+		}
+		return out, resp.StatusCode
+	}
+	count := func() []any {
+		body, resp := doGet(r, "http://127.0.0.1:60000/count")
+		r.Equal(200, resp.StatusCode)
+		var out []any
+		r.Nil(json.Unmarshal(body, &out))
+		return out
+	}
+
+	checkGetOK(r, "http://127.0.0.1:60000/setup")
+
+	// csv, ndjson and json array
+	out, code := post("/items", "text/csv", "id,name,price,tags\n1,\"a\tb\",1.5,\n2,\"multi\nline\",2,\"[\"\"x\"\"]\"\n")
+	r.Equal(200, code, out)
+	r.Equal(float64(2), out["rowsCopied"])
+	out, code = post("/items", "application/x-ndjson", `{"id": 3, "name": "c", "price": 3}`+"\n\n"+`{"id": 4, "tags": {"k": [1, 2]}}`)
+	r.Equal(200, code, out)
+	r.Equal(float64(2), out["rowsCopied"])
+	out, code = post("/items", "application/json", `[{"id": 5, "price": 4}, {"id": 6, "price": null}]`)
+	r.Equal(200, code, out)
+	r.Equal(float64(2), out["rowsCopied"])
+	r.Equal([]any{float64(6), float64(10.5)}, count())
+
+	// mapped columns
+	out, code = post("/items-mapped", "application/octet-stream", "ID;Name;Other\n7;x;y\n8;NULL;z\n")
+	r.Equal(200, code, out)
+	r.Equal(float64(2), out["rowsCopied"])
+
+	// errors have line numbers, and nothing is loaded
+	out, code = post("/items", "text/csv", "id,price\n9,1\n10,1\n11,notanumber\n")
+	r.Equal(400, code)
+	r.Equal(float64(4), out["line"])
+	r.Contains(out["error"], "invalid input syntax")
+	out, code = post("/items", "application/json", "[\n{\"id\": 12},\n{\"id\": 1}\n]")
+	r.Equal(400, code)
+	r.Equal(float64(3), out["line"])
+	out, code = post("/items", "application/x-ndjson", "{\"id\": 13}\n{\"id\": 14, \"nosuch\": 1}\n")
+	r.Equal(400, code)
+	r.Equal(float64(2), out["line"])
+	out, code = post("/items", "text/plain", "id\n15\n")
+	r.Equal(415, code)
+	r.Contains(out["error"], "content type must be")
+	r.Equal([]any{float64(8), float64(10.5)}, count())
+
+	// staging and merge
+	out, code = post("/items-merge/10", "text/csv", "id,price\n1,2\n20,3\n")
+	r.Equal(200, code, out)
+	r.Equal(float64(2), out["rowsCopied"])
+	r.Equal(float64(2), out["rowsAffected"])
+	r.Equal([]any{float64(9), float64(59)}, count())
+
+	s.Stop(time.Second)
+}
+
+const cfgTestServerExport = `{
+	"version": "1",
+	"listen": "127.0.0.1:60000",
+	"endpoints": [
+		{
+			"uri": "/setup",
+			"implType": "exec",
+			"script": "drop table if exists movies; create table movies (name text, year integer); insert into movies values ('The Godfather', 1972), ('The Dark Knight', 2008), ('12 Angry Men', 1957), ('It''s a Wonderful Life', 1946), (null, 2000);",
+			"datasource": "default"
+		},
+		{
+			"uri": "/export",
+			"implType": "export-csv",
+			"script": "select name, year, '$1' as \"$2\" from movies where year > $1 and (name is null or name <> $2) -- $3\n order by year;",
+			"datasource": "default",
+			"params": [
+				{ "name": "year", "in": "query", "type": "integer", "required": true },
+				{ "name": "skip", "in": "query", "type": "string" }
+			],
+			"csv": { "header": true, "delimiter": "semicolon", "null": "-" },
+			"tx": { "access": "read only" }
+		},
+		{
+			"uri": "/export-binary",
+			"implType": "export-binary",
+			"script": "select year from movies where name = any($1) order by year",
+			"datasource": "default",
+			"params": [
+				{ "name": "names", "in": "query", "type": "array", "elemType": "string" }
+			]
+		},
+		{
+			"uri": "/export-error",
+			"implType": "export-csv",
+			"script": "select 1/(2000-year) from movies order by year",
+			"datasource": "default"
+		}
+	],
+	"datasources": [
+		{
+			"name": "default",
+			"timeout": 5
+		}
+	]
+}`
+
+func TestServerExport(t *testing.T) {
+	r := require.New(t)
+
+	cfg := loadCfg(r, cfgTestServerExport)
+	s := startServerFull(r, cfg)
+
+	checkGetOK(r, "http://127.0.0.1:60000/setup")
+
+	// csv with params
+	body, resp := doGet(r, "http://127.0.0.1:60000/export?year=1950&skip=The%20Godfather")
+	r.Equal(200, resp.StatusCode)
+	r.Equal("text/csv; charset=utf-8", resp.Header.Get("Content-Type"))
+	r.Equal("name;year;$2\n12 Angry Men;1957;$1\n-;2000;$1\nThe Dark Knight;2008;$1\n", string(body))
+	body, _ = doGet(r, "http://127.0.0.1:60000/export?year=1900&skip=x")
+	r.Contains(string(body), "It's a Wonderful Life;1946;$1\n")
+
+	// binary
+	body, resp = doGet(r, "http://127.0.0.1:60000/export-binary?names=The%20Godfather&names=12%20Angry%20Men")
+	r.Equal(200, resp.StatusCode)
+	r.Equal("application/octet-stream", resp.Header.Get("Content-Type"))
+	r.True(bytes.HasPrefix(body, []byte("PGCOPY\n\xff\r\n\x00")))
+
+	// errors before any output
+	_, resp = doGet(r, "http://127.0.0.1:60000/export")
+	r.Equal(400, resp.StatusCode)
+	body, resp = doGet(r, "http://127.0.0.1:60000/export-error")
+	r.Equal(500, resp.StatusCode)
+	r.Contains(string(body), "division by zero")
+
+	s.Stop(time.Second)
+}
+
+const cfgTestServerTable = `{
+	"version": "1",
+	"listen": "127.0.0.1:60000",
+	"endpoints": [
+		{
+			"uri": "/setup",
+			"implType": "exec",
+			"script": "drop table if exists books; create table books (id serial primary key, title text not null, year int2, tags text[], meta jsonb, price numeric, isbn text unique, slug text generated always as (lower(title)) stored); drop table if exists film_actor; create table film_actor (film_id int, actor_id int, note text, primary key (film_id, actor_id)); drop table if exists logs; create table logs (msg text default 'none')",
+			"datasource": "default"
+		},
+		{
+			"uri": "/books",
+			"implType": "table",
+			"datasource": "default",
+			"table": "public.books"
+		},
+		{
+			"uri": "/film-actors",
+			"implType": "table",
+			"datasource": "default",
+			"table": "film_actor",
+			"methods": [ "GET", "POST", "DELETE" ]
+		},
+		{
+			"uri": "/logs",
+			"implType": "table",
+			"datasource": "default",
+			"table": "logs"
+		}
+	],
+	"datasources": [
+		{
+			"name": "default",
+			"timeout": 5
+		}
+	]
+}`
+
+func TestServerTable(t *testing.T) {
+	r := require.New(t)
+
+	// setup the tables before starting the server, which reads their structure
+	cfg := loadCfg(r, cfgTestServerTable)
+	setup := *cfg
+	setup.Endpoints = cfg.Endpoints[:1]
+	s := startServerFull(r, &setup)
+	checkGetOK(r, "http://127.0.0.1:60000/setup")
+	s.Stop(time.Second)
+	s = startServerFull(r, cfg)
+
+	do := func(method, u, body string) (any, *http.Response) {
+		req, err := http.NewRequest(method, "http://127.0.0.1:60000"+u, strings.NewReader(body))
+		r.Nil(err)
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		r.Nil(err)
+		defer resp.Body.Close()
+		var out any
+		if resp.Header.Get("Content-Type") == "application/json" {
+			r.Nil(json.NewDecoder(resp.Body).Decode(&out))
+		}
+		return out, resp
+	}
+
+	// create
+	out, resp := do("POST", "/books", `{"title": "Dune", "year": 1965, "tags": ["sf", "classic"], "meta": {"pages": 412}, "price": 9.99, "isbn": "a"}`)
+	r.Equal(201, resp.StatusCode, out)
+	r.Equal("/books/1", resp.Header.Get("Location"))
+	r.Equal(map[string]any{"id": float64(1), "title": "Dune", "year": float64(1965),
+		"tags": []any{"sf", "classic"}, "meta": map[string]any{"pages": float64(412)},
+		"price": 9.99, "isbn": "a", "slug": "dune"}, out)
+	_, resp = do("POST", "/books", `{"title": "Emma", "year": 1815}`)
+	r.Equal(201, resp.StatusCode)
+
+	// list & get
+	out, resp = do("GET", "/books", "")
+	r.Equal(200, resp.StatusCode)
+	r.Len(out, 2)
+	r.Equal("Emma", out.([]any)[1].(map[string]any)["title"])
+	out, resp = do("GET", "/books?limit=1&offset=1", "")
+	r.Equal(200, resp.StatusCode)
+	r.Len(out, 1)
+	r.Equal("Emma", out.([]any)[0].(map[string]any)["title"])
+	_, resp = do("GET", "/books?limit=1001", "")
+	r.Equal(400, resp.StatusCode)
+	_, resp = do("GET", "/books?offset=x", "")
+	r.Equal(400, resp.StatusCode)
+	out, resp = do("GET", "/books/2", "")
+	r.Equal(200, resp.StatusCode)
+	r.Equal("emma", out.(map[string]any)["slug"])
+	_, resp = do("GET", "/books/3", "")
+	r.Equal(404, resp.StatusCode)
+	_, resp = do("GET", "/books/x", "")
+	r.Equal(400, resp.StatusCode)
+
+	// update
+	out, resp = do("PATCH", "/books/1", `{"price": 12}`)
+	r.Equal(200, resp.StatusCode)
+	r.Equal(float64(12), out.(map[string]any)["price"])
+	r.Equal("Dune", out.(map[string]any)["title"])
+	out, resp = do("PUT", "/books/1", `{"title": "Dune Messiah"}`)
+	r.Equal(200, resp.StatusCode)
+	r.Nil(out.(map[string]any)["price"])
+	r.Equal("dune messiah", out.(map[string]any)["slug"])
+	_, resp = do("PATCH", "/books/3", `{"price": 12}`)
+	r.Equal(404, resp.StatusCode)
+
+	// invalid values
+	for _, body := range []string{`{"year": 100000}`, `{"year": "x"}`, `{"nosuch": 1}`,
+		`{"slug": "x"}`, `[1]`, `{}`, `{"tags": [1]}`} {
+		_, resp = do("PATCH", "/books/1", body)
+		r.Equal(400, resp.StatusCode, body)
+	}
+	_, resp = do("POST", "/books", `{"year": 2000}`)
+	r.Equal(400, resp.StatusCode)
+	_, resp = do("POST", "/books", `{"title": "`+strings.Repeat("x", 2<<20)+`"}`)
+	r.Equal(413, resp.StatusCode)
+	_, resp = do("POST", "/books", `{"title": "x", "isbn": "a"}`)
+	r.Equal(409, resp.StatusCode)
+
+	// delete
+	_, resp = do("DELETE", "/books/2", "")
+	r.Equal(204, resp.StatusCode)
+	_, resp = do("DELETE", "/books/2", "")
+	r.Equal(404, resp.StatusCode)
+
+	// composite key and methods
+	_, resp = do("POST", "/film-actors", `{"film_id": 1, "actor_id": 2}`)
+	r.Equal(201, resp.StatusCode)
+	r.Equal("/film-actors/1/2", resp.Header.Get("Location"))
+	out, resp = do("GET", "/film-actors/1/2", "")
+	r.Equal(200, resp.StatusCode)
+	r.Equal(map[string]any{"film_id": float64(1), "actor_id": float64(2), "note": nil}, out)
+	_, resp = do("PATCH", "/film-actors/1/2", `{"note": "x"}`)
+	r.Equal(405, resp.StatusCode)
+	_, resp = do("DELETE", "/film-actors/1/2", "")
+	r.Equal(204, resp.StatusCode)
+
+	// no primary key
+	out, resp = do("POST", "/logs", `{}`)
+	r.Equal(201, resp.StatusCode)
+	r.Equal("", resp.Header.Get("Location"))
+	r.Equal(map[string]any{"msg": "none"}, out)
+	out, _ = do("GET", "/logs", "")
+	r.Len(out, 1)
+	_, resp = do("GET", "/logs/1", "")
+	r.Equal(404, resp.StatusCode)
+
+	s.Stop(time.Second)
+}
+
+const cfgTestServerFilter = `{
+	"version": "1",
+	"listen": "127.0.0.1:60000",
+	"endpoints": [
+		{
+			"uri": "/orders",
+			"implType": "query-json",
+			"script": "select * from (values (1, 'paid', 10.5, 'ann'), (2, 'open', 20, 'bob'), (3, 'paid', 30, null), (4, 'void', 5, 'a,b')) as t(id, status, amount, customer) where id >= $1; -- orders\n",
+			"datasource": "default",
+			"params": [ { "name": "min", "in": "query", "type": "integer" } ],
+			"rows": "objects",
+			"filter": {
+				"columns": {
+					"status": [ "eq", "neq", "in" ],
+					"amount": [ "gt", "gte", "lt", "lte" ],
+					"customer": []
+				},
+				"order": [ "id", "amount", "customer" ],
+				"limit": 3,
+				"maxLimit": 10
+			}
+		}
+	],
+	"datasources": [
+		{
+			"name": "default",
+			"timeout": 5
+		}
+	]
+}`
+
+func TestServerFilter(t *testing.T) {
+	r := require.New(t)
+
+	cfg := loadCfg(r, cfgTestServerFilter)
+	s := startServerFull(r, cfg)
+
+	ids := func(q string) []int {
+		body, resp := doGet(r, "http://127.0.0.1:60000/orders?"+q)
+		r.Equal(200, resp.StatusCode, string(body))
+		var out struct {
+			Rows []struct {
+				ID int `json:"id"`
+			} `json:"rows"`
+		}
+		r.Nil(json.Unmarshal(body, &out))
+		ids := []int{}
+		for _, row := range out.Rows {
+			ids = append(ids, row.ID)
+		}
+		return ids
+	}
+
+	r.Equal([]int{1, 2, 3}, ids("min=0"))
+	r.Equal([]int{1, 3}, ids("min=0&status=eq.paid"))
+	r.Equal([]int{3, 1}, ids("min=0&status=eq.paid&order=amount.desc"))
+	r.Equal([]int{3}, ids("min=2&status=eq.paid"))
+	r.Equal([]int{2, 3}, ids("min=0&amount=gt.10.5&amount=lte.30"))
+	r.Equal([]int{1, 2, 4}, ids("min=0&status=not.eq.paid&order=id&limit=10"))
+	r.Equal([]int{1, 4}, ids("min=0&customer=in.(ann,%22a,b%22)&order=id"))
+	r.Equal([]int{3}, ids("min=0&customer=is.null"))
+	r.Equal([]int{1, 4}, ids("min=0&customer=like.a*&order=id"))
+	r.Equal([]int{2, 1}, ids("min=0&order=customer.desc.nullsfirst,id&offset=1&limit=2"))
+	r.Equal([]int{}, ids("min=0&status=in.()"))
+
+	// errors
+	for _, q := range []string{
+		"status=like.p*",                    // operator not allowed
+		"status=paid",                       // no operator
+		"amount=gt.x",                       // invalid value
+		"order=status",                      // not sortable
+		"order=id.up",                       // invalid modifier
+		"limit=11",                          // over max
+		"limit=-1",                          // invalid
+		"customer=in.(a",                    // unterminated list
+		"customer=is.maybe",                 // invalid is
+		"status=eq.a%27%3B%20drop%20x%20--", // bound, no match
+	} {
+		_, resp := doGet(r, "http://127.0.0.1:60000/orders?min=0&"+q)
+		if strings.HasPrefix(q, "status=eq.") {
+			r.Equal(200, resp.StatusCode, q)
+		} else if q == "amount=gt.x" {
+			r.Equal(500, resp.StatusCode, q)
+		} else {
+			r.Equal(400, resp.StatusCode, q)
+		}
+	}
+
+	s.Stop(time.Second)
+}
+
+const cfgTestServerPaginate = `{
+	"version": "1",
+	"listen": "127.0.0.1:60000",
+	"cursorKey": "0123456789abcdef0123456789abcdef",
+	"endpoints": [
+		{
+			"uri": "/items",
+			"implType": "query-json",
+			"script": "select * from (values (1, 'a'), (2, 'b'), (3, 'a'), (4, 'b'), (5, 'a')) as t(id, grp)",
+			"datasource": "default",
+			"rows": "objects",
+			"filter": { "columns": { "grp": [ "eq" ] } },
+			"paginate": { "keys": [ "grp.desc", "id" ], "limit": 2, "maxLimit": 3 }
+		},
+		{
+			"uri": "/items-csv",
+			"implType": "query-csv",
+			"script": "select * from (values (1, 'a'), (2, 'b'), (3, 'a'), (4, 'b'), (5, 'a')) as t(id, grp)",
+			"datasource": "default",
+			"cache": 60,
+			"paginate": { "keys": [ "id.desc" ], "limit": 2 }
+		}
+	],
+	"datasources": [
+		{
+			"name": "default",
+			"timeout": 5
+		}
+	]
+}`
+
+func TestServerPaginate(t *testing.T) {
+	r := require.New(t)
+
+	cfg := loadCfg(r, cfgTestServerPaginate)
+	s := startServerFull(r, cfg)
+
+	type page struct {
+		Rows []struct {
+			ID int `json:"id"`
+		} `json:"rows"`
+		Next string `json:"next"`
+	}
+	get := func(q string) (ids []int, next string, link string) {
+		body, resp := doGet(r, "http://127.0.0.1:60000/items?"+q)
+		r.Equal(200, resp.StatusCode, string(body))
+		var out page
+		r.Nil(json.Unmarshal(body, &out))
+		ids = []int{}
+		for _, row := range out.Rows {
+			ids = append(ids, row.ID)
+		}
+		return ids, out.Next, resp.Header.Get("Link")
+	}
+
+	// walk through the pages, ordered by grp desc, id asc
+	ids, next, link := get("")
+	r.Equal([]int{2, 4}, ids)
+	r.NotEmpty(next)
+	r.Equal(`</items?cursor=`+next+`>; rel="next"`, link)
+	ids, next, _ = get("cursor=" + next)
+	r.Equal([]int{1, 3}, ids)
+	ids, next, link = get("cursor=" + next)
+	r.Equal([]int{5}, ids)
+	r.Empty(next)
+	r.Empty(link)
+
+	// with limit and filter
+	ids, next, link = get("limit=3&grp=eq.a")
+	r.Equal([]int{1, 3, 5}, ids)
+	r.Empty(next)
+	r.Empty(link)
+	ids, next, link = get("limit=1&grp=eq.a")
+	r.Equal([]int{1}, ids)
+	r.Equal(`</items?cursor=`+next+`&grp=eq.a&limit=1>; rel="next"`, link)
+	ids, _, _ = get("limit=3&grp=eq.a&cursor=" + next)
+	r.Equal([]int{3, 5}, ids)
+
+	// csv, from the cache the second time
+	_, next, _ = get("")
+	for i := 0; i < 2; i++ {
+		body, resp := doGet(r, "http://127.0.0.1:60000/items-csv")
+		r.Equal(200, resp.StatusCode)
+		r.Equal("5,a\n4,b\n", string(body))
+		link := resp.Header.Get("Link")
+		r.True(strings.HasPrefix(link, "</items-csv?cursor="), link)
+		body, resp = doGet(r, "http://127.0.0.1:60000"+strings.TrimSuffix(
+			strings.TrimPrefix(link, "<"), `>; rel="next"`))
+		r.Equal(200, resp.StatusCode)
+		r.Equal("3,a\n2,b\n", string(body))
+	}
+
+	// errors
+	for _, q := range []string{
+		"limit=0",                      // invalid
+		"limit=4",                      // over max
+		"cursor=x",                     // invalid
+		"cursor=" + next[1:],           // tampered
+		"cursor=" + next + "&order=id", // order with pagination
+		"cursor=" + next + "&offset=1", // offset with pagination
+	} {
+		_, resp := doGet(r, "http://127.0.0.1:60000/items?"+q)
+		r.Equal(400, resp.StatusCode, q)
+	}
+	// cursor of another endpoint
+	_, resp := doGet(r, "http://127.0.0.1:60000/items-csv?cursor="+next)
+	r.Equal(400, resp.StatusCode)
+
+	s.Stop(time.Second)
+}
+
+const cfgTestServerNamedParams = `{
+	"version": "1",
+	"listen": "127.0.0.1:60000",
+	"endpoints": [
+		{
+			"uri": "/named",
+			"implType": "query-json",
+			"script": "select :b::int - @a::int as d, ':a' as lit, $$@a$$ as dq, array[1,2,3][2:3] as arr, array[4,5,6][2 : 3] as arr2, array[4,5,6][1 : :a::int] as arr3, array[:a::int, :b::int] as ab, (select @v from (values (-3)) as t(v)) as abs /* :c */ -- @d\n",
+			"datasource": "default",
+			"rows": "objects",
+			"params": [
+				{ "name": "a", "in": "query", "type": "integer", "required": true },
+				{ "name": "b", "in": "query", "type": "integer", "required": true }
+			]
+		},
+		{
+			"uri": "/named-batch",
+			"implType": "batch",
+			"datasource": "default",
+			"params": [
+				{ "name": "a", "in": "query", "type": "integer", "required": true },
+				{ "name": "b", "in": "query", "type": "integer", "required": true }
+			],
+			"steps": [
+				{ "name": "one", "mode": "query", "script": "select :b::int, $1::int", "params": [ "a" ] },
+				{ "name": "two", "mode": "query", "script": "select @b::int * :b" }
+			]
+		}
+	],
+	"datasources": [
+		{
+			"name": "default",
+			"timeout": 5
+		}
+	]
+}`
+
+func TestServerNamedParams(t *testing.T) {
+	r := require.New(t)
+
+	cfg := loadCfg(r, cfgTestServerNamedParams)
+	s := startServerFull(r, cfg)
+
+	// named params are bound, but not inside literals and comments
+	body, resp := doGet(r, "http://127.0.0.1:60000/named?a=2&b=10")
+	r.Equal(200, resp.StatusCode, string(body))
+	var result struct {
+		Rows []struct {
+			D    int    `json:"d"`
+			Lit  string `json:"lit"`
+			DQ   string `json:"dq"`
+			Arr  []int  `json:"arr"`
+			Arr2 []int  `json:"arr2"`
+			Arr3 []int  `json:"arr3"`
+			AB   []int  `json:"ab"`
+			Abs  int    `json:"abs"`
+		} `json:"rows"`
+	}
+	r.Nil(json.Unmarshal(body, &result))
+	r.Len(result.Rows, 1)
+	r.Equal(8, result.Rows[0].D)
+	r.Equal(":a", result.Rows[0].Lit)
+	r.Equal("@a", result.Rows[0].DQ)
+	r.Equal([]int{2, 3}, result.Rows[0].Arr)
+	r.Equal([]int{5, 6}, result.Rows[0].Arr2) // spaced slice, not a param
+	r.Equal([]int{4, 5}, result.Rows[0].Arr3)
+	r.Equal([]int{2, 10}, result.Rows[0].AB)
+	r.Equal(3, result.Rows[0].Abs) // @ operator, not a param
+
+	// the configuration itself is not modified
+	r.Contains(cfg.Endpoints[0].Script, ":b::int - @a::int")
+
+	// in batch steps, names are appended to the step's params
+	body, resp = doGet(r, "http://127.0.0.1:60000/named-batch?a=2&b=10")
+	r.Equal(200, resp.StatusCode, string(body))
+	var bresult struct {
+		One struct {
+			Rows [][]int64 `json:"rows"`
+		} `json:"one"`
+		Two struct {
+			Rows [][]int64 `json:"rows"`
+		} `json:"two"`
+	}
+	r.Nil(json.Unmarshal(body, &bresult))
+	r.Equal([][]int64{{10, 2}}, bresult.One.Rows)
+	r.Equal([][]int64{{100}}, bresult.Two.Rows)
+
+	s.Stop(time.Second * 5)
+}
+
+const cfgTestServerBodySchema = `{
+	"version": "1",
+	"listen": "127.0.0.1:60000",
+	"endpoints": [
+		{
+			"uri": "/body",
+			"implType": "query-json",
+			"script": "select :body->>'name' as name, jsonb_array_length(:body->'tags') as n, :k as k",
+			"datasource": "default",
+			"rows": "objects",
+			"params": [
+				{ "name": "k", "in": "query", "type": "integer" }
+			],
+			"bodySchema": {
+				"type": "object",
+				"required": [ "name", "tags" ],
+				"properties": {
+					"name": { "type": "string" },
+					"tags": { "type": "array", "items": { "type": "string" } }
+				}
+			}
+		},
+		{
+			"uri": "/body-batch",
+			"implType": "batch",
+			"datasource": "default",
+			"bodySchema": { "type": "array", "items": { "type": "integer" } },
+			"steps": [
+				{ "name": "sum", "mode": "query", "script": "select sum(x::int) from jsonb_array_elements_text(:body) as t(x)" },
+				{ "name": "len", "mode": "query", "script": "select jsonb_array_length($1::jsonb)", "params": [ "body" ] }
+			]
+		}
+	],
+	"datasources": [
+		{
+			"name": "default",
+			"timeout": 5
+		}
+	]
+}`
+
+func TestServerBodySchema(t *testing.T) {
+	r := require.New(t)
+
+	cfg := loadCfg(r, cfgTestServerBodySchema)
+	s := startServerFull(r, cfg)
+
+	// the body is available as a jsonb bind variable
+	body, resp := doPostJSON(r, "http://127.0.0.1:60000/body?k=3",
+		map[string]any{"name": "a", "tags": []string{"x", "y"}})
+	r.Equal(200, resp.StatusCode, string(body))
+	var result struct {
+		Rows []struct {
+			Name string `json:"name"`
+			N    int    `json:"n"`
+			K    int    `json:"k"`
+		} `json:"rows"`
+	}
+	r.Nil(json.Unmarshal(body, &result))
+	r.Len(result.Rows, 1)
+	r.Equal("a", result.Rows[0].Name)
+	r.Equal(2, result.Rows[0].N)
+	r.Equal(3, result.Rows[0].K)
+
+	body, resp = doPostJSON(r, "http://127.0.0.1:60000/body?k=3", map[string]any{"name": "a"})
+	r.Equal(400, resp.StatusCode)
+	r.Contains(string(body), `property "tags" is required`)
+
+	// and to batch steps
+	resp, err := http.Post("http://127.0.0.1:60000/body-batch", "application/json",
+		strings.NewReader("[1, 2, 3]"))
+	r.Nil(err)
+	body, err = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	r.Nil(err)
+	r.Equal(200, resp.StatusCode, string(body))
+	var bresult struct {
+		Sum struct {
+			Rows [][]int64 `json:"rows"`
+		} `json:"sum"`
+		Len struct {
+			Rows [][]int64 `json:"rows"`
+		} `json:"len"`
+	}
+	r.Nil(json.Unmarshal(body, &bresult))
+	r.Equal([][]int64{{6}}, bresult.Sum.Rows)
+	r.Equal([][]int64{{3}}, bresult.Len.Rows)
+
+	s.Stop(time.Second * 5)
+}
+
 const cfgTestServerBadDS = `{
 	"version": "1",
 	"listen": "127.0.0.1:60000",
@@ -0,0 +1,278 @@
+/*
+ * Copyright 2022 RapidLoop, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rapidrows
+
+import (
+	"strings"
+)
+
+// sqlToken is a token of interest found in a SQL statement, from sql[start]
+// up to sql[end].
+type sqlToken struct {
+	start, end int
+}
+
+// sqlCodeRanges returns the parts of a SQL statement that are not string
+// constants, quoted identifiers, dollar-quoted strings or comments.
+func sqlCodeRanges(sql string) (ranges []sqlToken) {
+	n := len(sql)
+	start, i := 0, 0
+	for i < n {
+		end, _ := sqlNonCode(sql, i)
+		if end == i {
+			i++
+			continue
+		}
+		if i > start {
+			ranges = append(ranges, sqlToken{start, i})
+		}
+		start, i = end, end
+	}
+	if start < n {
+		ranges = append(ranges, sqlToken{start, n})
+	}
+	return
+}
+
+// sqlNonCode returns the end of the string constant, quoted identifier,
+// dollar-quoted string or comment that starts at sql[i], and whether it is a
+// comment. If none starts there, end is i.
+func sqlNonCode(sql string, i int) (end int, comment bool) {
+	n := len(sql)
+	c := sql[i]
+	switch {
+	case c == '\'':
+		// E'..' strings can have backslash escapes
+		escapes := i > 0 && (sql[i-1] == 'E' || sql[i-1] == 'e') &&
+			(i < 2 || !isIdentChar(sql[i-2]))
+		return scanQuoted(sql, i, '\'', escapes), false
+	case c == '"':
+		return scanQuoted(sql, i, '"', false), false
+	case c == '-' && i+1 < n && sql[i+1] == '-':
+		if j := strings.IndexByte(sql[i:], '\n'); j >= 0 {
+			return i + j + 1, true
+		}
+		return n, true
+	case c == '/' && i+1 < n && sql[i+1] == '*':
+		return scanBlockComment(sql, i), true
+	case c == '$' && (i == 0 || !isIdentChar(sql[i-1])):
+		tag := dollarTag(sql[i:])
+		if tag == "" {
+			return i, false
+		}
+		if j := strings.Index(sql[i+len(tag):], tag); j >= 0 {
+			return i + len(tag) + j + len(tag), false
+		}
+		return n, false
+	}
+	return i, false
+}
+
+// sqlTrimEnd returns the SQL statement without any trailing whitespace,
+// semicolons and comments.
+func sqlTrimEnd(sql string) string {
+	b := []byte(sql)
+	for i := 0; i < len(sql); {
+		end, comment := sqlNonCode(sql, i)
+		if end == i {
+			i++
+			continue
+		}
+		if comment {
+			for j := i; j < end; j++ {
+				b[j] = ' '
+			}
+		}
+		i = end
+	}
+	return sql[:len(strings.TrimRight(string(b), " \t\r\n\f;"))]
+}
+
+// sqlPlaceholders returns the positions of the positional parameters ($1,
+// $2 etc.) in a SQL statement, along with their numbers.
+func sqlPlaceholders(sql string) (toks []sqlToken, nums []int) {
+	for _, r := range sqlCodeRanges(sql) {
+		for i := r.start; i < r.end; i++ {
+			if sql[i] != '$' || (i > 0 && isIdentChar(sql[i-1])) {
+				continue
+			}
+			j, num := i+1, 0
+			for j < r.end && sql[j] >= '0' && sql[j] <= '9' && num < 1e6 {
+				num = num*10 + int(sql[j]-'0')
+				j++
+			}
+			if j > i+1 {
+				toks = append(toks, sqlToken{i, j})
+				nums = append(nums, num)
+			}
+			i = j - 1
+		}
+	}
+	return
+}
+
+// scanQuoted returns the offset just after the end of the quoted string or
+// identifier starting at sql[i]. A doubled quote character does not end it.
+func scanQuoted(sql string, i int, q byte, escapes bool) int {
+	for j := i + 1; j < len(sql); j++ {
+		if escapes && sql[j] == '\\' {
+			j++
+		} else if sql[j] == q {
+			if j+1 < len(sql) && sql[j+1] == q {
+				j++
+			} else {
+				return j + 1
+			}
+		}
+	}
+	return len(sql)
+}
+
+// scanBlockComment returns the offset just after the end of the (possibly
+// nested) block comment starting at sql[i].
+func scanBlockComment(sql string, i int) int {
+	depth := 0
+	for j := i; j+1 < len(sql); j++ {
+		if sql[j] == '/' && sql[j+1] == '*' {
+			depth++
+			j++
+		} else if sql[j] == '*' && sql[j+1] == '/' {
+			depth--
+			j++
+			if depth == 0 {
+				return j + 1
+			}
+		}
+	}
+	return len(sql)
+}
+
+// dollarTag returns the tag ($$ or $name$) that starts a dollar-quoted string
+// at the start of s, or an empty string if there isn't one.
+func dollarTag(s string) string {
+	if len(s) < 2 || s[0] != '$' {
+		return ""
+	}
+	if c := s[1]; c != '$' && c != '_' && c < 0x80 &&
+		!(c >= 'A' && c <= 'Z') && !(c >= 'a' && c <= 'z') {
+		return ""
+	}
+	for j := 1; j < len(s); j++ {
+		if s[j] == '$' {
+			return s[:j+1]
+		} else if !isIdentChar(s[j]) {
+			return ""
+		}
+	}
+	return ""
+}
+
+func isIdentChar(c byte) bool {
+	return c == '_' || c == '$' || c >= 0x80 || (c >= 'A' && c <= 'Z') ||
+		(c >= 'a' && c <= 'z') || (c >= '0' && c <= '9')
+}
+
+// sqlNamedParams returns the positions of the named parameters (:name or
+// @name) in a SQL statement, along with their names. Type casts (::type),
+// array slices (a[lo:hi], a[lo : hi]) and operators like @> are not named
+// parameters.
+func sqlNamedParams(sql string) (toks []sqlToken, names []string) {
+	depth := 0 // of [] subscripts and array constructors
+	for _, r := range sqlCodeRanges(sql) {
+		for i := r.start; i < r.end; i++ {
+			c := sql[i]
+			if c == '[' {
+				depth++
+			} else if c == ']' && depth > 0 {
+				depth--
+			}
+			if (c != ':' && c != '@') || (i > 0 && (isIdentChar(sql[i-1]) || sql[i-1] == c)) {
+				continue
+			}
+			if c == ':' && depth > 0 && isSliceColon(sql, i) {
+				continue
+			}
+			if i+1 >= r.end || !isIdentStart(sql[i+1]) {
+				continue
+			}
+			j := i + 2
+			for j < r.end && isIdentChar(sql[j]) && sql[j] != '$' {
+				j++
+			}
+			toks = append(toks, sqlToken{i, j})
+			names = append(names, sql[i+1:j])
+			i = j - 1
+		}
+	}
+	return
+}
+
+// isSliceColon returns true if the colon at sql[i], which is within brackets,
+// is part of an array slice rather than the start of a named parameter, that
+// is, if it follows (possibly with whitespace in between) a word, a number, a
+// quoted value or a closing bracket as the lower bound, or the opening
+// bracket of a subscript with the lower bound omitted.
+func isSliceColon(sql string, i int) bool {
+	for i--; i >= 0; i-- {
+		switch c := sql[i]; c {
+		case ' ', '\t', '\n', '\r':
+			continue
+		case ')', ']', '\'', '"':
+			return true
+		case '[':
+			return !isArrayCtor(sql, i)
+		default:
+			return isIdentChar(c)
+		}
+	}
+	return false
+}
+
+// isArrayCtor returns true if the opening bracket at sql[i] starts an array
+// constructor, ARRAY[...], rather than a subscript.
+func isArrayCtor(sql string, i int) bool {
+	for i > 0 && (sql[i-1] == ' ' || sql[i-1] == '\t' || sql[i-1] == '\n' || sql[i-1] == '\r') {
+		i--
+	}
+	return i >= 5 && strings.EqualFold(sql[i-5:i], "array") && (i == 5 || !isIdentChar(sql[i-6]))
+}
+
+// bindNamedParams rewrites the named parameters in a SQL statement into the
+// positional parameters $1, $2 etc. bind returns the positional parameter
+// for a name, named parameters for which it returns an empty string are left
+// as they are.
+func bindNamedParams(sql string, bind func(name string) string) string {
+	toks, names := sqlNamedParams(sql)
+	if len(toks) == 0 {
+		return sql
+	}
+	var b strings.Builder
+	last := 0
+	for i, tok := range toks {
+		if pp := bind(names[i]); pp != "" {
+			b.WriteString(sql[last:tok.start])
+			b.WriteString(pp)
+			last = tok.end
+		}
+	}
+	b.WriteString(sql[last:])
+	return b.String()
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || c >= 0x80 || (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z')
+}
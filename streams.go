@@ -53,6 +53,24 @@ func (a *APIServer) startNotifDispatchers() error {
 		add(s.Datasource, s.Channel)
 	}
 
+	// also the channels that invalidate the cached results of endpoints
+	type invalidation struct {
+		pgchan string
+		ep     *Endpoint
+	}
+	ds2inv := make(map[string][]invalidation)
+	for i := range a.cfg.Endpoints {
+		ep := &a.cfg.Endpoints[i]
+		if !ep.cachesResults() {
+			continue
+		}
+		for _, inv := range ep.InvalidateOn {
+			add(inv.Datasource, inv.Channel)
+			ds2inv[inv.Datasource] = append(ds2inv[inv.Datasource],
+				invalidation{pgchan: inv.Channel, ep: ep})
+		}
+	}
+
 	// open a long-lived connection to each datasource, and start a notifDispatcher
 	// on that
 	connsToClose := make([]*pgx.Conn, 0, len(ds2pgchans))
@@ -73,6 +91,9 @@ func (a *APIServer) startNotifDispatchers() error {
 		}
 		a.nd.Store(ds, nd)
 		connsToClose = append(connsToClose, conn)
+		for _, inv := range ds2inv[ds] {
+			nd.register(inv.pgchan, &cacheInvalidator{a: a, ep: inv.ep})
+		}
 		a.logger.Info().Str("datasource", ds).Strs("channels", pgchans).
 			Msg("started notification dispatcher")
 	}
@@ -161,6 +182,13 @@ func (a *APIServer) serveStream(resp http.ResponseWriter, req *http.Request, s *
 
 //------------------------------------------------------------------------------
 
+// notifReceiver is implemented by the consumers of notifications dispatched
+// by a notifDispatcher. accept is called with the payload of each notification
+// and must NOT block.
+type notifReceiver interface {
+	accept(payload string)
+}
+
 // notifWriter writes out the payloads of pgconn.Notification objects into
 // a *websocket.Conn. It does not have a dedicated goroutine, it's event loop
 // is meant to be hosted by the http handler goroutine.
@@ -445,21 +473,21 @@ const (
 type notifDisptacherCmd struct {
 	act     int
 	channel string
-	writer  *notifWriter
+	writer  notifReceiver
 }
 
-func (nd *notifDispatcher) register(pgchan string, writer *notifWriter) {
+func (nd *notifDispatcher) register(pgchan string, writer notifReceiver) {
 	nd.cmd <- notifDisptacherCmd{act: actRegister, channel: pgchan, writer: writer}
 }
 
-func (nd *notifDispatcher) unregister(pgchan string, writer *notifWriter) {
+func (nd *notifDispatcher) unregister(pgchan string, writer notifReceiver) {
 	nd.cmd <- notifDisptacherCmd{act: actUnregister, channel: pgchan, writer: writer}
 }
 
 func (nd *notifDispatcher) dispatcher() {
-	// a map of pgchan -> all *notifWriter interested in that pgchan
-	c2ws := make(map[string][]*notifWriter)
-	unregister := func(c string, w2 *notifWriter) {
+	// a map of pgchan -> all notifReceivers interested in that pgchan
+	c2ws := make(map[string][]notifReceiver)
+	unregister := func(c string, w2 notifReceiver) {
 		if ws, ok := c2ws[c]; ok {
 			for i, w := range ws {
 				if w == w2 {
@@ -500,3 +528,12 @@ func pick[T any](cond bool, ifyes, ifno T) T {
 	}
 	return ifno
 }
+
+func contains[T comparable](a []T, v T) bool {
+	for _, e := range a {
+		if e == v {
+			return true
+		}
+	}
+	return false
+}
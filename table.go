@@ -0,0 +1,562 @@
+/*
+ * Copyright 2022 RapidLoop, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rapidrows
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/rs/zerolog"
+)
+
+// tableColumn is a column of the table of a table type endpoint.
+type tableColumn struct {
+	name     string
+	ident    string // quoted name
+	param    Param  // used to validate values for this column
+	readOnly bool   // generated columns, cannot be written to
+}
+
+// tableInfo is the structure of the table of a table type endpoint, as read
+// from the datasource when the server starts.
+type tableInfo struct {
+	table   string // quoted name
+	columns []tableColumn
+	pkey    []int // indexes into columns of the primary key, in order
+}
+
+func (ti *tableInfo) column(name string) *tableColumn {
+	for i := range ti.columns {
+		if ti.columns[i].name == name {
+			return &ti.columns[i]
+		}
+	}
+	return nil
+}
+
+// tableKeyParam is the prefix of the names of the chi URL parameters that
+// hold the primary key values.
+const tableKeyParam = "key"
+
+const sqlTableColumns = `
+SELECT a.attname, t.typname, coalesce(e.typname, ''),
+       a.attgenerated <> '' OR a.attidentity = 'a'
+  FROM pg_attribute a
+  JOIN pg_type d ON d.oid = a.atttypid
+  JOIN pg_type t ON t.oid = CASE WHEN d.typtype = 'd' THEN d.typbasetype ELSE d.oid END
+  LEFT JOIN pg_type e ON e.oid = t.typelem AND t.typcategory = 'A'
+ WHERE a.attrelid = $1::regclass AND a.attnum > 0 AND NOT a.attisdropped
+ ORDER BY a.attnum`
+
+const sqlTablePKey = `
+SELECT a.attname
+  FROM pg_index i
+  JOIN LATERAL unnest(i.indkey::int2[]) WITH ORDINALITY AS k(attnum, n) ON true
+  JOIN pg_attribute a ON a.attrelid = i.indrelid AND a.attnum = k.attnum
+ WHERE i.indrelid = $1::regclass AND i.indisprimary
+ ORDER BY k.n`
+
+// prepareTables reads the structure of the tables of all table type
+// endpoints from their datasources.
+func (a *APIServer) prepareTables() error {
+	for i := range a.cfg.Endpoints {
+		ep := &a.cfg.Endpoints[i]
+		if ep.ImplType != "table" {
+			continue
+		}
+		var ti *tableInfo
+		err := a.ds.withConn(ep.Datasource, func(conn *pgxpool.Conn) (err error) {
+			ti, err = loadTableInfo(a.bgctx, conn, ep.Table)
+			return
+		})
+		if err != nil {
+			a.logger.Error().Str("endpoint", ep.URI).Str("table", ep.Table).Err(err).
+				Msg("failed to read table structure")
+			return err
+		}
+		a.tables.Store(ep.URI, ti)
+	}
+	return nil
+}
+
+func loadTableInfo(ctx context.Context, q querier, table string) (*tableInfo, error) {
+	ti := &tableInfo{table: pgx.Identifier(strings.Split(table, ".")).Sanitize()}
+
+	// columns
+	rows, err := q.Query(ctx, sqlTableColumns, ti.table)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var name, typ, elem string
+		var readOnly bool
+		if err := rows.Scan(&name, &typ, &elem, &readOnly); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ti.columns = append(ti.columns, tableColumn{
+			name:     name,
+			ident:    pgx.Identifier{name}.Sanitize(),
+			param:    columnParam(name, typ, elem),
+			readOnly: readOnly,
+		})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(ti.columns) == 0 {
+		return nil, fmt.Errorf("table %s has no columns", ti.table)
+	}
+
+	// primary key
+	rows, err = q.Query(ctx, sqlTablePKey, ti.table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		for i := range ti.columns {
+			if ti.columns[i].name == name {
+				ti.pkey = append(ti.pkey, i)
+				break
+			}
+		}
+	}
+	return ti, rows.Err()
+}
+
+// columnParam returns the parameter that is used to validate the values of
+// a column, given the names of its type and its element type, if it is an
+// array. Values of types not listed here are passed as strings, to be parsed
+// by the server.
+func columnParam(name, typ, elem string) (p Param) {
+	scalar := func(t string) string {
+		switch t {
+		case "int2", "int4", "int8":
+			return "integer"
+		case "float4", "float8", "numeric":
+			return "number"
+		case "bool":
+			return "boolean"
+		case "text", "varchar", "bpchar", "name", "citext":
+			return "string"
+		}
+		return ""
+	}
+	p = Param{Name: name, In: "body", Type: "string"}
+	switch {
+	case elem != "":
+		if et := scalar(elem); et != "" {
+			p.Type, p.ElemType = "array", et
+		}
+	case typ == "numeric":
+		p.Type = "decimal"
+	case typ == "date" || typ == "time" || typ == "uuid":
+		p.Type = typ
+	case typ == "timestamp" || typ == "timestamptz":
+		p.Type = "timestamp"
+	case typ == "json" || typ == "jsonb":
+		p.Type = "json"
+	case scalar(typ) != "":
+		p.Type = scalar(typ)
+	}
+	switch typ {
+	case "int2":
+		p.Minimum, p.Maximum = ptrTo(float64(math.MinInt16)), ptrTo(float64(math.MaxInt16))
+	case "int4":
+		p.Minimum, p.Maximum = ptrTo(float64(math.MinInt32)), ptrTo(float64(math.MaxInt32))
+	}
+	return p
+}
+
+func ptrTo[T any](v T) *T {
+	return &v
+}
+
+//------------------------------------------------------------------------------
+// serving
+
+// setupTable adds the routes for a table type endpoint, for the methods that
+// are allowed.
+func (a *APIServer) setupTable(r *chi.Mux, ep *Endpoint, handler http.HandlerFunc) {
+	ti := a.tableInfo(ep)
+	allowed := func(m string) bool {
+		return len(ep.Methods) == 0 || contains(ep.Methods, m)
+	}
+	uri := a.cfg.CommonPrefix + ep.URI
+	for _, m := range []string{"GET", "POST"} {
+		if allowed(m) {
+			r.Method(m, uri, handler)
+		}
+	}
+	if len(ti.pkey) == 0 {
+		return
+	}
+	item := strings.TrimSuffix(uri, "/")
+	for i := range ti.pkey {
+		item += fmt.Sprintf("/{%s%d}", tableKeyParam, i)
+	}
+	for _, m := range []string{"GET", "PUT", "PATCH", "DELETE"} {
+		if allowed(m) {
+			r.Method(m, item, handler)
+		}
+	}
+}
+
+func (a *APIServer) tableInfo(ep *Endpoint) *tableInfo {
+	v, _ := a.tables.Load(ep.URI)
+	ti, _ := v.(*tableInfo)
+	return ti
+}
+
+// tableError is an error in the request to a table type endpoint.
+type tableError struct {
+	code int
+	msg  string
+}
+
+func (e *tableError) Error() string {
+	return e.msg
+}
+
+func newTableError(code int, format string, args ...any) error {
+	return &tableError{code: code, msg: fmt.Sprintf(format, args...)}
+}
+
+// tableErrorCode returns the HTTP status code for an error that occured
+// while serving a table type endpoint.
+func tableErrorCode(err error) int {
+	var te *tableError
+	var pgErr *pgconn.PgError
+	if errors.As(err, &te) {
+		return te.code
+	} else if errors.As(err, &pgErr) {
+		switch {
+		case pgErr.Code == "23503" || pgErr.Code == "23505" || pgErr.Code == "23P01":
+			// foreign key, unique and exclusion violations
+			return http.StatusConflict
+		case strings.HasPrefix(pgErr.Code, "22") || strings.HasPrefix(pgErr.Code, "23"):
+			// data exceptions and other integrity constraint violations
+			return http.StatusBadRequest
+		}
+	}
+	return http.StatusInternalServerError
+}
+
+func (a *APIServer) serveTable(resp http.ResponseWriter, req *http.Request,
+	ep *Endpoint, logger zerolog.Logger) {
+
+	// Do debug logs only if debugging is turned on for this endpoint. Caller
+	// can also wrap in "if ep.Debug" to avoid compute.
+	debug := func() *zerolog.Event {
+		e := logger.Debug()
+		if !ep.Debug {
+			e = e.Discard()
+		}
+		return e
+	}
+
+	// helper function to write errors
+	writeError := func(err error) {
+		logger.Error().Err(err).Str("method", req.Method).Msg("table request failed")
+		resp.Header().Set("Content-Type", "application/json")
+		resp.WriteHeader(tableErrorCode(err))
+		if err2 := json.NewEncoder(resp).Encode(map[string]string{"error": err.Error()}); err2 != nil {
+			logger.Error().Err(err2).Msg("error writing response")
+		}
+	}
+
+	// make the sql
+	ti := a.tableInfo(ep)
+	sql, args, err := a.tableSQL(req, ep, ti)
+	if err != nil {
+		writeError(err)
+		return
+	}
+	if ep.Debug {
+		debug().Str("sql", sql).Msg("running table query")
+	}
+
+	// make context
+	ctx, cancel := a.queryContext(ep)
+	defer cancel()
+
+	// run the query, each row of the result has the row as a JSON object
+	// and, for inserts, the values of the primary key
+	var results [][]string
+	tq := time.Now()
+	cb := func(q querier) error {
+		rows, err := q.Query(ctx, sql, args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			vals := make([]string, len(rows.FieldDescriptions()))
+			ptrs := make([]any, len(vals))
+			for i := range vals {
+				ptrs[i] = &vals[i]
+			}
+			if err := rows.Scan(ptrs...); err != nil {
+				return err
+			}
+			results = append(results, vals)
+		}
+		return rows.Err()
+	}
+	if err := a.ds.withTx(ep.Datasource, ep.TxOptions, cb); err != nil {
+		writeError(err)
+		return
+	}
+	debug().Float64("elapsed", float64(time.Since(tq))/1e6).Int("rows", len(results)).
+		Msg("table query completed successfully")
+
+	// write output
+	isItem := tableKeyCount(req) > 0
+	if isItem && len(results) == 0 {
+		writeError(newTableError(http.StatusNotFound, "row not found"))
+		return
+	}
+	code := http.StatusOK
+	var out []byte
+	switch {
+	case req.Method == "DELETE":
+		resp.WriteHeader(http.StatusNoContent)
+		return
+	case req.Method == "POST":
+		if len(results) == 0 {
+			// a trigger or rule can cause the insert to be skipped
+			writeError(newTableError(http.StatusConflict, "row was not inserted"))
+			return
+		}
+		loc := a.cfg.CommonPrefix + strings.TrimSuffix(ep.URI, "/")
+		for _, k := range results[0][1:] {
+			loc += "/" + url.PathEscape(k)
+		}
+		if len(ti.pkey) > 0 {
+			resp.Header().Set("Location", loc)
+		}
+		code, out = http.StatusCreated, []byte(results[0][0])
+	case isItem:
+		out = []byte(results[0][0])
+	default:
+		out = append(out, '[')
+		for i, r := range results {
+			if i > 0 {
+				out = append(out, ',')
+			}
+			out = append(out, r[0]...)
+		}
+		out = append(out, ']')
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	resp.WriteHeader(code)
+	if _, err := resp.Write(append(out, '\n')); err != nil {
+		logger.Error().Err(err).Msg("error writing response")
+	}
+}
+
+// tableKeyCount returns the number of primary key values in the URL of the
+// request.
+func tableKeyCount(req *http.Request) (n int) {
+	if rctx := chi.RouteContext(req.Context()); rctx != nil {
+		for _, k := range rctx.URLParams.Keys {
+			if strings.HasPrefix(k, tableKeyParam) {
+				n++
+			}
+		}
+	}
+	return
+}
+
+// tableMaxBodySize is the maximum size of the JSON object in the request
+// body of a table type endpoint.
+const tableMaxBodySize = 1 << 20
+
+// tableMaxRows is the maximum number of rows returned when listing the rows
+// of a table type endpoint, and the default if the request has no limit.
+const tableMaxRows = 1000
+
+// tableLimits returns the limit and offset for listing the rows of a table
+// type endpoint, from the query parameters of the request.
+func tableLimits(req *http.Request) (limit, offset int64, err error) {
+	q := req.URL.Query()
+	limit = tableMaxRows
+	if v := q.Get("limit"); v != "" {
+		if limit, err = strconv.ParseInt(v, 10, 64); err != nil || limit < 0 {
+			return 0, 0, newTableError(http.StatusBadRequest, "limit %q: not a valid number of rows", v)
+		} else if limit > tableMaxRows {
+			return 0, 0, newTableError(http.StatusBadRequest, "limit %q: exceeds the maximum of %d", v, tableMaxRows)
+		}
+	}
+	if v := q.Get("offset"); v != "" {
+		if offset, err = strconv.ParseInt(v, 10, 64); err != nil || offset < 0 {
+			return 0, 0, newTableError(http.StatusBadRequest, "offset %q: not a valid number of rows", v)
+		}
+	}
+	return
+}
+
+// tableSQL returns the SQL statement and its arguments for a request to a
+// table type endpoint.
+func (a *APIServer) tableSQL(req *http.Request, ep *Endpoint, ti *tableInfo) (string, []any, error) {
+	var args []any
+	arg := func(v any) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+	const row = "row_to_json(t.*)::text"
+
+	// the WHERE clause for the primary key, if present in the url
+	var where string
+	if tableKeyCount(req) > 0 {
+		conds := make([]string, len(ti.pkey))
+		for i, ci := range ti.pkey {
+			c := &ti.columns[ci]
+			k := chi.URLParam(req, fmt.Sprintf("%s%d", tableKeyParam, i))
+			v, err := a.isSuitable(ep, &c.param, k)
+			if err != nil {
+				return "", nil, newTableError(http.StatusBadRequest, "column %q: invalid value: %v", c.name, err)
+			}
+			conds[i] = c.ident + " = " + arg(v)
+		}
+		where = " WHERE " + strings.Join(conds, " AND ")
+	}
+
+	switch req.Method {
+	case "GET":
+		sql := "SELECT " + row + " FROM " + ti.table + " AS t" + where
+		if where != "" {
+			return sql, args, nil
+		}
+		if len(ti.pkey) > 0 {
+			keys := make([]string, len(ti.pkey))
+			for i, ci := range ti.pkey {
+				keys[i] = ti.columns[ci].ident
+			}
+			sql += " ORDER BY " + strings.Join(keys, ", ")
+		}
+		limit, offset, err := tableLimits(req)
+		if err != nil {
+			return "", nil, err
+		}
+		sql += " LIMIT " + arg(limit)
+		if offset > 0 {
+			sql += " OFFSET " + arg(offset)
+		}
+		return sql, args, nil
+	case "DELETE":
+		return "DELETE FROM " + ti.table + " AS t" + where + " RETURNING " + row, args, nil
+	}
+
+	// POST, PUT and PATCH have a JSON object in the body
+	values, err := a.tableValues(req, ep, ti)
+	if err != nil {
+		return "", nil, err
+	}
+	var cols, vals []string
+	for i := range ti.columns {
+		c := &ti.columns[i]
+		if v, ok := values[c.name]; ok {
+			cols = append(cols, c.ident)
+			vals = append(vals, arg(v))
+		} else if req.Method == "PUT" && !c.readOnly && !contains(ti.pkey, i) {
+			cols = append(cols, c.ident)
+			vals = append(vals, "DEFAULT")
+		}
+	}
+	if req.Method == "POST" {
+		returning := []string{row}
+		for _, ci := range ti.pkey {
+			returning = append(returning, "t."+ti.columns[ci].ident+"::text")
+		}
+		sql := "INSERT INTO " + ti.table + " AS t"
+		if len(cols) == 0 {
+			sql += " DEFAULT VALUES"
+		} else {
+			sql += " (" + strings.Join(cols, ", ") + ") VALUES (" + strings.Join(vals, ", ") + ")"
+		}
+		return sql + " RETURNING " + strings.Join(returning, ", "), args, nil
+	}
+	if len(cols) == 0 {
+		return "", nil, newTableError(http.StatusBadRequest, "no columns to update")
+	}
+	sets := make([]string, len(cols))
+	for i := range cols {
+		sets[i] = cols[i] + " = " + vals[i]
+	}
+	return "UPDATE " + ti.table + " AS t SET " + strings.Join(sets, ", ") + where +
+		" RETURNING " + row, args, nil
+}
+
+// tableValues reads the JSON object in the request body and returns the
+// validated values of the columns in it.
+func (a *APIServer) tableValues(req *http.Request, ep *Endpoint, ti *tableInfo) (map[string]any, error) {
+	// limit both the body as sent and as decompressed
+	req.Body = http.MaxBytesReader(nil, req.Body, tableMaxBodySize)
+	body, err := decodeBody(req)
+	if err != nil {
+		return nil, newTableError(http.StatusBadRequest, "%v", err)
+	}
+	defer body.Close()
+	var obj map[string]any
+	dec := json.NewDecoder(http.MaxBytesReader(nil, body, tableMaxBodySize))
+	dec.UseNumber()
+	if err := dec.Decode(&obj); err != nil {
+		var mbe *http.MaxBytesError
+		if errors.As(err, &mbe) {
+			return nil, newTableError(http.StatusRequestEntityTooLarge,
+				"request body too large (limit is %d bytes)", mbe.Limit)
+		}
+		return nil, newTableError(http.StatusBadRequest, "request body must be a JSON object")
+	} else if obj == nil {
+		return nil, newTableError(http.StatusBadRequest, "request body must be a JSON object")
+	}
+	values := make(map[string]any, len(obj))
+	for k, v := range obj {
+		c := ti.column(k)
+		if c == nil {
+			return nil, newTableError(http.StatusBadRequest, "unknown column %q", k)
+		} else if c.readOnly {
+			return nil, newTableError(http.StatusBadRequest, "column %q cannot be written to", k)
+		}
+		if v == nil {
+			values[k] = nil
+		} else if v2, err := a.isSuitable(ep, &c.param, v); err != nil {
+			return nil, newTableError(http.StatusBadRequest, "column %q: invalid value: %v", k, err)
+		} else {
+			values[k] = v2
+		}
+	}
+	return values, nil
+}
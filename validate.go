@@ -25,6 +25,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/robfig/cron/v3"
 	"golang.org/x/mod/semver"
@@ -54,6 +55,19 @@ var (
 	rxPrefix = regexp.MustCompile(`^(/[A-Za-z0-9_.-]+)+$`)
 )
 
+// rxIdent matches an unquoted PostgreSQL identifier. Letters include all
+// non-ASCII characters, as in PostgreSQL.
+var rxIdent = regexp.MustCompile(`^[A-Za-z_\x{80}-\x{10FFFF}][A-Za-z_\x{80}-\x{10FFFF}0-9$]*$`)
+
+// maxIdentLen is the length in bytes beyond which PostgreSQL truncates
+// identifiers.
+const maxIdentLen = 63
+
+// isIdentifier returns true if s is a valid unquoted PostgreSQL identifier.
+func isIdentifier(s string) bool {
+	return len(s) <= maxIdentLen && rxIdent.MatchString(s)
+}
+
 func (c *APIServerConfig) validate() (r []ValidationResult) {
 	// Version
 	if !semver.IsValid("v" + c.Version) {
@@ -91,6 +105,18 @@ func (c *APIServerConfig) validate() (r []ValidationResult) {
 		epURIs[c.Endpoints[i].URI] += 1
 		r = append(r, c.Endpoints[i].validate(c.Datasources)...)
 	}
+	// CursorKey, required for paginated endpoints
+	for i := range c.Endpoints {
+		if c.Endpoints[i].Paginate == nil || !isQueryType(c.Endpoints[i].ImplType) {
+			continue
+		}
+		if c.CursorKey == "" {
+			r = addError(r, "cursor key must be specified for paginated endpoints")
+		} else if len(c.CursorKey) < 32 {
+			r = addWarn(r, "cursor key should be at least 32 characters long")
+		}
+		break
+	}
 	// check uniqueness of endpoint URIs
 	for u, c := range epURIs {
 		if c > 1 {
@@ -181,6 +207,20 @@ var (
 	rxMethod = regexp.MustCompile(`^((GET)|(POST)|(PUT)|(PATCH)|(DELETE))$`)
 )
 
+// isQueryType returns true if the implementation type is query or one of the
+// query-* types.
+func isQueryType(implType string) bool {
+	switch implType {
+	case "query", "query-json", "query-ndjson", "query-csv", "query-arrow", "query-parquet":
+		return true
+	}
+	return false
+}
+
+func isExportType(implType string) bool {
+	return implType == "export-csv" || implType == "export-binary"
+}
+
 func (ep *Endpoint) validate(ds []Datasource) (r []ValidationResult) {
 	// URI
 	if !rxURI.MatchString(ep.URI) && ep.URI != "/" {
@@ -207,15 +247,16 @@ func (ep *Endpoint) validate(ds []Datasource) (r []ValidationResult) {
 		}
 	}
 	// ImplType
-	if ep.ImplType != "query-json" && ep.ImplType != "query-csv" &&
-		ep.ImplType != "exec" && ep.ImplType != "static-text" &&
+	if !isQueryType(ep.ImplType) &&
+		ep.ImplType != "exec" && ep.ImplType != "batch" && ep.ImplType != "ingest" &&
+		!isExportType(ep.ImplType) && ep.ImplType != "table" && ep.ImplType != "static-text" &&
 		ep.ImplType != "static-json" && ep.ImplType != "javascript" {
 		r = addError(r, fmt.Sprintf("endpoint %q: invalid implementation type %q",
 			ep.URI, ep.ImplType))
 	}
 	// Datasource
-	if ep.ImplType == "query-json" || ep.ImplType == "query-csv" ||
-		ep.ImplType == "exec" {
+	if isQueryType(ep.ImplType) || ep.ImplType == "exec" || ep.ImplType == "batch" ||
+		ep.ImplType == "ingest" || isExportType(ep.ImplType) || ep.ImplType == "table" {
 		found := false
 		for i := range ds {
 			if ds[i].Name == ep.Datasource {
@@ -229,7 +270,8 @@ func (ep *Endpoint) validate(ds []Datasource) (r []ValidationResult) {
 		}
 	}
 	// Script
-	if len(strings.TrimSpace(ep.Script)) == 0 && ep.ImplType != "static-text" {
+	if len(strings.TrimSpace(ep.Script)) == 0 && ep.ImplType != "static-text" &&
+		ep.ImplType != "batch" && ep.ImplType != "ingest" && ep.ImplType != "table" {
 		r = addError(r, fmt.Sprintf("endpoint %q: invalid script: empty",
 			ep.URI))
 	}
@@ -237,6 +279,27 @@ func (ep *Endpoint) validate(ds []Datasource) (r []ValidationResult) {
 		r = addError(r, fmt.Sprintf("endpoint %q: invalid script: invalid json",
 			ep.URI))
 	}
+	if isExportType(ep.ImplType) {
+		// params are substituted by us, so check the placeholders now
+		_, nums := sqlPlaceholders(ep.Script)
+		nparams := len(ep.Params)
+		if ep.hasBody() {
+			nparams++
+		}
+		for _, n := range nums {
+			if n < 1 || n > nparams {
+				r = addError(r, fmt.Sprintf("endpoint %q: invalid script: no param for $%d",
+					ep.URI, n))
+				break
+			}
+		}
+	}
+	if hasSQLScript(ep.ImplType) {
+		// unused params need not be an error for exports, as they are
+		// substituted by us
+		r = append(r, ep.validateNamedParams(fmt.Sprintf("endpoint %q: script:", ep.URI),
+			ep.Script, !isExportType(ep.ImplType))...)
+	}
 	// TxOptions
 	if ep.TxOptions != nil {
 		r = append(r, ep.TxOptions.validate(fmt.Sprintf("endpoint %q:", ep.URI))...)
@@ -250,6 +313,375 @@ func (ep *Endpoint) validate(ds []Datasource) (r []ValidationResult) {
 	if ep.Cache != nil && *ep.Cache <= 0 {
 		r = addWarn(r, fmt.Sprintf("endpoint %q: cache ttl %g is <=0, will be ignored",
 			ep.URI, *ep.Cache))
+	} else if ep.Cache != nil && ep.hasPerRequestParams() {
+		r = addWarn(r, fmt.Sprintf("endpoint %q: cache is not applicable if params have the source 'now' or 'requestID', will be ignored",
+			ep.URI))
+	}
+	// StaleWhileRevalidate
+	if ep.StaleWhileRevalidate != nil && *ep.StaleWhileRevalidate <= 0 {
+		r = addWarn(r, fmt.Sprintf("endpoint %q: staleWhileRevalidate %g is <=0, will be ignored",
+			ep.URI, *ep.StaleWhileRevalidate))
+	} else if ep.StaleWhileRevalidate != nil && (ep.Cache == nil || *ep.Cache <= 0) {
+		r = addWarn(r, fmt.Sprintf("endpoint %q: staleWhileRevalidate is applicable only if cache is set, will be ignored",
+			ep.URI))
+	} else if ep.StaleWhileRevalidate != nil && !isQueryType(ep.ImplType) {
+		r = addWarn(r, fmt.Sprintf("endpoint %q: staleWhileRevalidate is applicable only for query types, will be ignored",
+			ep.URI))
+	} else if ep.StaleWhileRevalidate != nil && ep.Stream && ep.Paginate == nil {
+		r = addWarn(r, fmt.Sprintf("endpoint %q: staleWhileRevalidate is not applicable for streamed endpoints, will be ignored",
+			ep.URI))
+	}
+	// CacheControl
+	if strings.ContainsAny(ep.CacheControl, "\r\n") {
+		r = addError(r, fmt.Sprintf("endpoint %q: cacheControl cannot contain newlines",
+			ep.URI))
+	} else if ep.CacheControl != "" && !isQueryType(ep.ImplType) {
+		r = addWarn(r, fmt.Sprintf("endpoint %q: cacheControl is applicable only for query types, will be ignored",
+			ep.URI))
+	}
+	// InvalidateOn
+	for i, inv := range ep.InvalidateOn {
+		if !isIdentifier(inv.Channel) {
+			r = addError(r, fmt.Sprintf("endpoint %q: invalidateOn #%d: invalid channel %q",
+				ep.URI, i+1, inv.Channel))
+		}
+		found := false
+		for j := range ds {
+			if ds[j].Name == inv.Datasource {
+				found = true
+				break
+			}
+		}
+		if !found {
+			r = addError(r, fmt.Sprintf("endpoint %q: invalidateOn #%d: unknown datasource %q",
+				ep.URI, i+1, inv.Datasource))
+		}
+	}
+	if len(ep.InvalidateOn) > 0 && (ep.Cache == nil || *ep.Cache <= 0) {
+		r = addWarn(r, fmt.Sprintf("endpoint %q: invalidateOn is applicable only if cache is set, will be ignored",
+			ep.URI))
+	}
+	// Rows
+	if ep.Rows != "" && ep.Rows != "arrays" && ep.Rows != "objects" {
+		r = addError(r, fmt.Sprintf("endpoint %q: invalid rows %q, must be one of 'arrays' or 'objects'",
+			ep.URI, ep.Rows))
+	} else if ep.Rows != "" && ep.ImplType != "query-json" && ep.ImplType != "query-ndjson" && ep.ImplType != "query" {
+		r = addWarn(r, fmt.Sprintf("endpoint %q: rows is applicable only for query-json, query-ndjson and query, will be ignored",
+			ep.URI))
+	}
+	// Columns
+	if ep.Columns && ep.ImplType != "query-json" && ep.ImplType != "query" {
+		r = addWarn(r, fmt.Sprintf("endpoint %q: columns is applicable only for query-json and query, will be ignored",
+			ep.URI))
+	} else if ep.Columns && ep.Rows == "objects" {
+		r = addWarn(r, fmt.Sprintf("endpoint %q: columns is not applicable if rows is 'objects', will be ignored",
+			ep.URI))
+	}
+	// Stream
+	if ep.Stream && !isQueryType(ep.ImplType) {
+		r = addWarn(r, fmt.Sprintf("endpoint %q: stream is applicable only for query-* types, will be ignored",
+			ep.URI))
+	}
+	// CSV
+	if ep.CSV != nil {
+		r = append(r, ep.CSV.validate(fmt.Sprintf("endpoint %q:", ep.URI))...)
+		if ep.ImplType != "query-csv" && ep.ImplType != "query" && ep.ImplType != "ingest" &&
+			ep.ImplType != "export-csv" {
+			r = addWarn(r, fmt.Sprintf("endpoint %q: csv is applicable only for query-csv, query, ingest and export-csv, will be ignored",
+				ep.URI))
+		} else if ep.ImplType == "export-csv" && (ep.CSV.CRLF || ep.CSV.Quote == "nonnumeric") {
+			r = addWarn(r, fmt.Sprintf("endpoint %q: csv crlf and quote 'nonnumeric' are not supported for export-csv, will be ignored",
+				ep.URI))
+		}
+	}
+	// Formats, Format
+	for _, f := range ep.Formats {
+		if !contains(queryFormats, f) {
+			r = addError(r, fmt.Sprintf("endpoint %q: invalid format %q, must be one of '%s'",
+				ep.URI, f, strings.Join(queryFormats, "', '")))
+		}
+	}
+	if ep.Format != "" {
+		if !contains(queryFormats, ep.Format) {
+			r = addError(r, fmt.Sprintf("endpoint %q: invalid format %q, must be one of '%s'",
+				ep.URI, ep.Format, strings.Join(queryFormats, "', '")))
+		} else if formats, _ := formatsOf(ep); !contains(formats, ep.Format) {
+			r = addError(r, fmt.Sprintf("endpoint %q: format %q is not one of the formats",
+				ep.URI, ep.Format))
+		}
+	}
+	if (len(ep.Formats) > 0 || ep.Format != "") && ep.ImplType != "query" {
+		r = addWarn(r, fmt.Sprintf("endpoint %q: formats and format are applicable only for query, will be ignored",
+			ep.URI))
+	}
+	// Result
+	if ep.Result != "" && ep.Result != "rows" && ep.Result != "single" && ep.Result != "scalar" {
+		r = addError(r, fmt.Sprintf("endpoint %q: invalid result %q, must be one of 'rows', 'single' or 'scalar'",
+			ep.URI, ep.Result))
+	} else if ep.Result != "" && ep.ImplType != "query-json" && ep.ImplType != "query" {
+		r = addWarn(r, fmt.Sprintf("endpoint %q: result is applicable only for query-json and query, will be ignored",
+			ep.URI))
+	} else if (ep.Result == "single" || ep.Result == "scalar") && ep.Stream {
+		r = addWarn(r, fmt.Sprintf("endpoint %q: stream is not applicable if result is %q, will be ignored",
+			ep.URI, ep.Result))
+	}
+	// Filter
+	if ep.Filter != nil && !isQueryType(ep.ImplType) {
+		r = addWarn(r, fmt.Sprintf("endpoint %q: filter is applicable only for query types, will be ignored",
+			ep.URI))
+	} else if ep.Filter != nil {
+		r = append(r, ep.Filter.validate(ep)...)
+	}
+	// Paginate
+	if ep.Paginate != nil && !isQueryType(ep.ImplType) {
+		r = addWarn(r, fmt.Sprintf("endpoint %q: paginate is applicable only for query types, will be ignored",
+			ep.URI))
+	} else if ep.Paginate != nil {
+		r = append(r, ep.Paginate.validate(ep)...)
+	}
+	if ep.ImplType == "query" && paramNames["format"] > 0 {
+		r = addError(r, fmt.Sprintf("endpoint %q: param name \"format\" is reserved for endpoints of type query",
+			ep.URI))
+	}
+	// BodySchema
+	if ep.BodySchema != nil && !ep.hasBody() {
+		r = addWarn(r, fmt.Sprintf("endpoint %q: bodySchema is applicable only for query types, exec, export types, batch and javascript, will be ignored",
+			ep.URI))
+	} else if ep.BodySchema != nil {
+		if _, err := compileSchema(ep.BodySchema, ""); err != nil {
+			r = addError(r, fmt.Sprintf("endpoint %q: invalid bodySchema: %v", ep.URI, err))
+		}
+		if paramNames["body"] > 0 {
+			r = addError(r, fmt.Sprintf("endpoint %q: param name \"body\" is reserved if bodySchema is specified",
+				ep.URI))
+		}
+		for i := range ep.Params {
+			if ep.Params[i].In == "body" {
+				r = addError(r, fmt.Sprintf("endpoint %q: param %q: cannot be in body if bodySchema is specified",
+					ep.URI, ep.Params[i].Name))
+			}
+		}
+		if len(ep.Methods) == 0 || contains(ep.Methods, "GET") {
+			r = addWarn(r, fmt.Sprintf("endpoint %q: bodySchema requires a request body, GET requests will fail; set methods to POST, PUT or PATCH",
+				ep.URI))
+		}
+		// the body can be listed in the params of batch steps
+		paramNames["body"]++
+	}
+	// Steps
+	if ep.ImplType == "batch" && len(ep.Steps) == 0 {
+		r = addError(r, fmt.Sprintf("endpoint %q: steps must be specified for batch",
+			ep.URI))
+	} else if len(ep.Steps) > 0 && ep.ImplType != "batch" {
+		r = addWarn(r, fmt.Sprintf("endpoint %q: steps are applicable only for batch, will be ignored",
+			ep.URI))
+	}
+	stepNames := make(map[string]int)
+	for i := range ep.Steps {
+		stepNames[ep.Steps[i].Name] += 1
+		r = append(r, ep.Steps[i].validate(ep.URI, i, paramNames)...)
+	}
+	for n, c := range stepNames {
+		if c > 1 {
+			r = addError(r, fmt.Sprintf("endpoint %q: %d steps named %q",
+				ep.URI, c, n))
+		}
+	}
+	// Ingest
+	if ep.ImplType == "ingest" && ep.Ingest == nil {
+		r = addError(r, fmt.Sprintf("endpoint %q: ingest must be specified for ingest",
+			ep.URI))
+	} else if ep.Ingest != nil && ep.ImplType != "ingest" {
+		r = addWarn(r, fmt.Sprintf("endpoint %q: ingest is applicable only for ingest, will be ignored",
+			ep.URI))
+	} else if ep.Ingest != nil {
+		r = append(r, ep.Ingest.validate(ep.URI)...)
+		r = append(r, ep.validateNamedParams(fmt.Sprintf("endpoint %q: ingest: merge:", ep.URI),
+			ep.Ingest.Merge, true)...)
+	}
+	if ep.ImplType == "ingest" {
+		for i := range ep.Params {
+			if ep.Params[i].In == "body" {
+				r = addError(r, fmt.Sprintf("endpoint %q: param %q: cannot be in body for ingest",
+					ep.URI, ep.Params[i].Name))
+			}
+		}
+	}
+	// Table
+	if ep.ImplType == "table" && ep.Table == "" {
+		r = addError(r, fmt.Sprintf("endpoint %q: table must be specified for table",
+			ep.URI))
+	} else if ep.Table != "" && ep.ImplType != "table" {
+		r = addWarn(r, fmt.Sprintf("endpoint %q: table is applicable only for table, will be ignored",
+			ep.URI))
+	} else if ep.Table != "" && !isTableName(ep.Table) {
+		r = addError(r, fmt.Sprintf("endpoint %q: invalid table %q", ep.URI, ep.Table))
+	}
+	if ep.ImplType == "table" {
+		if strings.Contains(ep.URI, "{") {
+			r = addError(r, fmt.Sprintf("endpoint %q: URI cannot have parameters for table",
+				ep.URI))
+		}
+		if len(ep.Params) > 0 {
+			r = addWarn(r, fmt.Sprintf("endpoint %q: params are not applicable for table, will be ignored",
+				ep.URI))
+		}
+	}
+	return
+}
+
+// validateNamedParams checks the named parameters (:name or @name) in a SQL
+// statement of the endpoint. Each name must be that of a param, and if any
+// names are used, each param must be used either by name or as $1, $2 etc.
+// Unused params are reported as errors if strict is set, else as warnings.
+func (ep *Endpoint) validateNamedParams(pfx, sql string, strict bool) (r []ValidationResult) {
+	toks, names := sqlNamedParams(sql)
+	used := make(map[string]bool)
+	for i, name := range names {
+		if ep.paramPos(name) != 0 {
+			used[name] = true
+		} else if sql[toks[i].start] == ':' && !used[name] {
+			// unknown @names are left alone, they may be operators
+			r = addError(r, fmt.Sprintf("%s unknown param %q", pfx, name))
+			used[name] = true
+		}
+	}
+	if len(used) == 0 {
+		return
+	}
+	_, nums := sqlPlaceholders(sql)
+	for _, n := range nums {
+		if n >= 1 && n <= len(ep.Params) {
+			used[ep.Params[n-1].Name] = true
+		}
+	}
+	for i := range ep.Params {
+		if name := ep.Params[i].Name; !used[name] {
+			msg := fmt.Sprintf("%s param %q is not used", pfx, name)
+			if strict {
+				r = addError(r, msg)
+			} else {
+				r = addWarn(r, msg)
+			}
+		}
+	}
+	return
+}
+
+//------------------------------------------------------------------------------
+// endpoint -> batchstep
+
+func (s *BatchStep) validate(u string, i int, paramNames map[string]int) (r []ValidationResult) {
+	// Name
+	if !rxParamName.MatchString(s.Name) {
+		r = addError(r, fmt.Sprintf("endpoint %q: step #%d: invalid name %q",
+			u, i+1, s.Name))
+	}
+	// Mode
+	if s.Mode != "query" && s.Mode != "exec" {
+		r = addError(r, fmt.Sprintf("endpoint %q: step %q: invalid mode %q, must be one of 'query' or 'exec'",
+			u, s.Name, s.Mode))
+	}
+	// Script
+	if len(strings.TrimSpace(s.Script)) == 0 {
+		r = addError(r, fmt.Sprintf("endpoint %q: step %q: invalid script: empty",
+			u, s.Name))
+	}
+	// Params
+	for _, p := range s.Params {
+		if paramNames[p] == 0 {
+			r = addError(r, fmt.Sprintf("endpoint %q: step %q: unknown param %q",
+				u, s.Name, p))
+		}
+	}
+	toks, names := sqlNamedParams(s.Script)
+	for i, p := range names {
+		if paramNames[p] == 0 && s.Script[toks[i].start] == ':' {
+			r = addError(r, fmt.Sprintf("endpoint %q: step %q: script: unknown param %q",
+				u, s.Name, p))
+		}
+	}
+	return
+}
+
+//------------------------------------------------------------------------------
+// endpoint -> ingestoptions
+
+// isTableName returns true if s is an identifier, optionally qualified with
+// the schema name.
+func isTableName(s string) bool {
+	parts := strings.Split(s, ".")
+	for _, p := range parts {
+		if !isIdentifier(p) {
+			return false
+		}
+	}
+	return len(parts) <= 2
+}
+
+func (ing *IngestOptions) validate(u string) (r []ValidationResult) {
+	// Table
+	if !isTableName(ing.Table) {
+		r = addError(r, fmt.Sprintf("endpoint %q: ingest: invalid table %q",
+			u, ing.Table))
+	}
+	// Format
+	if ing.Format != "" && ing.Format != "csv" && ing.Format != "ndjson" && ing.Format != "json" {
+		r = addError(r, fmt.Sprintf("endpoint %q: ingest: invalid format %q, must be one of 'csv', 'ndjson' or 'json'",
+			u, ing.Format))
+	}
+	// Columns
+	for f, c := range ing.Columns {
+		if f == "" || c == "" {
+			r = addError(r, fmt.Sprintf("endpoint %q: ingest: invalid column mapping %q to %q",
+				u, f, c))
+		}
+	}
+	if ing.Columns != nil && len(ing.Columns) == 0 {
+		r = addError(r, fmt.Sprintf("endpoint %q: ingest: columns must not be empty if specified",
+			u))
+	}
+	targets := make(map[string]string, len(ing.Columns))
+	for _, f := range sortedKeys(ing.Columns) {
+		c := ing.Columns[f]
+		if f2, ok := targets[c]; ok && c != "" {
+			r = addError(r, fmt.Sprintf("endpoint %q: ingest: fields %q and %q both map to column %q",
+				u, f2, f, c))
+		}
+		targets[c] = f
+	}
+	// Staging
+	if ing.Staging != "" && !isIdentifier(ing.Staging) {
+		r = addError(r, fmt.Sprintf("endpoint %q: ingest: invalid staging table %q",
+			u, ing.Staging))
+	}
+	// Merge
+	if ing.Staging != "" && len(strings.TrimSpace(ing.Merge)) == 0 {
+		r = addError(r, fmt.Sprintf("endpoint %q: ingest: merge is required if staging is set",
+			u))
+	}
+	return
+}
+
+//------------------------------------------------------------------------------
+// endpoint -> csvoptions
+
+func (c *CSVOptions) validate(pfx string) (r []ValidationResult) {
+	// Delimiter (empty = comma)
+	if c.Delimiter != "" && c.Delimiter != "comma" && c.Delimiter != "tab" &&
+		c.Delimiter != "semicolon" {
+		r = addError(r, fmt.Sprintf("%s csv: invalid delimiter %q, must be one of 'comma', 'tab' or 'semicolon'",
+			pfx, c.Delimiter))
+	}
+	// Quote (empty = minimal)
+	if c.Quote != "" && c.Quote != "minimal" && c.Quote != "all" &&
+		c.Quote != "nonnumeric" {
+		r = addError(r, fmt.Sprintf("%s csv: invalid quote %q, must be one of 'minimal', 'all' or 'nonnumeric'",
+			pfx, c.Quote))
+	}
+	// Null
+	if strings.ContainsAny(c.Null, "\r\n") {
+		r = addError(r, fmt.Sprintf("%s csv: null string cannot contain newlines", pfx))
 	}
 	return
 }
@@ -279,6 +711,8 @@ func (tx *TxOptions) validate(pfx string) (r []ValidationResult) {
 
 var rxParamName = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]*$`)
 
+var rxMediaType = regexp.MustCompile(`^([A-Za-z0-9][A-Za-z0-9!#$&^_.+-]*/([A-Za-z0-9][A-Za-z0-9!#$&^_.+-]*|\*)|\*/\*)$`)
+
 func (p *Param) validate(u string) (r []ValidationResult) {
 	pfx := fmt.Sprintf("endpoint %q: param %q:", u, p.Name)
 	isint := func(v any) (ok bool) { _, ok = v.(int64); return }
@@ -291,18 +725,64 @@ func (p *Param) validate(u string) (r []ValidationResult) {
 		r = addError(r, fmt.Sprintf("%s invalid name", pfx))
 	}
 	// In
-	if p.In != "query" && p.In != "path" && p.In != "body" {
+	if p.Source != "" {
+		if p.In != "" {
+			r = addError(r, fmt.Sprintf("%s location cannot be specified if source is specified",
+				pfx))
+		}
+	} else if p.In != "query" && p.In != "path" && p.In != "body" && p.In != "header" &&
+		p.In != "cookie" {
 		r = addError(r, fmt.Sprintf("%s invalid location %q", pfx, p.In))
 	}
+	// Source
+	switch p.Source {
+	case "":
+	case "now":
+		//	- type must be timestamp
+		if p.Type != "timestamp" {
+			r = addError(r, fmt.Sprintf("%s source 'now' can be used only for params of type timestamp",
+				pfx))
+		}
+	case "clientIP", "requestID":
+		//	- type must be string
+		if p.Type != "string" {
+			r = addError(r, fmt.Sprintf("%s source '%s' can be used only for params of type string",
+				pfx, p.Source))
+		}
+	case "claim":
+		//	- claim must be specified
+		if p.Claim == "" {
+			r = addError(r, fmt.Sprintf("%s claim must be specified if source is 'claim'",
+				pfx))
+		}
+		//	- type cannot be file
+		if p.Type == "file" {
+			r = addError(r, fmt.Sprintf("%s source 'claim' cannot be used for params of type file",
+				pfx))
+		}
+	default:
+		r = addError(r, fmt.Sprintf("%s invalid source %q", pfx, p.Source))
+	}
+	// Claim
+	if p.Claim != "" && p.Source != "claim" {
+		r = addError(r, fmt.Sprintf("%s claim can be specified only if source is 'claim'",
+			pfx))
+	}
 	// Type
 	if p.Type != "integer" && p.Type != "number" && p.Type != "string" &&
-		p.Type != "boolean" && p.Type != "array" {
+		p.Type != "boolean" && p.Type != "array" && p.Type != "file" &&
+		p.Type != "decimal" && !isTemporal(p.Type) && p.Type != "uuid" &&
+		p.Type != "json" {
 		r = addError(r, fmt.Sprintf("%s invalid type %q", pfx, p.Type))
 	}
 	// if type is 'array', disallow in = 'path'
 	if p.Type == "array" && p.In == "path" {
 		r = addError(r, fmt.Sprintf("%s type 'array' cannot occur in 'path'", pfx))
 	}
+	// if type is 'file', allow only in = 'body'
+	if p.Type == "file" && p.In != "body" {
+		r = addError(r, fmt.Sprintf("%s type 'file' can occur only in 'body'", pfx))
+	}
 	// Enum
 	if len(p.Enum) > 0 {
 		//	- type must be integer or number or string
@@ -360,9 +840,9 @@ func (p *Param) validate(u string) (r []ValidationResult) {
 	}
 	// Minimum
 	if p.Minimum != nil {
-		//	- type must be integer or number
-		if p.Type != "integer" && p.Type != "number" {
-			r = addError(r, fmt.Sprintf("%s minimum can be specified only for params of type integer or number",
+		//	- type must be integer, number or decimal
+		if p.Type != "integer" && p.Type != "number" && p.Type != "decimal" {
+			r = addError(r, fmt.Sprintf("%s minimum can be specified only for params of type integer, number or decimal",
 				pfx))
 		}
 		//	- frac. part must be 0 if type is integer
@@ -376,9 +856,9 @@ func (p *Param) validate(u string) (r []ValidationResult) {
 	}
 	// Maximum
 	if p.Maximum != nil {
-		//	- type must be integer or number
-		if p.Type != "integer" && p.Type != "number" {
-			r = addError(r, fmt.Sprintf("%s maximum can be specified only for params of type integer or number",
+		//	- type must be integer, number or decimal
+		if p.Type != "integer" && p.Type != "number" && p.Type != "decimal" {
+			r = addError(r, fmt.Sprintf("%s maximum can be specified only for params of type integer, number or decimal",
 				pfx))
 		}
 		//	- frac. part must be 0 if type is integer
@@ -397,6 +877,35 @@ func (p *Param) validate(u string) (r []ValidationResult) {
 			}
 		}
 	}
+	// Earliest
+	var earliest time.Time
+	if len(p.Earliest) > 0 {
+		//	- type must be date, time or timestamp
+		if !isTemporal(p.Type) {
+			r = addError(r, fmt.Sprintf("%s earliest can be specified only for params of type date, time or timestamp",
+				pfx))
+		} else if t, _, err := parseTemporal(p.Type, p.Earliest); err != nil {
+			//	- must be a valid value of the type
+			r = addError(r, fmt.Sprintf("%s earliest %q is %v", pfx, p.Earliest, err))
+		} else {
+			earliest = t
+		}
+	}
+	// Latest
+	if len(p.Latest) > 0 {
+		//	- type must be date, time or timestamp
+		if !isTemporal(p.Type) {
+			r = addError(r, fmt.Sprintf("%s latest can be specified only for params of type date, time or timestamp",
+				pfx))
+		} else if t, _, err := parseTemporal(p.Type, p.Latest); err != nil {
+			//	- must be a valid value of the type
+			r = addError(r, fmt.Sprintf("%s latest %q is %v", pfx, p.Latest, err))
+		} else if len(p.Earliest) > 0 && t.Before(earliest) {
+			//	- must not be earlier than earliest if both are specified
+			r = addError(r, fmt.Sprintf("%s latest %q is earlier than earliest %q",
+				pfx, p.Latest, p.Earliest))
+		}
+	}
 	// MaxLength
 	if p.MaxLength != nil {
 		//	- type must be string
@@ -473,13 +982,182 @@ func (p *Param) validate(u string) (r []ValidationResult) {
 				pfx))
 		}
 	}
+	// MaxSize
+	if p.MaxSize != nil {
+		//	- type must be file
+		if p.Type != "file" {
+			r = addError(r, fmt.Sprintf("%s maxSize can be specified only for params of type file",
+				pfx))
+		}
+		//	- must be > 0
+		if *p.MaxSize <= 0 {
+			r = addError(r, fmt.Sprintf("%s maxSize %d should be > 0", pfx,
+				*p.MaxSize))
+		}
+	}
+	// ContentTypes
+	if len(p.ContentTypes) > 0 {
+		//	- type must be file
+		if p.Type != "file" {
+			r = addError(r, fmt.Sprintf("%s contentTypes can be specified only for params of type file",
+				pfx))
+		}
+		//	- must be valid media types
+		for _, ct := range p.ContentTypes {
+			if !rxMediaType.MatchString(ct) {
+				r = addError(r, fmt.Sprintf("%s invalid content type %q", pfx, ct))
+			}
+		}
+	}
+	// Text
+	if p.Text && p.Type != "file" {
+		r = addError(r, fmt.Sprintf("%s text can be specified only for params of type file",
+			pfx))
+	}
+	// Default
+	if p.Default != nil {
+		if p.Type == "file" {
+			//	- type cannot be file
+			r = addError(r, fmt.Sprintf("%s default cannot be specified for params of type file",
+				pfx))
+		} else if p.Required {
+			//	- not used if required
+			r = addWarn(r, fmt.Sprintf("%s default is not used for required params", pfx))
+		} else {
+			//	- must be a valid value, checked the same way as at runtime
+			a := &APIServer{cfg: &APIServerConfig{
+				Endpoints: []Endpoint{{URI: u, Params: []Param{*p}}},
+			}}
+			a.prepareParams()
+			if _, err := a.defaultValue(&a.cfg.Endpoints[0], p); err != nil {
+				r = addError(r, fmt.Sprintf("%s invalid default: %v", pfx, err))
+			}
+		}
+	}
 	return
 }
 
 //------------------------------------------------------------------------------
-// stream
+// endpoint -> filter
+
+func (f *FilterOptions) validate(ep *Endpoint) (r []ValidationResult) {
+	pfx := fmt.Sprintf("endpoint %q: filter:", ep.URI)
 
-var rxPgChan = regexp.MustCompile(`^[A-Za-z\200-\377_][A-Za-z\200-\377_0-9\$]*$`)
+	// names of query parameters that are already in use
+	inUse := make(map[string]bool)
+	for i := range ep.Params {
+		if ep.Params[i].In == "query" {
+			inUse[ep.Params[i].Name] = true
+		}
+	}
+	if ep.ImplType == "query" {
+		inUse["format"] = true
+	}
+	for _, n := range filterReserved {
+		if inUse[n] {
+			r = addError(r, fmt.Sprintf("%s query parameter %q is reserved for filtering",
+				pfx, n))
+		}
+	}
+
+	// Columns
+	for c, ops := range f.Columns {
+		if !isIdentifier(c) {
+			r = addError(r, fmt.Sprintf("%s invalid column name %q", pfx, c))
+		} else if contains(filterReserved, c) || inUse[c] {
+			r = addError(r, fmt.Sprintf("%s column %q conflicts with another query parameter",
+				pfx, c))
+		}
+		for _, op := range ops {
+			if _, ok := filterOps[op]; !ok {
+				r = addError(r, fmt.Sprintf("%s column %q: invalid operator %q", pfx, c, op))
+			}
+		}
+	}
+	// Order
+	for _, c := range f.Order {
+		if !isIdentifier(c) {
+			r = addError(r, fmt.Sprintf("%s invalid order column name %q", pfx, c))
+		}
+	}
+	// Limit, MaxLimit
+	if f.Limit < 0 {
+		r = addError(r, fmt.Sprintf("%s limit %d should be >= 0", pfx, f.Limit))
+	}
+	if f.MaxLimit < 0 {
+		r = addError(r, fmt.Sprintf("%s maxLimit %d should be >= 0", pfx, f.MaxLimit))
+	} else if f.MaxLimit > 0 && f.Limit > f.MaxLimit {
+		r = addError(r, fmt.Sprintf("%s limit %d is more than maxLimit %d", pfx,
+			f.Limit, f.MaxLimit))
+	}
+	if len(f.Columns) == 0 && len(f.Order) == 0 && f.Limit == 0 && f.MaxLimit == 0 {
+		r = addWarn(r, fmt.Sprintf("%s no columns, order or limits specified", pfx))
+	}
+	return
+}
+
+//------------------------------------------------------------------------------
+// endpoint -> paginate
+
+func (p *Pagination) validate(ep *Endpoint) (r []ValidationResult) {
+	pfx := fmt.Sprintf("endpoint %q: paginate:", ep.URI)
+
+	// query parameters used for pagination
+	for i := range ep.Params {
+		if ep.Params[i].In == "query" && contains(pageReserved, ep.Params[i].Name) {
+			r = addError(r, fmt.Sprintf("%s query parameter %q is reserved for pagination",
+				pfx, ep.Params[i].Name))
+		}
+	}
+	if ep.Filter != nil {
+		for c := range ep.Filter.Columns {
+			if contains(pageReserved, c) {
+				r = addError(r, fmt.Sprintf("%s filter column %q conflicts with a query parameter used for pagination",
+					pfx, c))
+			}
+		}
+		if len(ep.Filter.Order) > 0 || ep.Filter.Limit != 0 || ep.Filter.MaxLimit != 0 {
+			r = addWarn(r, fmt.Sprintf("%s order, limit and maxLimit of filter are not applicable, will be ignored",
+				pfx))
+		}
+	}
+
+	// Keys
+	if len(p.Keys) == 0 {
+		r = addError(r, fmt.Sprintf("%s keys must be specified", pfx))
+	}
+	seen := make(map[string]bool)
+	for _, k := range p.Keys {
+		if c, _ := pageKey(k); !isIdentifier(c) {
+			r = addError(r, fmt.Sprintf("%s invalid key %q", pfx, k))
+		} else if seen[c] {
+			r = addError(r, fmt.Sprintf("%s duplicate key column %q", pfx, c))
+		} else {
+			seen[c] = true
+		}
+	}
+	// Limit, MaxLimit
+	if p.Limit < 0 {
+		r = addError(r, fmt.Sprintf("%s limit %d should be >= 0", pfx, p.Limit))
+	}
+	if p.MaxLimit < 0 {
+		r = addError(r, fmt.Sprintf("%s maxLimit %d should be >= 0", pfx, p.MaxLimit))
+	} else if p.MaxLimit > 0 && p.Limit > p.MaxLimit {
+		r = addError(r, fmt.Sprintf("%s limit %d is more than maxLimit %d", pfx,
+			p.Limit, p.MaxLimit))
+	}
+	// Result, Stream
+	if ep.Result == "single" || ep.Result == "scalar" {
+		r = addError(r, fmt.Sprintf("%s not applicable if result is %q", pfx, ep.Result))
+	} else if ep.Stream {
+		r = addWarn(r, fmt.Sprintf("%s stream is not applicable for paginated endpoints, will be ignored",
+			pfx))
+	}
+	return
+}
+
+//------------------------------------------------------------------------------
+// stream
 
 func (s *Stream) validate(ds []Datasource) (r []ValidationResult) {
 	// URI
@@ -491,7 +1169,7 @@ func (s *Stream) validate(ds []Datasource) (r []ValidationResult) {
 		r = addError(r, fmt.Sprintf("stream %q: invalid type %q", s.URI, s.Type))
 	}
 	// Channel
-	if !rxPgChan.MatchString(s.Channel) {
+	if !isIdentifier(s.Channel) {
 		r = addError(r, fmt.Sprintf("stream %q: invalid channel %q", s.URI, s.Channel))
 	}
 	// Datasource
@@ -515,7 +1193,6 @@ func (s *Stream) validate(ds []Datasource) (r []ValidationResult) {
 var (
 	rxName    = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_-]*(\.[A-Za-z0-9_][A-Za-z0-9_-]*)*$`)
 	rxPqParam = regexp.MustCompile(`^[a-z]+(_[a-z]+)*$`)
-	rxRole    = regexp.MustCompile(`^[A-Za-z\200-\377_][A-Za-z\200-\377_0-9\$]*$`)
 )
 
 func (d *Datasource) validate() (r []ValidationResult) {
@@ -534,7 +1211,7 @@ func (d *Datasource) validate() (r []ValidationResult) {
 		r = addWarn(r, fmt.Sprintf("datasource %q: timeout %g is <=0, will be ignored",
 			d.Name, *d.Timeout))
 	}
-	if len(d.Role) > 0 && !rxRole.MatchString(d.Role) {
+	if len(d.Role) > 0 && !isIdentifier(d.Role) {
 		r = addError(r, fmt.Sprintf("datasource %q: invalid role %q", d.Name,
 			d.Role))
 	}